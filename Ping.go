@@ -1,70 +1,145 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"os/signal"
+	"time"
+
+	"github.com/lryong/golang-snippets/pinger"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: ", os.Args[0], "host")
+	count := flag.Int("c", 4, "stop after sending count requests, 0 means forever")
+	interval := flag.Duration("i", time.Second, "wait interval between requests")
+	timeout := flag.Duration("W", 2*time.Second, "time to wait for the last reply")
+	size := flag.Int("s", 56, "payload size in bytes")
+	ipv4 := flag.Bool("4", false, "use IPv4 only")
+	ipv6 := flag.Bool("6", false, "use IPv6 only")
+	mode := flag.String("m", "auto", "socket mode: auto, privileged or unprivileged")
+	trace := flag.Bool("t", false, "traceroute mode, needs a privileged socket")
+	maxHops := flag.Int("max-hops", 30, "maximum TTL in traceroute mode")
+	probes := flag.Int("q", 3, "probes per hop in traceroute mode")
+	resolve := flag.Bool("resolve", false, "reverse-resolve hop addresses in traceroute mode")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ", os.Args[0], "[options] host")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	addr, err := net.ResolveIPAddr("ip", os.Args[1])
+	network := "ip"
+	if *ipv4 {
+		network = "ip4"
+	} else if *ipv6 {
+		network = "ip6"
+	}
+
+	if *trace {
+		traceroute(network, flag.Arg(0), *maxHops, *probes, *timeout, *size, *resolve)
+		return
+	}
+
+	p, err := pinger.NewWithNetwork(network, flag.Arg(0))
 	if err != nil {
 		fmt.Println("Resolution error", err.Error())
 		os.Exit(1)
 	}
+	p.Count = *count
+	p.Interval = *interval
+	p.Timeout = *timeout
+	p.Size = *size
+	switch *mode {
+	case "auto":
+		p.Mode = pinger.ModeAuto
+	case "privileged":
+		p.Mode = pinger.ModePrivileged
+	case "unprivileged":
+		p.Mode = pinger.ModeUnprivileged
+	default:
+		fmt.Println("Invalid mode", *mode)
+		os.Exit(1)
+	}
+	p.OnRecv = func(pkt *pinger.Packet) {
+		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v\n", pkt.Bytes, pkt.Addr, pkt.Seq, pkt.RTT)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 
-	conn, err := net.DialIP("ip4:icmp", addr, addr)
+	fmt.Printf("PING %s (%s) %d bytes of data.\n", flag.Arg(0), p.Addr(), p.Size)
+	stats, err := p.Run(ctx)
 	checkError(err)
 
-	var msg [512]byte
-	msg[0] = 8
-	msg[1] = 0
-	msg[2] = 0
-	msg[3] = 0
-	msg[4] = 0
-	msg[5] = 13
-	msg[6] = 0
-	msg[7] = 37
-	len := 8
+	fmt.Printf("\n--- %s ping statistics ---\n", flag.Arg(0))
+	fmt.Printf("%d packets transmitted, %d received, %.1f%% packet loss\n",
+		stats.PacketsSent, stats.PacketsRecv, stats.PacketLoss)
+	if stats.PacketsRecv > 0 {
+		fmt.Printf("rtt min/avg/max/mdev = %v/%v/%v/%v\n",
+			stats.MinRTT, stats.AvgRTT, stats.MaxRTT, stats.StdDevRTT)
+	}
+	if stats.PacketsRecv == 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
 
-	check := checkSum(msg[0:len])
-	msg[2] = byte(check >> 8)
-	msg[3] = byte(check & 255)
+func traceroute(network, host string, maxHops, probes int, timeout time.Duration, size int, resolve bool) {
+	t, err := pinger.NewTracer(network, host)
+	if err != nil {
+		fmt.Println("Resolution error", err.Error())
+		os.Exit(1)
+	}
+	t.MaxHops = maxHops
+	t.Probes = probes
+	t.Timeout = timeout
+	t.Size = size
+	t.ResolveNames = resolve
+	t.OnHop = printHop
 
-	_, err = conn.Write(msg[0:len])
-	checkError(err)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 
-	_, err = conn.Read(msg[0:])
+	fmt.Printf("traceroute to %s (%s), %d hops max\n", host, t.Addr(), maxHops)
+	hops, err := t.Run(ctx)
 	checkError(err)
-
-	fmt.Println("Got response")
-	if msg[5] == 13 {
-		fmt.Println("identifier matches")
-	}
-	if msg[7] == 37 {
-		fmt.Println("Sequence matches")
+	if len(hops) == 0 || !hops[len(hops)-1].Reached {
+		os.Exit(1)
 	}
-
 	os.Exit(0)
 }
 
-func checkSum(msg []byte) uint16 {
-	sum := 0
-
-	for n := 1; n < len(msg)-1; n += 2 {
-		sum += int(msg[n])*256 + int(msg[n+1])
+// printHop prints the responder before the first probe it answered and
+// again whenever it changes, as load balanced paths answer from several
+func printHop(h *pinger.Hop) {
+	fmt.Printf("%2d ", h.TTL)
+	var last net.IP
+	for i, rtt := range h.RTTs {
+		if addr := h.Addrs[i]; addr != nil && !addr.Equal(last) {
+			name := addr.String()
+			if n := h.Names[name]; n != "" {
+				name = n
+			}
+			fmt.Printf(" %s (%s)", name, addr)
+			last = addr
+		}
+		if rtt < 0 {
+			fmt.Print("  *")
+		} else {
+			fmt.Printf("  %.3f ms", float64(rtt)/float64(time.Millisecond))
+		}
+	}
+	if h.Unreachable >= 0 {
+		fmt.Printf(" !%d", h.Unreachable)
 	}
-	sum = (sum >> 16) + (sum & 0xffff)
-	sum += (sum >> 16)
-	var answer uint16 = uint16(^sum)
-	return answer
+	fmt.Println()
 }
 
 func checkError(err error) {
@@ -73,21 +148,3 @@ func checkError(err error) {
 		os.Exit(1)
 	}
 }
-
-func readFully(conn net.Conn) ([]byte, error) {
-	defer conn.Close()
-
-	result := bytes.NewBuffer(nil)
-	var buf [512]byte
-	for {
-		n, err := conn.Read(buf[0:])
-		result.Write(buf[0:n])
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-	}
-	return result.Bytes(), nil
-}
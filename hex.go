@@ -1,8 +1,10 @@
 package main
 
 import (
+	"database/sql/driver"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -28,3 +30,275 @@ func marshalHex(bytes []byte) ([]byte, error) {
 	s := strings.ToUpper(hex.EncodeToString(bytes))
 	return json.Marshal(s)
 }
+
+// HexCodec describes how hex strings are produced and accepted
+type HexCodec struct {
+	// Upper makes the encoder emit upper-cased digits
+	Upper bool
+	// AllowPrefix makes the decoder accept an optional "0x" or "0X" prefix
+	AllowPrefix bool
+}
+
+// DefaultHexCodec is used by HexBytes and the fixed-length hash types.
+// Upper-case output keeps it compatible with marshalHex.
+var DefaultHexCodec = HexCodec{Upper: true}
+
+// EncodeToString returns the hex form of src
+func (c HexCodec) EncodeToString(src []byte) string {
+	s := hex.EncodeToString(src)
+	if c.Upper {
+		s = strings.ToUpper(s)
+	}
+	return s
+}
+
+// DecodeString parses s, which may use either case
+func (c HexCodec) DecodeString(s string) ([]byte, error) {
+	if c.AllowPrefix && len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+	}
+	return hex.DecodeString(s)
+}
+
+// decodeFixed decodes s into dst and fails unless it fills dst exactly
+func (c HexCodec) decodeFixed(dst []byte, s string) error {
+	val, err := c.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(val) != len(dst) {
+		return errors.Errorf("invalid hex length: want %d bytes, got %d", len(dst), len(val))
+	}
+	copy(dst, val)
+	return nil
+}
+
+// EncodeJSON encodes b as a JSON hex string
+func (c HexCodec) EncodeJSON(b []byte) ([]byte, error) {
+	return json.Marshal(c.EncodeToString(b))
+}
+
+// DecodeJSON decodes a JSON hex string into out
+func (c HexCodec) DecodeJSON(bz []byte, out *[]byte) error {
+	var s string
+	if err := json.Unmarshal(bz, &s); err != nil {
+		return errors.Wrap(err, "parse string")
+	}
+	val, err := c.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	// only update object on success
+	*out = val
+	return nil
+}
+
+// DecodeHash32 parses s into a Hash32, rejecting other lengths
+func (c HexCodec) DecodeHash32(s string) (Hash32, error) {
+	var h Hash32
+	err := c.decodeFixed(h[:], s)
+	return h, err
+}
+
+// Hex pairs a byte slice with the codec serializing it, for values
+// that need a case or prefix other than DefaultHexCodec. Codec is
+// set before decoding, the zero codec emits lower case
+type Hex struct {
+	Bytes []byte
+	Codec HexCodec
+}
+
+func (h Hex) String() string {
+	return h.Codec.EncodeToString(h.Bytes)
+}
+
+func (h Hex) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hex) UnmarshalText(text []byte) error {
+	val, err := h.Codec.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	h.Bytes = val
+	return nil
+}
+
+func (h Hex) MarshalJSON() ([]byte, error) {
+	return h.Codec.EncodeJSON(h.Bytes)
+}
+
+func (h *Hex) UnmarshalJSON(bz []byte) error {
+	return h.Codec.DecodeJSON(bz, &h.Bytes)
+}
+
+// HexBytes is a byte slice serialized as a hex string
+// in JSON, text, YAML and SQL
+type HexBytes []byte
+
+// String returns the hex form using DefaultHexCodec
+func (b HexBytes) String() string {
+	return DefaultHexCodec.EncodeToString(b)
+}
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	val, err := DefaultHexCodec.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	// only update object on success
+	*b = val
+	return nil
+}
+
+func (b HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+func (b *HexBytes) UnmarshalJSON(bz []byte) error {
+	var s string
+	if err := json.Unmarshal(bz, &s); err != nil {
+		return errors.Wrap(err, "parse string")
+	}
+	return b.UnmarshalText([]byte(s))
+}
+
+// MarshalYAML implements the yaml.Marshaler interface
+func (b HexBytes) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (b *HexBytes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return errors.Wrap(err, "parse string")
+	}
+	return b.UnmarshalText([]byte(s))
+}
+
+// Value stores the hex string in the database
+func (b HexBytes) Value() (driver.Value, error) {
+	return b.String(), nil
+}
+
+// Scan accepts the hex text stored by Value, either as a string or
+// as the bytes of a text column, NULL scans as nil
+func (b *HexBytes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*b = nil
+		return nil
+	case string:
+		return b.UnmarshalText([]byte(v))
+	case []byte:
+		return b.UnmarshalText(v)
+	default:
+		return errors.Errorf("cannot scan %T into HexBytes", src)
+	}
+}
+
+// Format supports %s, %v, %q, %x and %X, the latter two
+// overriding the case of DefaultHexCodec. The # flag adds a "0x" prefix
+func (b HexBytes) Format(f fmt.State, verb rune) {
+	formatHex(f, verb, b)
+}
+
+func formatHex(f fmt.State, verb rune, b []byte) {
+	prefix := ""
+	if f.Flag('#') {
+		prefix = "0x"
+	}
+	switch verb {
+	case 'x':
+		fmt.Fprint(f, prefix+HexCodec{}.EncodeToString(b))
+	case 'X':
+		fmt.Fprint(f, prefix+HexCodec{Upper: true}.EncodeToString(b))
+	case 'q':
+		fmt.Fprintf(f, "%q", prefix+DefaultHexCodec.EncodeToString(b))
+	case 's', 'v':
+		fmt.Fprint(f, prefix+DefaultHexCodec.EncodeToString(b))
+	default:
+		fmt.Fprintf(f, "%%!%c(HexBytes=%s)", verb, DefaultHexCodec.EncodeToString(b))
+	}
+}
+
+// Hash32 is a fixed 32-byte value such as a SHA-256 digest,
+// decoding rejects input of any other length
+type Hash32 [32]byte
+
+func (h Hash32) String() string {
+	return DefaultHexCodec.EncodeToString(h[:])
+}
+
+func (h Hash32) Bytes() HexBytes {
+	return HexBytes(h[:])
+}
+
+func (h Hash32) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash32) UnmarshalText(text []byte) error {
+	var tmp Hash32
+	if err := DefaultHexCodec.decodeFixed(tmp[:], string(text)); err != nil {
+		return err
+	}
+	*h = tmp
+	return nil
+}
+
+func (h Hash32) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+func (h *Hash32) UnmarshalJSON(bz []byte) error {
+	var s string
+	if err := json.Unmarshal(bz, &s); err != nil {
+		return errors.Wrap(err, "parse string")
+	}
+	return h.UnmarshalText([]byte(s))
+}
+
+// MarshalYAML implements the yaml.Marshaler interface
+func (h Hash32) MarshalYAML() (interface{}, error) {
+	return h.String(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (h *Hash32) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return errors.Wrap(err, "parse string")
+	}
+	return h.UnmarshalText([]byte(s))
+}
+
+func (h Hash32) Value() (driver.Value, error) {
+	return h.String(), nil
+}
+
+// Scan accepts the hex text stored by Value, NULL scans as
+// the zero hash
+func (h *Hash32) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*h = Hash32{}
+		return nil
+	case string:
+		return h.UnmarshalText([]byte(v))
+	case []byte:
+		return h.UnmarshalText(v)
+	default:
+		return errors.Errorf("cannot scan %T into Hash32", src)
+	}
+}
+
+func (h Hash32) Format(f fmt.State, verb rune) {
+	formatHex(f, verb, h[:])
+}
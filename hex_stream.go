@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Streaming variants of marshalHex/unmarshalHex, so large blobs can be
+// written into or read from a JSON document without holding the
+// encoded form in memory.
+
+const streamChunkSize = 32 * 1024
+
+// upperHexWriter upper-cases the lower-case output of hex.NewEncoder,
+// it rewrites p in place which is safe for the encoder's own buffer
+type upperHexWriter struct {
+	w io.Writer
+}
+
+func (u upperHexWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if 'a' <= c && c <= 'f' {
+			p[i] = c - ('a' - 'A')
+		}
+	}
+	return u.w.Write(p)
+}
+
+// NewHexEncoder returns a writer which hex-encodes everything
+// written to it into w, using the case configured in codec
+func NewHexEncoder(w io.Writer, codec HexCodec) io.Writer {
+	if codec.Upper {
+		return hex.NewEncoder(upperHexWriter{w})
+	}
+	return hex.NewEncoder(w)
+}
+
+// NewHexDecoder returns a reader which decodes the hex digits read from r.
+// The "0x" prefix is honoured if codec allows it.
+func NewHexDecoder(r io.Reader, codec HexCodec) io.Reader {
+	if codec.AllowPrefix {
+		br := bufio.NewReader(r)
+		if p, err := br.Peek(2); err == nil && p[0] == '0' && (p[1] == 'x' || p[1] == 'X') {
+			br.Discard(2)
+		}
+		r = br
+	}
+	return hex.NewDecoder(r)
+}
+
+// NewBase64Encoder returns a writer which base64-encodes into w,
+// it must be closed to flush any partially written blocks
+func NewBase64Encoder(w io.Writer, enc *base64.Encoding) io.WriteCloser {
+	return base64.NewEncoder(enc, w)
+}
+
+// NewBase64Decoder returns a reader which decodes base64 read from r
+func NewBase64Decoder(r io.Reader, enc *base64.Encoding) io.Reader {
+	return base64.NewDecoder(enc, r)
+}
+
+// WriteJSONHex copies src into w as a single JSON string token of hex digits
+func WriteJSONHex(w io.Writer, src io.Reader, codec HexCodec) (int64, error) {
+	return writeJSONString(w, func(sw io.Writer) (io.Writer, func() error) {
+		return NewHexEncoder(sw, codec), nil
+	}, src)
+}
+
+// WriteJSONBase64 copies src into w as a single JSON string token in base64
+func WriteJSONBase64(w io.Writer, src io.Reader, enc *base64.Encoding) (int64, error) {
+	return writeJSONString(w, func(sw io.Writer) (io.Writer, func() error) {
+		e := NewBase64Encoder(sw, enc)
+		return e, e.Close
+	}, src)
+}
+
+// writeJSONString wraps the output of an encoder in double quotes,
+// the alphabets of hex and base64 never need escaping
+func writeJSONString(w io.Writer, newEnc func(io.Writer) (io.Writer, func() error), src io.Reader) (int64, error) {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return 0, err
+	}
+	enc, flush := newEnc(w)
+	n, err := io.CopyBuffer(enc, src, make([]byte, streamChunkSize))
+	if err != nil {
+		return n, err
+	}
+	if flush != nil {
+		if err := flush(); err != nil {
+			return n, err
+		}
+	}
+	_, err = io.WriteString(w, `"`)
+	return n, err
+}
+
+// NewJSONHexReader decodes a JSON string token of hex digits read from r.
+// r must be positioned at the opening quote or the separator before it.
+// It is read byte by byte and left right after the closing quote for
+// the tokens that follow. When the token comes from a json.Decoder use
+// bufio.NewReader(io.MultiReader(dec.Buffered(), src)).
+func NewJSONHexReader(r io.ByteReader, codec HexCodec) io.Reader {
+	return NewHexDecoder(newJSONStringReader(r), codec)
+}
+
+// NewJSONBase64Reader decodes a JSON string token in base64 read from r
+func NewJSONBase64Reader(r io.ByteReader, enc *base64.Encoding) io.Reader {
+	return NewBase64Decoder(newJSONStringReader(r), enc)
+}
+
+// jsonStringReader yields the unescaped content of a JSON string token
+// and stops at its closing quote, without reading past it
+type jsonStringReader struct {
+	r io.ByteReader
+	// set when r is a *bufio.Reader, plain runs are copied
+	// from its buffer instead of byte by byte
+	buf     *bufio.Reader
+	started bool
+	// the closing quote was read
+	closed bool
+	// a high surrogate waiting for its low half
+	high rune
+	// UTF-8 of decoded \u escapes not returned yet
+	pending []byte
+}
+
+func newJSONStringReader(r io.ByteReader) *jsonStringReader {
+	j := &jsonStringReader{r: r}
+	j.buf, _ = r.(*bufio.Reader)
+	return j
+}
+
+func (j *jsonStringReader) Read(p []byte) (int, error) {
+	if !j.started {
+		if err := j.skipToQuote(); err != nil {
+			return 0, err
+		}
+		j.started = true
+	}
+
+	n := 0
+	for n < len(p) {
+		if len(j.pending) > 0 {
+			c := copy(p[n:], j.pending)
+			j.pending = j.pending[c:]
+			n += c
+			continue
+		}
+		if j.closed {
+			return n, io.EOF
+		}
+		if j.buf != nil && j.high == 0 {
+			if m := j.copyPlain(p[n:]); m > 0 {
+				n += m
+				continue
+			}
+		}
+		c, r, end, err := j.next()
+		if err != nil {
+			return n, err
+		}
+		if j.high != 0 {
+			// pair it up, a lone half decodes to U+FFFD
+			// like encoding/json does
+			high := j.high
+			j.high = 0
+			if utf16.IsSurrogate(r) && r >= 0xdc00 {
+				j.pending = utf8.AppendRune(j.pending, utf16.DecodeRune(high, r))
+				continue
+			}
+			j.pending = utf8.AppendRune(j.pending, unicode.ReplacementChar)
+		}
+		switch {
+		case r >= 0xd800 && r < 0xdc00:
+			j.high = r
+		case r >= 0:
+			// AppendRune turns a lone low surrogate into U+FFFD
+			j.pending = utf8.AppendRune(j.pending, r)
+		case end:
+			j.closed = true
+		default:
+			if len(j.pending) > 0 {
+				j.pending = append(j.pending, c)
+				continue
+			}
+			p[n] = c
+			n++
+		}
+	}
+	return n, nil
+}
+
+// copyPlain copies the buffered bytes up to the next quote, escape
+// or control character into p
+func (j *jsonStringReader) copyPlain(p []byte) int {
+	b, _ := j.buf.Peek(min(j.buf.Buffered(), len(p)))
+	m := 0
+	for m < len(b) && b[m] != '"' && b[m] != '\\' && b[m] >= 0x20 {
+		m++
+	}
+	copy(p, b[:m])
+	j.buf.Discard(m)
+	return m
+}
+
+// next returns a byte of the string, or the code unit of a \u
+// escape as r, which is negative otherwise. end reports the
+// closing quote
+func (j *jsonStringReader) next() (c byte, r rune, end bool, err error) {
+	c, err = j.readByte()
+	if err != nil {
+		return 0, -1, false, err
+	}
+	switch {
+	case c == '"':
+		return 0, -1, true, nil
+	case c < 0x20:
+		return 0, -1, false, errors.Errorf("invalid control character %q in JSON string", c)
+	case c != '\\':
+		return c, -1, false, nil
+	}
+
+	if c, err = j.readByte(); err != nil {
+		return 0, -1, false, err
+	}
+	switch c {
+	case '"', '\\', '/':
+		return c, -1, false, nil
+	case 'b':
+		return '\b', -1, false, nil
+	case 'f':
+		return '\f', -1, false, nil
+	case 'n':
+		return '\n', -1, false, nil
+	case 'r':
+		return '\r', -1, false, nil
+	case 't':
+		return '\t', -1, false, nil
+	case 'u':
+		r, err = j.readHex4()
+		return 0, r, false, err
+	default:
+		return 0, -1, false, errors.Errorf("invalid escape \\%c in JSON string", c)
+	}
+}
+
+func (j *jsonStringReader) readByte() (byte, error) {
+	c, err := j.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "unterminated JSON string")
+	}
+	return c, nil
+}
+
+// readHex4 reads the four hex digits of a \u escape
+func (j *jsonStringReader) readHex4() (rune, error) {
+	var r rune
+	for i := 0; i < 4; i++ {
+		c, err := j.readByte()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, errors.Errorf("invalid \\u escape digit %q", c)
+		}
+		r = r<<4 | rune(c)
+	}
+	return r, nil
+}
+
+// skipToQuote consumes leading whitespace up to the opening quote,
+// along with one ':' or ',' which json.Decoder.Token leaves unread
+func (j *jsonStringReader) skipToQuote() error {
+	sep := false
+	for {
+		c, err := j.r.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "expect JSON string")
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case ':', ',':
+			if sep {
+				return errors.Errorf("expect JSON string, got %q", c)
+			}
+			sep = true
+			continue
+		case '"':
+			return nil
+		default:
+			return errors.Errorf("expect JSON string, got %q", c)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWriteJSONHex(t *testing.T) {
+	src := []byte{0x00, 0xab, 0xff}
+	var buf bytes.Buffer
+	n, err := WriteJSONHex(&buf, bytes.NewReader(src), DefaultHexCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(src)) {
+		t.Fatalf("copied %d bytes", n)
+	}
+	want, _ := marshalHex(src)
+	if buf.String() != string(want) {
+		t.Fatalf("got %s, want %s", buf.String(), want)
+	}
+}
+
+func TestJSONHexReaderRoundTrip(t *testing.T) {
+	src := make([]byte, 3*streamChunkSize+7)
+	rand.New(rand.NewSource(1)).Read(src)
+	for _, codec := range []HexCodec{{}, {Upper: true}} {
+		var buf bytes.Buffer
+		if _, err := WriteJSONHex(&buf, bytes.NewReader(src), codec); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(NewJSONHexReader(&buf, codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("%+v: round trip differs", codec)
+		}
+	}
+}
+
+func TestJSONBase64ReaderRoundTrip(t *testing.T) {
+	src := make([]byte, streamChunkSize+2)
+	rand.New(rand.NewSource(2)).Read(src)
+	var buf bytes.Buffer
+	if _, err := WriteJSONBase64(&buf, bytes.NewReader(src), base64.StdEncoding); err != nil {
+		t.Fatal(err)
+	}
+	// the same token as encoding/json emits for []byte
+	want, _ := json.Marshal(src)
+	if buf.String() != string(want) {
+		t.Fatal("WriteJSONBase64 differs from encoding/json")
+	}
+	got, err := io.ReadAll(NewJSONBase64Reader(&buf, base64.StdEncoding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatal("round trip differs")
+	}
+}
+
+// the reader must stop at the closing quote so the caller
+// can go on with the tokens after the string
+func TestJSONHexReaderLeavesFollowingTokens(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader(` "0xDEADBEEF", "next": 1}`))
+	got, err := io.ReadAll(NewJSONHexReader(br, HexCodec{AllowPrefix: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Fatalf("got %x", got)
+	}
+	rest, _ := io.ReadAll(br)
+	if string(rest) != `, "next": 1}` {
+		t.Fatalf("left %q", rest)
+	}
+}
+
+func TestJSONHexReaderWithDecoder(t *testing.T) {
+	src := strings.NewReader(`{"hash": "00ff"} {"tail": true}`)
+	dec := json.NewDecoder(src)
+	for _, want := range []json.Token{json.Delim('{'), "hash"} {
+		tok, err := dec.Token()
+		if err != nil || tok != want {
+			t.Fatalf("Token() = %v, %v", tok, err)
+		}
+	}
+	br := bufio.NewReader(io.MultiReader(dec.Buffered(), src))
+	got, err := io.ReadAll(NewJSONHexReader(br, DefaultHexCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0x00, 0xff}) {
+		t.Fatalf("got %x", got)
+	}
+	rest, _ := io.ReadAll(br)
+	if string(rest) != `} {"tail": true}` {
+		t.Fatalf("left %q", rest)
+	}
+}
+
+func TestJSONStringReaderEscapes(t *testing.T) {
+	tests := []string{
+		`""`,
+		`"plain"`,
+		`"\"\\\/\b\f\n\r\t"`,
+		`"Aé中"`,
+		`"😀"`,
+		// lone surrogates decode to U+FFFD
+		`"\ud83d"`,
+		`"\ud83dx"`,
+		`"\ude00"`,
+		`"\ud83dA"`,
+		`"\ud83d😀"`,
+		`"a\"b"`,
+	}
+	for _, in := range tests {
+		var want string
+		if err := json.Unmarshal([]byte(in), &want); err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		got, err := io.ReadAll(newJSONStringReader(strings.NewReader(in)))
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestJSONStringReaderErrors(t *testing.T) {
+	for _, in := range []string{``, `x`, `::"a"`, `"abc`, `"\`, `"\x"`, `"\u12"`, `"\u12g4"`, "\"\n\""} {
+		if _, err := io.ReadAll(newJSONStringReader(strings.NewReader(in))); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+// FuzzJSONStringReader compares the reader with encoding/json on
+// valid UTF-8, where encoding/json doesn't substitute any bytes
+func FuzzJSONStringReader(f *testing.F) {
+	for _, s := range []string{`""`, `"ab"`, `"A"`, `"😀"`, `"\ud83d"`, `"\/"`, ` "x" `} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		if !utf8.ValidString(in) {
+			return
+		}
+		r := strings.NewReader(in)
+		got, err := io.ReadAll(newJSONStringReader(r))
+		rest, _ := io.ReadAll(r)
+
+		// the buffered path must agree with the byte-wise one
+		br := bufio.NewReaderSize(strings.NewReader(in), 16)
+		gotBuf, errBuf := io.ReadAll(newJSONStringReader(br))
+		restBuf, _ := io.ReadAll(br)
+		if (err == nil) != (errBuf == nil) || string(got) != string(gotBuf) || string(rest) != string(restBuf) {
+			t.Fatalf("%q: bufio path gave %q, %v, byte-wise %q, %v", in, gotBuf, errBuf, got, err)
+		}
+
+		var want string
+		jsonErr := json.Unmarshal([]byte(in), &want)
+		if jsonErr == nil && !strings.HasPrefix(strings.TrimLeft(in, " \t\r\n"), `"`) {
+			// not a string token
+			return
+		}
+		if jsonErr == nil {
+			if err != nil {
+				t.Fatalf("%q: %v, encoding/json accepts it", in, err)
+			}
+			if string(got) != want {
+				t.Fatalf("%q: got %q, want %q", in, got, want)
+			}
+			return
+		}
+		if err == nil && strings.TrimSpace(string(rest)) == "" && strings.HasPrefix(strings.TrimLeft(in, " \t\r\n"), `"`) {
+			t.Fatalf("%q accepted as %q, encoding/json: %v", in, got, jsonErr)
+		}
+	})
+}
+
+var benchBlob = func() []byte {
+	b := make([]byte, 1<<20)
+	rand.New(rand.NewSource(3)).Read(b)
+	return b
+}()
+
+func BenchmarkMarshalHex(b *testing.B) {
+	b.SetBytes(int64(len(benchBlob)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := marshalHex(benchBlob); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteJSONHex(b *testing.B) {
+	b.SetBytes(int64(len(benchBlob)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := WriteJSONHex(io.Discard, bytes.NewReader(benchBlob), DefaultHexCodec); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalHex(b *testing.B) {
+	bz, _ := marshalHex(benchBlob)
+	b.SetBytes(int64(len(benchBlob)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out []byte
+		if err := unmarshalHex(bz, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONHexReader(b *testing.B) {
+	bz, _ := marshalHex(benchBlob)
+	buf := make([]byte, streamChunkSize)
+	b.SetBytes(int64(len(benchBlob)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewJSONHexReader(bufio.NewReader(bytes.NewReader(bz)), DefaultHexCodec)
+		if _, err := io.CopyBuffer(io.Discard, r, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteJSONBase64(b *testing.B) {
+	b.SetBytes(int64(len(benchBlob)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := WriteJSONBase64(io.Discard, bytes.NewReader(benchBlob), base64.StdEncoding); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONBase64Reader(b *testing.B) {
+	bz, _ := json.Marshal(benchBlob)
+	buf := make([]byte, streamChunkSize)
+	b.SetBytes(int64(len(benchBlob)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewJSONBase64Reader(bufio.NewReader(bytes.NewReader(bz)), base64.StdEncoding)
+		if _, err := io.CopyBuffer(io.Discard, r, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
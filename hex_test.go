@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHexBytesJSON(t *testing.T) {
+	b := HexBytes{0xde, 0xad, 0xbe, 0xef}
+	bz, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bz) != `"DEADBEEF"` {
+		t.Fatalf("got %s", bz)
+	}
+	// compatible with the free functions
+	old, _ := marshalHex(b)
+	if !bytes.Equal(bz, old) {
+		t.Fatalf("marshalHex gave %s, HexBytes %s", old, bz)
+	}
+
+	var out HexBytes
+	if err := json.Unmarshal([]byte(`"deadBEEF"`), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, b) {
+		t.Fatalf("got %x", out)
+	}
+	if err := json.Unmarshal([]byte(`"0xdeadbeef"`), &out); err == nil {
+		t.Fatal("prefix accepted by the default codec")
+	}
+}
+
+func TestHexBytesScan(t *testing.T) {
+	tests := []struct {
+		src     interface{}
+		want    HexBytes
+		wantErr bool
+	}{
+		{src: nil, want: nil},
+		{src: "00ff", want: HexBytes{0x00, 0xff}},
+		{src: []byte("00FF"), want: HexBytes{0x00, 0xff}},
+		{src: "", want: HexBytes{}},
+		// raw bytes are not a storage format
+		{src: []byte{0x00, 0xff}, wantErr: true},
+		{src: "0g", wantErr: true},
+		{src: "abc", wantErr: true},
+		{src: 42, wantErr: true},
+	}
+	for _, tt := range tests {
+		b := HexBytes{0x01}
+		err := b.Scan(tt.src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Scan(%#v) = %x, want error", tt.src, []byte(b))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Scan(%#v): %v", tt.src, err)
+			continue
+		}
+		if !bytes.Equal(b, tt.want) || (b == nil) != (tt.want == nil) {
+			t.Errorf("Scan(%#v) = %#v, want %#v", tt.src, b, tt.want)
+		}
+	}
+}
+
+func TestHexBytesValueScan(t *testing.T) {
+	in := HexBytes{1, 2, 3, 0xab}
+	v, err := in.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out HexBytes
+	if err := out.Scan(v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, out) {
+		t.Fatalf("got %x, want %x", out, in)
+	}
+}
+
+func TestHash32Scan(t *testing.T) {
+	full := strings.Repeat("ab", 32)
+	tests := []struct {
+		src     interface{}
+		want    Hash32
+		wantErr bool
+	}{
+		{src: nil, want: Hash32{}},
+		{src: full, want: hash32Of(0xab)},
+		{src: []byte(full), want: hash32Of(0xab)},
+		{src: full[:62], wantErr: true},
+		{src: full + "ab", wantErr: true},
+		// 32 raw bytes are not hex text
+		{src: bytes.Repeat([]byte{0xab}, 32), wantErr: true},
+		{src: 1.5, wantErr: true},
+	}
+	for _, tt := range tests {
+		h := hash32Of(0x11)
+		err := h.Scan(tt.src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Scan(%#v) = %s, want error", tt.src, h)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Scan(%#v): %v", tt.src, err)
+			continue
+		}
+		if h != tt.want {
+			t.Errorf("Scan(%#v) = %s, want %s", tt.src, h, tt.want)
+		}
+	}
+}
+
+func TestHash32RejectsLength(t *testing.T) {
+	var h Hash32
+	for _, s := range []string{`""`, `"ab"`, `"` + strings.Repeat("0", 66) + `"`} {
+		if err := json.Unmarshal([]byte(s), &h); err == nil {
+			t.Errorf("Unmarshal(%s) accepted", s)
+		}
+	}
+}
+
+func TestHexCodec(t *testing.T) {
+	b := []byte{0x0a, 0xbc}
+	tests := []struct {
+		codec HexCodec
+		enc   string
+		dec   string
+		ok    bool
+	}{
+		{HexCodec{}, "0abc", "0ABC", true},
+		{HexCodec{Upper: true}, "0ABC", "0abc", true},
+		{HexCodec{}, "0abc", "0x0abc", false},
+		{HexCodec{AllowPrefix: true}, "0abc", "0x0abc", true},
+		{HexCodec{AllowPrefix: true}, "0abc", "0X0ABC", true},
+		{HexCodec{AllowPrefix: true}, "0abc", "0x0", false},
+	}
+	for _, tt := range tests {
+		if got := tt.codec.EncodeToString(b); got != tt.enc {
+			t.Errorf("%+v: EncodeToString = %s, want %s", tt.codec, got, tt.enc)
+		}
+		got, err := tt.codec.DecodeString(tt.dec)
+		if tt.ok != (err == nil) {
+			t.Errorf("%+v: DecodeString(%s) error %v", tt.codec, tt.dec, err)
+			continue
+		}
+		if tt.ok && !bytes.Equal(got, b) {
+			t.Errorf("%+v: DecodeString(%s) = %x", tt.codec, tt.dec, got)
+		}
+	}
+}
+
+func TestHexPerValueCodec(t *testing.T) {
+	type doc struct {
+		Default HexBytes `json:"default"`
+		Lower   Hex      `json:"lower"`
+	}
+	in := doc{
+		Default: HexBytes{0xab},
+		Lower:   Hex{Bytes: []byte{0xcd}},
+	}
+	bz, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bz) != `{"default":"AB","lower":"cd"}` {
+		t.Fatalf("got %s", bz)
+	}
+
+	out := doc{Lower: Hex{Codec: HexCodec{AllowPrefix: true}}}
+	if err := json.Unmarshal([]byte(`{"default":"AB","lower":"0xCD"}`), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Lower.Bytes, []byte{0xcd}) {
+		t.Fatalf("got %x", out.Lower.Bytes)
+	}
+
+	h, err := HexCodec{AllowPrefix: true}.DecodeHash32("0x" + strings.Repeat("ab", 32))
+	if err != nil || h != hash32Of(0xab) {
+		t.Fatalf("DecodeHash32 = %s, %v", h, err)
+	}
+}
+
+func TestHexFormat(t *testing.T) {
+	b := HexBytes{0xab, 0x01}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%s", "AB01"},
+		{"%v", "AB01"},
+		{"%x", "ab01"},
+		{"%X", "AB01"},
+		{"%#x", "0xab01"},
+		{"%q", `"AB01"`},
+		{"%d", "%!d(HexBytes=AB01)"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprintf(tt.format, b); got != tt.want {
+			t.Errorf("Sprintf(%s) = %s, want %s", tt.format, got, tt.want)
+		}
+	}
+	if got := fmt.Sprintf("%x", hash32Of(1)); got != strings.Repeat("01", 32) {
+		t.Errorf("Hash32 %%x = %s", got)
+	}
+}
+
+func hash32Of(c byte) Hash32 {
+	var h Hash32
+	for i := range h {
+		h[i] = c
+	}
+	return h
+}
+
+// FuzzHexBytesDecode checks the decoder against encoding/hex
+// and that decoded values round-trip
+func FuzzHexBytesDecode(f *testing.F) {
+	for _, s := range []string{"", "00", "DEADbeef", "0x00", "0", "zz", "\"", "é"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		var b HexBytes
+		err := b.UnmarshalText([]byte(s))
+		want, wantErr := hex.DecodeString(s)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("UnmarshalText(%q) error %v, encoding/hex %v", s, err, wantErr)
+		}
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(b, want) {
+			t.Fatalf("UnmarshalText(%q) = %x, want %x", s, []byte(b), want)
+		}
+		if got := b.String(); got != strings.ToUpper(s) {
+			t.Fatalf("String() = %s, want %s", got, strings.ToUpper(s))
+		}
+
+		bz, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out HexBytes
+		if err := json.Unmarshal(bz, &out); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", bz, err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Fatalf("round trip %x became %x", []byte(b), []byte(out))
+		}
+	})
+}
+
+// FuzzHexBytesJSON feeds arbitrary JSON to the decoders,
+// they either fail or agree with the free unmarshalHex
+func FuzzHexBytesJSON(f *testing.F) {
+	for _, s := range []string{`""`, `"00"`, `"0xab"`, `"AbC0"`, `null`, `1`, `"ab`} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, bz []byte) {
+		var b HexBytes
+		err := json.Unmarshal(bz, &b)
+		var want []byte
+		wantErr := unmarshalHex(bz, &want)
+		if string(bz) == "null" {
+			// json leaves Unmarshaler values alone on null
+			return
+		}
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("Unmarshal(%q) error %v, unmarshalHex %v", bz, err, wantErr)
+		}
+		if err == nil && !bytes.Equal(b, want) {
+			t.Fatalf("Unmarshal(%q) = %x, want %x", bz, []byte(b), want)
+		}
+
+		var h Hash32
+		if err := json.Unmarshal(bz, &h); err == nil && (wantErr != nil || len(want) != len(h)) {
+			t.Fatalf("Hash32 accepted %q", bz)
+		}
+	})
+}
+
+// FuzzHexCodecPrefix checks prefix handling against encoding/hex
+func FuzzHexCodecPrefix(f *testing.F) {
+	for _, s := range []string{"0x", "0xab", "0Xab", "ab", "x0ab", "00x1"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		c := HexCodec{AllowPrefix: true}
+		got, err := c.DecodeString(s)
+		trimmed := s
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			trimmed = s[2:]
+		}
+		want, wantErr := hex.DecodeString(trimmed)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("DecodeString(%q) error %v, want %v", s, err, wantErr)
+		}
+		if err == nil && !bytes.Equal(got, want) {
+			t.Fatalf("DecodeString(%q) = %x, want %x", s, got, want)
+		}
+	})
+}
@@ -2,13 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/lryong/golang-snippets/ioutils"
 )
 
 // GetTLSConfig generate tls.Config from CAFile
@@ -32,27 +41,387 @@ func GetTLSConfig(CAFile string) (*tls.Config, error) {
 
 // CreateHTTPClient returns a http.Client
 func CreateHTTPClient(CAFile string) (*http.Client, error) {
-	var tlsConfig *tls.Config
-	var err error
+	if CAFile == "" {
+		return NewHTTPClient()
+	}
+	return NewHTTPClient(WithCAFile(CAFile))
+}
+
+const (
+	defaultHTTPTimeout         = 5 * time.Second
+	defaultMaxIdleConnsPerHost = 20
+	defaultDialTimeout         = 30 * time.Second
+)
+
+type clientOptions struct {
+	caFile              string
+	certFile            string
+	keyFile             string
+	timeout             time.Duration
+	maxIdleConnsPerHost int
+	proxy               func(*http.Request) (*url.URL, error)
+	tlsProvider         *ReloadingTLSProvider
+	minTLSVersion       uint16
+	cipherSuites        []uint16
+	spkiPins            []Hash32
+	retry               *RetryPolicy
+}
 
-	if CAFile != "" {
-		tlsConfig, err = GetTLSConfig(CAFile)
+// ClientOption configures the client built by NewHTTPClient
+type ClientOption func(*clientOptions) error
+
+// WithCAFile trusts only the CA certificates in the PEM file
+func WithCAFile(CAFile string) ClientOption {
+	return func(o *clientOptions) error {
+		o.caFile = CAFile
+		return nil
+	}
+}
+
+// WithClientCert presents the certificate to the server for mutual TLS
+func WithClientCert(certFile, keyFile string) ClientOption {
+	return func(o *clientOptions) error {
+		if certFile == "" || keyFile == "" {
+			return errors.New("both client certificate and key are required")
+		}
+		o.certFile, o.keyFile = certFile, keyFile
+		return nil
+	}
+}
+
+// WithTLSProvider takes the CA and client certificate from a
+// ReloadingTLSProvider, it can't be combined with WithCAFile or WithClientCert
+func WithTLSProvider(p *ReloadingTLSProvider) ClientOption {
+	return func(o *clientOptions) error {
+		o.tlsProvider = p
+		return nil
+	}
+}
+
+// WithTimeout sets the overall timeout of a request, 0 means no timeout.
+// With WithRetry it applies to each attempt, the backoff between
+// attempts is bounded by the request's context instead.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) error {
+		if d < 0 {
+			return fmt.Errorf("invalid timeout %s", d)
+		}
+		o.timeout = d
+		return nil
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the size of the keep-alive pool per host
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(o *clientOptions) error {
+		o.maxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// WithProxy sends all requests through a HTTP or HTTPS proxy
+func WithProxy(proxyURL string) ClientOption {
+	return func(o *clientOptions) error {
+		u, err := url.Parse(proxyURL)
 		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		}
+		o.proxy = http.ProxyURL(u)
+		return nil
+	}
+}
+
+// WithProxyFromEnvironment honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func WithProxyFromEnvironment() ClientOption {
+	return func(o *clientOptions) error {
+		o.proxy = http.ProxyFromEnvironment
+		return nil
+	}
+}
+
+// WithMinTLSVersion rejects servers which can't speak at least version,
+// e.g. tls.VersionTLS12
+func WithMinTLSVersion(version uint16) ClientOption {
+	return func(o *clientOptions) error {
+		o.minTLSVersion = version
+		return nil
+	}
+}
+
+// WithCipherSuites restricts the TLS 1.0-1.2 cipher suites offered,
+// TLS 1.3 suites are not configurable
+func WithCipherSuites(suites ...uint16) ClientOption {
+	return func(o *clientOptions) error {
+		o.cipherSuites = suites
+		return nil
+	}
+}
+
+// WithPinnedSPKI only trusts servers whose certificate chain contains
+// one of the public keys, see ParseSPKIPin for the accepted formats.
+// Pass several pins to allow rotating the manager's key.
+func WithPinnedSPKI(pins ...string) ClientOption {
+	return func(o *clientOptions) error {
+		for _, s := range pins {
+			pin, err := ParseSPKIPin(s)
+			if err != nil {
+				return err
+			}
+			o.spkiPins = append(o.spkiPins, pin)
+		}
+		return nil
+	}
+}
+
+// WithRetry retries idempotent requests according to policy
+func WithRetry(policy RetryPolicy) ClientOption {
+	return func(o *clientOptions) error {
+		if policy.MaxAttempts < 1 {
+			return fmt.Errorf("invalid retry attempts %d", policy.MaxAttempts)
+		}
+		o.retry = &policy
+		return nil
+	}
+}
+
+// NewHTTPClient builds a http.Client from options, the defaults are
+// those of CreateHTTPClient: 5s timeout and 20 idle connections per host
+func NewHTTPClient(opts ...ClientOption) (*http.Client, error) {
+	o := &clientOptions{
+		timeout:             defaultHTTPTimeout,
+		maxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
 			return nil, err
 		}
 	}
 
-	tr := &http.Transport{
-		MaxIdleConnsPerHost: 20,
+	tlsConfig, err := o.tlsConfig("")
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:               o.proxy,
+		MaxIdleConnsPerHost: o.maxIdleConnsPerHost,
 		TLSClientConfig:     tlsConfig,
 	}
+	if o.tlsProvider != nil {
+		// crypto/tls gives the provider no server name to check for IP
+		// addresses, so each connection gets a config for its host.
+		// through a proxy TLSClientConfig is used, IPs are refused there
+		dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultDialTimeout}
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			cfg, err := o.tlsConfig(host)
+			if err != nil {
+				return nil, err
+			}
+			return (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, network, addr)
+		}
+	}
+	var tr http.RoundTripper = transport
+	timeout := o.timeout
+	if o.retry != nil {
+		tr = &retryTransport{next: tr, policy: *o.retry, attemptTimeout: timeout}
+		timeout = 0
+	}
 
 	return &http.Client{
 		Transport: tr,
-		Timeout:   5 * time.Second,
+		Timeout:   timeout,
 	}, nil
 }
 
+// tlsConfig builds the config for connections to host, host is only
+// used by the TLS provider and may be empty
+func (o *clientOptions) tlsConfig(host string) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	var err error
+
+	if o.tlsProvider != nil {
+		if o.caFile != "" || o.certFile != "" {
+			return nil, errors.New("TLS provider can't be combined with CA or client certificate files")
+		}
+		tlsConfig = o.tlsProvider.TLSConfigFor(host)
+	} else if o.caFile != "" {
+		tlsConfig, err = GetTLSConfig(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.certFile == "" && o.minTLSVersion == 0 && o.cipherSuites == nil && o.spkiPins == nil {
+		return tlsConfig, nil
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if o.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	tlsConfig.MinVersion = o.minTLSVersion
+	tlsConfig.CipherSuites = o.cipherSuites
+	if o.spkiPins != nil && o.tlsProvider != nil {
+		// the provider verifies the chain itself, crypto/tls
+		// would pass no verified chains to VerifyPeerCertificate
+		tlsConfig.VerifyConnection = spkiPinConnVerifier(o.spkiPins, func(cs tls.ConnectionState) ([][]*x509.Certificate, error) {
+			return o.tlsProvider.verifyChains(cs, host)
+		})
+	} else if o.spkiPins != nil {
+		// VerifyPeerCertificate is skipped on resumed sessions,
+		// which is fine as no ClientSessionCache is set
+		tlsConfig.VerifyPeerCertificate = spkiPinVerifier(o.spkiPins)
+	}
+	return tlsConfig, nil
+}
+
+// RetryPolicy describes how failed idempotent requests are retried
+type RetryPolicy struct {
+	// MaxAttempts counts the first try, 1 disables retrying
+	MaxAttempts int
+	// BaseDelay is doubled after every attempt, 100ms if unset
+	BaseDelay time.Duration
+	// MaxDelay caps the delay, 0 means no cap
+	MaxDelay time.Duration
+	// ShouldRetry decides whether a result is worth retrying,
+	// by default network errors and 429/502/503/504 are retried
+	ShouldRetry func(resp *http.Response, err error) bool
+}
+
+func defaultShouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+const defaultRetryBaseDelay = 100 * time.Millisecond
+
+// backoff returns the delay before the given retry (1-based),
+// using exponential backoff with full jitter
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	if d <= 0 {
+		d = defaultRetryBaseDelay
+	}
+	for i := 1; i < retry; i++ {
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+		if d > math.MaxInt64/2 {
+			// doubling would overflow
+			break
+		}
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d == math.MaxInt64 {
+		d--
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+	// bounds each attempt including reading its body, 0 means none
+	attemptTimeout time.Duration
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	// the body must be replayable
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req) {
+		return t.roundTrip(req)
+	}
+	shouldRetry := t.policy.ShouldRetry
+	if shouldRetry == nil {
+		shouldRetry = defaultShouldRetry
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.roundTrip(req)
+		if attempt >= t.policy.MaxAttempts || !shouldRetry(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			// drain so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(t.policy.backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// roundTrip makes one attempt under attemptTimeout, the timeout
+// is cancelled once the body is closed
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.attemptTimeout == 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.attemptTimeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 // PostJson posts json object to url
 func PostJson(url string, obj interface{}, client *http.Client) (*http.Response, error) {
 	if client == nil {
@@ -75,14 +444,172 @@ func GetJson(url string, obj interface{}, client *http.Client) (*http.Response,
 	if err != nil {
 		return resp, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return resp, errors.New("HTTP status code is not 200")
+		herr := newHTTPError(resp)
+		drainBody(resp.Body)
+		return resp, herr
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutils.ReadAll(resp.Body, defaultMaxResponseSize)
 	if err != nil {
 		return resp, err
 	}
 	return resp, json.Unmarshal(body, obj)
 }
+
+const (
+	// defaultMaxResponseSize caps the JSON body read by the typed helpers
+	defaultMaxResponseSize = 4 << 20
+	// httpErrorBodySize is how much of a failed response HTTPError keeps
+	httpErrorBodySize = 512
+	// maxDrainSize is how much of an unused body is read so the
+	// connection can be reused, larger ones are just closed
+	maxDrainSize = 64 << 10
+)
+
+// ErrResponseTooLarge is matched with errors.Is by the
+// *ioutils.TooLargeError of a response body exceeding the limit
+var ErrResponseTooLarge = ioutils.ErrTooLarge
+
+// HTTPError is returned for any response which is not 2xx
+type HTTPError struct {
+	StatusCode int
+	Method     string
+	URL        string
+	// Body holds the beginning of the response body
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%s %s: HTTP status %d", e.Method, e.URL, e.StatusCode)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// newHTTPError keeps a truncated copy of the body,
+// the caller is still responsible for closing it
+func newHTTPError(resp *http.Response) *HTTPError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, httpErrorBodySize))
+	e := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Body:       string(bytes.TrimSpace(body)),
+	}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.URL = resp.Request.URL.String()
+	}
+	return e
+}
+
+// drainBody reads what is left of a small body before it is closed
+func drainBody(body io.Reader) {
+	io.CopyN(ioutil.Discard, body, maxDrainSize)
+}
+
+type jsonOptions struct {
+	maxResponseSize int64
+	header          http.Header
+}
+
+// JSONOption configures a single request of the typed JSON helpers
+type JSONOption func(*jsonOptions)
+
+// WithMaxResponseSize overrides the 4MiB default response limit
+func WithMaxResponseSize(n int64) JSONOption {
+	return func(o *jsonOptions) {
+		o.maxResponseSize = n
+	}
+}
+
+// WithHeader adds a header to the request
+func WithHeader(key, value string) JSONOption {
+	return func(o *jsonOptions) {
+		o.header.Add(key, value)
+	}
+}
+
+// GetJSONContext gets url and decodes the json response into T
+func GetJSONContext[T any](ctx context.Context, client *http.Client, url string, opts ...JSONOption) (T, error) {
+	return doJSON[T](ctx, client, http.MethodGet, url, nil, opts)
+}
+
+// PostJSONContext posts obj as json to url and decodes the response into T
+func PostJSONContext[T any](ctx context.Context, client *http.Client, url string, obj interface{}, opts ...JSONOption) (T, error) {
+	return doJSON[T](ctx, client, http.MethodPost, url, obj, opts)
+}
+
+// PutJSONContext puts obj as json to url and decodes the response into T
+func PutJSONContext[T any](ctx context.Context, client *http.Client, url string, obj interface{}, opts ...JSONOption) (T, error) {
+	return doJSON[T](ctx, client, http.MethodPut, url, obj, opts)
+}
+
+// DeleteJSONContext deletes url and decodes the response into T
+func DeleteJSONContext[T any](ctx context.Context, client *http.Client, url string, opts ...JSONOption) (T, error) {
+	return doJSON[T](ctx, client, http.MethodDelete, url, nil, opts)
+}
+
+func doJSON[T any](ctx context.Context, client *http.Client, method, url string, obj interface{}, opts []JSONOption) (T, error) {
+	var result T
+
+	o := &jsonOptions{
+		maxResponseSize: defaultMaxResponseSize,
+		header:          make(http.Header),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if client == nil {
+		client, _ = CreateHTTPClient("")
+	}
+
+	var body io.Reader
+	if obj != nil {
+		b := new(bytes.Buffer)
+		if err := json.NewEncoder(b).Encode(obj); err != nil {
+			return result, err
+		}
+		body = b
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return result, err
+	}
+	for k, v := range o.header {
+		req.Header[k] = v
+	}
+	if obj != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		herr := newHTTPError(resp)
+		drainBody(resp.Body)
+		return result, herr
+	}
+
+	// a body over the limit fails with *ioutils.TooLargeError,
+	// which matches ErrResponseTooLarge
+	data, err := ioutils.ReadAll(resp.Body, o.maxResponseSize)
+	if err != nil {
+		return result, err
+	}
+	if resp.StatusCode == http.StatusNoContent || len(bytes.TrimSpace(data)) == 0 {
+		return result, nil
+	}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
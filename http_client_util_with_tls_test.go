@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCert is a locally generated certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial atomic.Int64
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T, cn string) *testCert {
+	t.Helper()
+	return signTestCert(t, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	})
+}
+
+// issue signs a leaf valid for localhost and 127.0.0.1,
+// usable by servers and clients alike
+func (ca *testCert) issue(t *testing.T, cn string) *testCert {
+	t.Helper()
+	return signTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func signTestCert(t *testing.T, parent *testCert, tmpl *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(testSerial.Add(1))
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// tlsCertificate returns the leaf followed by chain for a server
+func (c *testCert) tlsCertificate(chain ...*testCert) tls.Certificate {
+	cert := tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+	for _, ca := range chain {
+		cert.Certificate = append(cert.Certificate, ca.cert.Raw)
+	}
+	return cert
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestTLSServer serves handler with a certificate issued by ca
+func newTestTLSServer(t *testing.T, ca *testCert, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server").tlsCertificate(ca)}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (string, error) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestNewHTTPClientCAFile(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	srv := newTestTLSServer(t, ca, http.HandlerFunc(okHandler))
+	caFile := writeTestFile(t, t.TempDir(), "ca.pem", ca.certPEM())
+
+	client, err := CreateHTTPClient(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := getBody(t, client, srv.URL); err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+
+	// another CA isn't trusted
+	otherFile := writeTestFile(t, t.TempDir(), "other.pem", newTestCA(t, "other ca").certPEM())
+	client, err = NewHTTPClient(WithCAFile(otherFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getBody(t, client, srv.URL); err == nil {
+		t.Fatal("server of an untrusted CA accepted")
+	}
+}
+
+func TestNewHTTPClientMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server").tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM())
+	client := ca.issue(t, "worker-1")
+	certFile := writeTestFile(t, dir, "client.pem", client.certPEM())
+	keyFile := writeTestFile(t, dir, "client.key", client.keyPEM(t))
+
+	c, err := NewHTTPClient(WithCAFile(caFile), WithClientCert(certFile, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := getBody(t, c, srv.URL); err != nil || body != "worker-1" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+
+	c, err = NewHTTPClient(WithCAFile(caFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getBody(t, c, srv.URL); err == nil {
+		t.Fatal("request without client certificate accepted")
+	}
+}
+
+func TestNewHTTPClientMinTLSVersion(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server").tlsCertificate()},
+		MaxVersion:   tls.VersionTLS12,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writeTestFile(t, t.TempDir(), "ca.pem", ca.certPEM())
+
+	c, err := NewHTTPClient(WithCAFile(caFile), WithMinTLSVersion(tls.VersionTLS12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getBody(t, c, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewHTTPClient(WithCAFile(caFile), WithMinTLSVersion(tls.VersionTLS13))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getBody(t, c, srv.URL); err == nil {
+		t.Fatal("TLS 1.2 server accepted")
+	}
+}
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a forward proxy receives the absolute URL
+		proxied.Store(r.URL.String())
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+
+	c, err := NewHTTPClient(WithProxy(proxy.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := getBody(t, c, "http://manager.invalid/ping")
+	if err != nil || body != "via proxy" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if got := proxied.Load(); got != "http://manager.invalid/ping" {
+		t.Fatalf("proxy saw %v", got)
+	}
+
+	if _, err := NewHTTPClient(WithProxy("socks5://127.0.0.1:1080")); err == nil {
+		t.Fatal("socks5 proxy accepted")
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	var calls atomic.Int32
+	srv := newTestTLSServer(t, ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		okHandler(w, r)
+	}))
+	caFile := writeTestFile(t, t.TempDir(), "ca.pem", ca.certPEM())
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	c, err := NewHTTPClient(WithCAFile(caFile), WithRetry(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := getBody(t, c, srv.URL); err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("%d attempts, want 3", n)
+	}
+
+	// POST isn't idempotent
+	calls.Store(0)
+	resp, err := c.Post(srv.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("POST: status %d after %d attempts", resp.StatusCode, calls.Load())
+	}
+
+	// the last response is returned once attempts run out
+	calls.Store(-10)
+	resp, err = c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != -7 {
+		t.Fatalf("status %d after %d attempts", resp.StatusCode, calls.Load()+10)
+	}
+}
+
+func TestRetryTransportReplaysBody(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	c, err := NewHTTPClient(WithRetry(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, srv.URL, strings.NewReader("payload"))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "payload" || calls.Load() != 2 {
+		t.Fatalf("got %q after %d attempts", b, calls.Load())
+	}
+}
+
+// the timeout bounds each attempt, so a hung first attempt
+// doesn't use up the time of the retries
+func TestRetryTransportAttemptTimeout(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		// slower than the timeout in total, not per attempt
+		time.Sleep(150 * time.Millisecond)
+		okHandler(w, r)
+	}))
+	defer srv.Close()
+
+	c, err := NewHTTPClient(
+		WithTimeout(200*time.Millisecond),
+		WithRetry(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Timeout != 0 {
+		t.Fatalf("client timeout %s spans all attempts", c.Timeout)
+	}
+	if body, err := getBody(t, c, srv.URL); err != nil || body != "ok" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("%d attempts, want 2", calls.Load())
+	}
+
+	// an attempt that times out on its own is reported as such
+	calls.Store(0)
+	c, _ = NewHTTPClient(WithTimeout(50*time.Millisecond), WithRetry(RetryPolicy{MaxAttempts: 1}))
+	if _, err := getBody(t, c, srv.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		retry  int
+		max    time.Duration
+	}{
+		{"default base", RetryPolicy{}, 1, defaultRetryBaseDelay},
+		{"doubles without cap", RetryPolicy{BaseDelay: time.Second}, 4, 8 * time.Second},
+		{"capped", RetryPolicy{BaseDelay: time.Second, MaxDelay: 3 * time.Second}, 4, 3 * time.Second},
+		{"cap below base", RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Millisecond}, 1, time.Millisecond},
+		{"no overflow", RetryPolicy{BaseDelay: time.Hour}, 200, time.Duration(1<<63 - 1)},
+	}
+	for _, tt := range tests {
+		var largest time.Duration
+		for i := 0; i < 1000; i++ {
+			d := tt.policy.backoff(tt.retry)
+			if d < 0 || d > tt.max {
+				t.Fatalf("%s: backoff(%d) = %s, want within [0, %s]", tt.name, tt.retry, d, tt.max)
+			}
+			if d > largest {
+				largest = d
+			}
+		}
+		// full jitter should reach the upper half
+		if largest < tt.max/2 {
+			t.Errorf("%s: largest backoff %s, want up to %s", tt.name, largest, tt.max)
+		}
+	}
+}
+
+func TestJSONResponseLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"name":"`+strings.Repeat("x", 100)+`"}`)
+	}))
+	defer srv.Close()
+	type resp struct{ Name string }
+
+	ctx := context.Background()
+	if _, err := GetJSONContext[resp](ctx, srv.Client(), srv.URL, WithMaxResponseSize(50)); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("got %v, want ErrResponseTooLarge", err)
+	}
+	// exactly at the limit
+	r, err := GetJSONContext[resp](ctx, srv.Client(), srv.URL, WithMaxResponseSize(111))
+	if err != nil || len(r.Name) != 100 {
+		t.Fatalf("got %v, %v", r, err)
+	}
+	var out resp
+	if _, err := GetJson(srv.URL, &out, srv.Client()); err != nil || len(out.Name) != 100 {
+		t.Fatalf("GetJson: %v, %v", out, err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	body := "  " + strings.Repeat("e", 2*httpErrorBodySize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	_, err := PutJSONContext[struct{}](context.Background(), srv.Client(), srv.URL+"/jobs", map[string]int{"a": 1})
+	var herr *HTTPError
+	if !errors.As(err, &herr) {
+		t.Fatalf("got %v", err)
+	}
+	if herr.StatusCode != http.StatusServiceUnavailable || herr.Method != http.MethodPut || herr.URL != srv.URL+"/jobs" {
+		t.Errorf("got %+v", herr)
+	}
+	// the leading space is trimmed from the kept part
+	if herr.Body != strings.Repeat("e", httpErrorBodySize-2) {
+		t.Errorf("body of %d bytes", len(herr.Body))
+	}
+	if msg := herr.Error(); !strings.HasPrefix(msg, "PUT "+srv.URL+"/jobs: HTTP status 503: eee") {
+		t.Errorf("Error() = %.80q", msg)
+	}
+	if (&HTTPError{Method: "GET", URL: "/x", StatusCode: 404}).Error() != "GET /x: HTTP status 404" {
+		t.Error("empty body is not omitted")
+	}
+}
+
+func TestJSONMethods(t *testing.T) {
+	type echo struct {
+		Method      string
+		Body        string
+		Accept      string
+		ContentType string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(echo{r.Method, string(body), r.Header.Get("Accept"), r.Header.Get("Content-Type")})
+	}))
+	defer srv.Close()
+	ctx, c := context.Background(), srv.Client()
+	obj := map[string]string{"name": "debian"}
+	const jsonType = "application/json; charset=utf-8"
+
+	tests := []struct {
+		name string
+		call func(...JSONOption) (echo, error)
+		want echo
+	}{
+		{"get", func(o ...JSONOption) (echo, error) { return GetJSONContext[echo](ctx, c, srv.URL, o...) },
+			echo{"GET", "", "application/json", ""}},
+		{"post", func(o ...JSONOption) (echo, error) { return PostJSONContext[echo](ctx, c, srv.URL, obj, o...) },
+			echo{"POST", `{"name":"debian"}` + "\n", "application/json", jsonType}},
+		{"put", func(o ...JSONOption) (echo, error) { return PutJSONContext[echo](ctx, c, srv.URL, obj, o...) },
+			echo{"PUT", `{"name":"debian"}` + "\n", "application/json", jsonType}},
+		{"delete", func(o ...JSONOption) (echo, error) { return DeleteJSONContext[echo](ctx, c, srv.URL, o...) },
+			echo{"DELETE", "", "application/json", ""}},
+	}
+	for _, tt := range tests {
+		if got, err := tt.call(); err != nil || got != tt.want {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+		// a caller's Accept is kept
+		want := tt.want
+		want.Accept = "application/vnd.tunasync+json"
+		if got, err := tt.call(WithHeader("Accept", want.Accept)); err != nil || got != want {
+			t.Errorf("%s with Accept: got %+v, %v", tt.name, got, err)
+		}
+	}
+
+	if got, err := DeleteJSONContext[echo](ctx, c, srv.URL+"/empty"); err != nil || got != (echo{}) {
+		t.Errorf("no content: got %+v, %v", got, err)
+	}
+	if _, err := PostJSONContext[echo](ctx, c, srv.URL, make(chan int)); err == nil {
+		t.Error("unencodable body sent")
+	}
+}
+
+func TestJSONContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := PutJSONContext[struct{}](ctx, srv.Client(), srv.URL, struct{}{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("returned after %s", d)
+	}
+
+	// canceled before the request is sent
+	if _, err := DeleteJSONContext[struct{}](ctx, srv.Client(), srv.URL); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// trackedBody records how much of it was read and whether it was closed
+type trackedBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestJSONErrorDrainsBody(t *testing.T) {
+	var body *trackedBody
+	c := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body = &trackedBody{Reader: strings.NewReader(strings.Repeat("x", 4096))}
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: body, Request: r}, nil
+	})}
+
+	if _, err := GetJSONContext[struct{}](context.Background(), c, "http://manager/jobs"); err == nil {
+		t.Fatal("no error")
+	}
+	if !body.closed || body.Len() != 0 {
+		t.Errorf("closed %v, %d bytes left", body.closed, body.Len())
+	}
+	var out struct{}
+	if _, err := GetJson("http://manager/jobs", &out, c); err == nil {
+		t.Fatal("GetJson: no error")
+	}
+	if !body.closed || body.Len() != 0 {
+		t.Errorf("GetJson: closed %v, %d bytes left", body.closed, body.Len())
+	}
+
+	// so the connection is reused
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, strings.Repeat("x", 4096))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := GetJSONContext[struct{}](context.Background(), srv.Client(), srv.URL); err == nil {
+			t.Fatal("no error")
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections for 3 requests", n)
+	}
+}
@@ -0,0 +1,117 @@
+// Package ioutils has size-limited and deadline-aware read helpers
+// and a simple length-prefixed framing.
+package ioutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// ErrTooLarge matches any *TooLargeError with errors.Is
+var ErrTooLarge = errors.New("data too large")
+
+// TooLargeError is returned when input exceeds the allowed size
+type TooLargeError struct {
+	Limit int64
+	// Size is the announced size for frames, -1 when unknown
+	Size int64
+}
+
+func (e *TooLargeError) Error() string {
+	if e.Size >= 0 {
+		return fmt.Sprintf("data too large: %d bytes, limit is %d", e.Size, e.Limit)
+	}
+	return fmt.Sprintf("data too large: more than %d bytes", e.Limit)
+}
+
+// Is makes errors.Is(err, ErrTooLarge) hold for every limit
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// ReadAll reads r until EOF like io.ReadAll, but fails with a
+// *TooLargeError instead of reading more than limit bytes.
+// A limit of math.MaxInt64 reads everything, a negative one is an error.
+func ReadAll(r io.Reader, limit int64) ([]byte, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("negative read limit %d", limit)
+	}
+	buf := bytes.NewBuffer(nil)
+	// read one more byte than allowed to tell input of exactly
+	// limit bytes from a larger one, which can't overflow
+	if limit < math.MaxInt64 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, &TooLargeError{Limit: limit, Size: -1}
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadAllTimeout reads conn until EOF, at most limit bytes, and gives
+// up once timeout elapsed. The deadline is cleared afterwards and the
+// connection is left open, closing it is up to the caller.
+func ReadAllTimeout(conn net.Conn, limit int64, timeout time.Duration) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	return ReadAll(conn, limit)
+}
+
+// ReadFullTimeout fills buf from conn unless timeout elapses first
+func ReadFullTimeout(conn net.Conn, buf []byte, timeout time.Duration) (int, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	return io.ReadFull(conn, buf)
+}
+
+// frameHeaderLen is the size of the big-endian length prefix
+const frameHeaderLen = 4
+
+// WriteFrame writes p prefixed with its length as a big-endian uint32
+func WriteFrame(w io.Writer, p []byte) error {
+	if uint64(len(p)) > 0xffffffff {
+		return &TooLargeError{Limit: 0xffffffff, Size: int64(len(p))}
+	}
+	var hdr [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame, frames announcing
+// more than maxSize bytes are rejected before anything is allocated
+func ReadFrame(r io.Reader, maxSize uint32) ([]byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxSize {
+		return nil, &TooLargeError{Limit: int64(maxSize), Size: int64(size)}
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
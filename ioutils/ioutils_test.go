@@ -0,0 +1,115 @@
+package ioutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAll(t *testing.T) {
+	tests := []struct {
+		in    string
+		limit int64
+		err   bool
+	}{
+		{"", 0, false},
+		{"abc", 3, false},
+		{"abc", 10, false},
+		{"abcd", 3, true},
+		{"a", 0, true},
+		{"abc", math.MaxInt64, false},
+		{"abc", math.MaxInt64 - 1, false},
+	}
+	for _, tt := range tests {
+		got, err := ReadAll(strings.NewReader(tt.in), tt.limit)
+		if tt.err {
+			var tl *TooLargeError
+			if !errors.As(err, &tl) || tl.Limit != tt.limit || !errors.Is(err, ErrTooLarge) {
+				t.Errorf("ReadAll(%q, %d) error %v", tt.in, tt.limit, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.in {
+			t.Errorf("ReadAll(%q, %d) = %q, %v", tt.in, tt.limit, got, err)
+		}
+	}
+}
+
+func TestReadAllNegativeLimit(t *testing.T) {
+	for _, limit := range []int64{-1, math.MinInt64} {
+		got, err := ReadAll(strings.NewReader("abc"), limit)
+		if err == nil || errors.Is(err, ErrTooLarge) {
+			t.Errorf("ReadAll limit %d = %q, %v", limit, got, err)
+		}
+	}
+}
+
+func TestReadAllTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go b.Write([]byte("partial"))
+
+	start := time.Now()
+	_, err := ReadAllTimeout(a, 100, 50*time.Millisecond)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("deadline not applied")
+	}
+
+	// the deadline is cleared and the connection left open
+	go func() {
+		b.Write([]byte("rest"))
+		b.Close()
+	}()
+	got, err := ReadAllTimeout(a, 100, time.Second)
+	if err != nil || string(got) != "rest" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestReadFullTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go b.Write([]byte("abcdef"))
+	buf := make([]byte, 4)
+	if n, err := ReadFullTimeout(a, buf, time.Second); n != 4 || err != nil || string(buf) != "abcd" {
+		t.Fatalf("got %d %q, %v", n, buf, err)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range []string{"", "hello", strings.Repeat("x", 1000)} {
+		if err := WriteFrame(&buf, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"", "hello"} {
+		got, err := ReadFrame(&buf, 100)
+		if err != nil || string(got) != want {
+			t.Fatalf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	// rejected from the header alone
+	_, err := ReadFrame(&buf, 100)
+	var tl *TooLargeError
+	if !errors.As(err, &tl) || tl.Size != 1000 || tl.Limit != 100 || !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v", err)
+	}
+
+	if _, err := ReadFrame(bytes.NewReader([]byte{0, 0, 0, 5, 'a'}), 100); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame: %v", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(nil), 100); err != io.EOF {
+		t.Fatalf("empty input: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package pinger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ICMP message types understood by the codec
+const (
+	TypeEchoReply              uint8 = 0
+	TypeDestinationUnreachable uint8 = 3
+	TypeEcho                   uint8 = 8
+	TypeTimeExceeded           uint8 = 11
+
+	TypeV6DestinationUnreachable uint8 = 1
+	TypeV6TimeExceeded           uint8 = 3
+	TypeV6Echo                   uint8 = 128
+	TypeV6EchoReply              uint8 = 129
+)
+
+const (
+	icmpHeaderLen  = 4
+	protocolICMP   = 1
+	protocolICMPv6 = 58
+)
+
+var (
+	// ErrShortMessage is returned for truncated messages
+	ErrShortMessage = errors.New("icmp message too short")
+	// ErrChecksum is returned when a parsed message fails its checksum
+	ErrChecksum = errors.New("icmp checksum mismatch")
+)
+
+// Body is the part of a message after type, code and checksum
+type Body interface {
+	// Len is the encoded length of the body
+	Len() int
+	marshal(b []byte)
+}
+
+// Message is an ICMPv4 or ICMPv6 message
+type Message struct {
+	Type uint8
+	Code uint8
+	// Checksum is filled in by the parsers, Marshal ignores it
+	Checksum uint16
+	Body     Body
+}
+
+// Echo is the body of echo requests and replies
+type Echo struct {
+	ID   int
+	Seq  int
+	Data []byte
+}
+
+func (e *Echo) Len() int {
+	return 4 + len(e.Data)
+}
+
+func (e *Echo) marshal(b []byte) {
+	binary.BigEndian.PutUint16(b[0:], uint16(e.ID))
+	binary.BigEndian.PutUint16(b[2:], uint16(e.Seq))
+	copy(b[4:], e.Data)
+}
+
+// DstUnreach is the body of destination unreachable messages,
+// Data holds the IP header and the beginning of the original datagram
+type DstUnreach struct {
+	// Unused holds the 4 bytes before Data, they are zero except for
+	// the next-hop MTU and the RFC 4884 length
+	Unused [4]byte
+	Data   []byte
+}
+
+// MTU returns the next-hop MTU of an ICMPv4 "fragmentation needed"
+// message (RFC 1191), 0 if the router didn't report it
+func (d *DstUnreach) MTU() int {
+	return int(binary.BigEndian.Uint16(d.Unused[2:]))
+}
+
+func (d *DstUnreach) Len() int {
+	return 4 + len(d.Data)
+}
+
+func (d *DstUnreach) marshal(b []byte) {
+	copy(b, d.Unused[:])
+	copy(b[4:], d.Data)
+}
+
+// TimeExceeded is the body of time exceeded messages,
+// Data holds the IP header and the beginning of the original datagram
+type TimeExceeded struct {
+	// Unused holds the 4 bytes before Data, zero except for
+	// the RFC 4884 length
+	Unused [4]byte
+	Data   []byte
+}
+
+func (t *TimeExceeded) Len() int {
+	return 4 + len(t.Data)
+}
+
+func (t *TimeExceeded) marshal(b []byte) {
+	copy(b, t.Unused[:])
+	copy(b[4:], t.Data)
+}
+
+// RawBody keeps the body of message types the codec doesn't know
+type RawBody struct {
+	Data []byte
+}
+
+func (r *RawBody) Len() int {
+	return len(r.Data)
+}
+
+func (r *RawBody) marshal(b []byte) {
+	copy(b, r.Data)
+}
+
+// Marshal encodes an ICMPv4 message and computes its checksum
+func (m *Message) Marshal() ([]byte, error) {
+	b, err := m.marshalNoChecksum()
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(b[2:], Checksum(b))
+	return b, nil
+}
+
+// MarshalV6 encodes an ICMPv6 message, whose checksum covers a
+// pseudo-header of the IP addresses. With src unknown the checksum is
+// left zero, the kernel fills it in for raw (RFC 3542) and datagram
+// ICMPv6 sockets alike.
+func (m *Message) MarshalV6(src, dst net.IP) ([]byte, error) {
+	b, err := m.marshalNoChecksum()
+	if err != nil {
+		return nil, err
+	}
+	if src != nil {
+		binary.BigEndian.PutUint16(b[2:], ChecksumV6(src, dst, b))
+	}
+	return b, nil
+}
+
+func (m *Message) marshalNoChecksum() ([]byte, error) {
+	if m.Body == nil {
+		return nil, errors.New("icmp message without body")
+	}
+	b := make([]byte, icmpHeaderLen+m.Body.Len())
+	b[0] = m.Type
+	b[1] = m.Code
+	m.Body.marshal(b[icmpHeaderLen:])
+	return b, nil
+}
+
+// ParseMessage decodes an ICMPv4 message and verifies its checksum
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < icmpHeaderLen {
+		return nil, ErrShortMessage
+	}
+	if Checksum(b) != 0 {
+		return nil, ErrChecksum
+	}
+	return parseMessage(b, false)
+}
+
+// ParseMessageV6 decodes an ICMPv6 message. The checksum is verified
+// when both addresses are known, otherwise the kernel is trusted
+// to have dropped corrupt messages.
+func ParseMessageV6(b []byte, src, dst net.IP) (*Message, error) {
+	if len(b) < icmpHeaderLen {
+		return nil, ErrShortMessage
+	}
+	if src != nil && dst != nil && ChecksumV6(src, dst, b) != binary.BigEndian.Uint16(b[2:]) {
+		return nil, ErrChecksum
+	}
+	return parseMessage(b, true)
+}
+
+func parseMessage(b []byte, v6 bool) (*Message, error) {
+	m := &Message{
+		Type:     b[0],
+		Code:     b[1],
+		Checksum: binary.BigEndian.Uint16(b[2:]),
+	}
+	body := b[icmpHeaderLen:]
+
+	echoTypes := [2]uint8{TypeEcho, TypeEchoReply}
+	unreach, exceeded := TypeDestinationUnreachable, TypeTimeExceeded
+	if v6 {
+		echoTypes = [2]uint8{TypeV6Echo, TypeV6EchoReply}
+		unreach, exceeded = TypeV6DestinationUnreachable, TypeV6TimeExceeded
+	}
+
+	switch m.Type {
+	case echoTypes[0], echoTypes[1]:
+		if len(body) < 4 {
+			return nil, ErrShortMessage
+		}
+		m.Body = &Echo{
+			ID:   int(binary.BigEndian.Uint16(body[0:])),
+			Seq:  int(binary.BigEndian.Uint16(body[2:])),
+			Data: copyBytes(body[4:]),
+		}
+	case unreach:
+		if len(body) < 4 {
+			return nil, ErrShortMessage
+		}
+		d := &DstUnreach{Data: copyBytes(body[4:])}
+		copy(d.Unused[:], body)
+		m.Body = d
+	case exceeded:
+		if len(body) < 4 {
+			return nil, ErrShortMessage
+		}
+		t := &TimeExceeded{Data: copyBytes(body[4:])}
+		copy(t.Unused[:], body)
+		m.Body = t
+	default:
+		m.Body = &RawBody{Data: copyBytes(body)}
+	}
+	return m, nil
+}
+
+// the parsed message must not alias the caller's read buffer
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// Checksum is the Internet checksum of RFC 1071,
+// an odd trailing byte is padded with zero.
+// It is 0 over a message carrying a valid checksum.
+func Checksum(b []byte) uint16 {
+	var sum uint32
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// ChecksumV6 computes the ICMPv6 checksum over the IPv6 pseudo-header
+// (RFC 8200 section 8.1) followed by msg, treating msg's own checksum
+// field as zero
+func ChecksumV6(src, dst net.IP, msg []byte) uint16 {
+	b := make([]byte, 40+len(msg))
+	copy(b[0:16], src.To16())
+	copy(b[16:32], dst.To16())
+	binary.BigEndian.PutUint32(b[32:], uint32(len(msg)))
+	b[39] = protocolICMPv6
+	copy(b[40:], msg)
+	if len(msg) >= icmpHeaderLen {
+		b[42], b[43] = 0, 0
+	}
+	return Checksum(b)
+}
+
+func (m *Message) String() string {
+	switch body := m.Body.(type) {
+	case nil:
+		return fmt.Sprintf("type=%d code=%d len=0", m.Type, m.Code)
+	case *Echo:
+		if body == nil {
+			return fmt.Sprintf("type=%d code=%d len=0", m.Type, m.Code)
+		}
+		return fmt.Sprintf("type=%d code=%d id=%d seq=%d", m.Type, m.Code, body.ID, body.Seq)
+	default:
+		return fmt.Sprintf("type=%d code=%d len=%d", m.Type, m.Code, m.Body.Len())
+	}
+}
@@ -0,0 +1,286 @@
+package pinger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want uint16
+	}{
+		{"empty", nil, 0xffff},
+		// the example of RFC 1071 section 3, its sum is 0xddf2
+		{"rfc 1071", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, ^uint16(0xddf2)},
+		{"odd length pads with zero", []byte{0x01, 0x02, 0x03}, ^uint16(0x0102 + 0x0300)},
+		{"first byte counts", []byte{0xff, 0x00}, 0x00ff},
+		{"end-around carry", []byte{0xff, 0xff, 0x00, 0x01}, 0xfffe},
+		{"echo header", []byte{8, 0, 0, 0, 0, 13, 0, 37}, ^uint16(0x0800 + 13 + 37)},
+	}
+	for _, tt := range tests {
+		if got := Checksum(tt.in); got != tt.want {
+			t.Errorf("%s: Checksum = %#04x, want %#04x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalParse(t *testing.T) {
+	quoted := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 1, 1, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, 8, 0, 0xf7, 0xff, 0, 0, 0, 0}
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"echo", &Message{Type: TypeEcho, Body: &Echo{ID: 13, Seq: 37, Data: []byte("hello")}}},
+		{"echo reply odd payload", &Message{Type: TypeEchoReply, Body: &Echo{ID: 0xffff, Seq: 1, Data: []byte{1, 2, 3}}}},
+		{"echo without data", &Message{Type: TypeEcho, Body: &Echo{ID: 1, Seq: 2, Data: []byte{}}}},
+		{"port unreachable", &Message{Type: TypeDestinationUnreachable, Code: 3, Body: &DstUnreach{Data: quoted}}},
+		{"fragmentation needed", &Message{Type: TypeDestinationUnreachable, Code: 4,
+			Body: &DstUnreach{Unused: [4]byte{0, 0, 0x05, 0xdc}, Data: quoted}}},
+		{"time exceeded", &Message{Type: TypeTimeExceeded, Body: &TimeExceeded{Data: quoted}}},
+		{"rfc 4884 length", &Message{Type: TypeTimeExceeded, Body: &TimeExceeded{Unused: [4]byte{0, 7, 0, 0}, Data: quoted}}},
+		{"unknown type", &Message{Type: 13, Body: &RawBody{Data: []byte{1, 2, 3, 4, 5}}}},
+	}
+	for _, tt := range tests {
+		b, err := tt.msg.Marshal()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if Checksum(b) != 0 {
+			t.Errorf("%s: checksum doesn't verify", tt.name)
+		}
+		m, err := ParseMessage(b)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if m.Type != tt.msg.Type || m.Code != tt.msg.Code || m.Checksum != binary.BigEndian.Uint16(b[2:]) {
+			t.Errorf("%s: parsed %v", tt.name, m)
+		}
+		again, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, b) {
+			t.Errorf("%s: round trip\n got %x\nwant %x", tt.name, again, b)
+		}
+	}
+}
+
+func TestDstUnreachMTU(t *testing.T) {
+	b, _ := (&Message{Type: TypeDestinationUnreachable, Code: 4,
+		Body: &DstUnreach{Unused: [4]byte{0, 0, 0x05, 0xdc}}}).Marshal()
+	m, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu := m.Body.(*DstUnreach).MTU(); mtu != 1500 {
+		t.Fatalf("MTU = %d", mtu)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid, _ := (&Message{Type: TypeEcho, Body: &Echo{ID: 1, Seq: 1}}).Marshal()
+	corrupt := append([]byte(nil), valid...)
+	corrupt[5] ^= 0x40
+	short := func(typ uint8) []byte {
+		b := []byte{typ, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], Checksum(b))
+		return b
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"empty", nil, ErrShortMessage},
+		{"header only", []byte{8, 0}, ErrShortMessage},
+		{"checksum", corrupt, ErrChecksum},
+		{"short echo", short(TypeEcho), ErrShortMessage},
+		{"short unreachable", short(TypeDestinationUnreachable), ErrShortMessage},
+		{"short time exceeded", short(TypeTimeExceeded), ErrShortMessage},
+	}
+	for _, tt := range tests {
+		if _, err := ParseMessage(tt.in); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestChecksumV6(t *testing.T) {
+	src, dst := net.ParseIP("fe80::1"), net.ParseIP("ff02::1")
+	m := &Message{Type: TypeV6Echo, Body: &Echo{ID: 0x1234, Seq: 1, Data: []byte("abc")}}
+	b, err := m.MarshalV6(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the checksum over the pseudo-header and message must verify
+	pseudo := make([]byte, 40, 40+len(b))
+	copy(pseudo, src.To16())
+	copy(pseudo[16:], dst.To16())
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(b)))
+	pseudo[39] = 58
+	if Checksum(append(pseudo, b...)) != 0 {
+		t.Fatal("pseudo-header checksum doesn't verify")
+	}
+	// and match what x/net computes for the same message
+	want, err := (&icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Body: &icmp.Echo{ID: 0x1234, Seq: 1, Data: []byte("abc")}}).
+		Marshal(icmp.IPv6PseudoHeader(src, dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("got %x, x/net %x", b, want)
+	}
+
+	if _, err := ParseMessageV6(b, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseMessageV6(b, src, net.ParseIP("ff02::2")); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("wrong destination: %v", err)
+	}
+	// without the addresses the checksum is left to the kernel
+	if _, err := ParseMessageV6(b, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	unset, _ := m.MarshalV6(nil, dst)
+	if binary.BigEndian.Uint16(unset[2:]) != 0 {
+		t.Fatal("checksum set without a source")
+	}
+}
+
+func TestMarshalMatchesXNet(t *testing.T) {
+	data := []byte("payload")
+	ours, _ := (&Message{Type: TypeEcho, Body: &Echo{ID: 7, Seq: 9, Data: data}}).Marshal()
+	theirs, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 7, Seq: 9, Data: data}}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ours, theirs) {
+		t.Fatalf("got %x, x/net %x", ours, theirs)
+	}
+}
+
+// FuzzParse builds messages with a valid checksum from the fuzzed
+// type, code and body and cross-checks the parsers with x/net/icmp
+func FuzzParse(f *testing.F) {
+	f.Add(false, TypeEcho, uint8(0), []byte{0, 1, 0, 2, 'h', 'i'})
+	f.Add(false, TypeEchoReply, uint8(0), []byte{0xff, 0xff, 0, 0})
+	f.Add(false, TypeDestinationUnreachable, uint8(4), []byte{0, 0, 5, 0xdc, 0x45, 0})
+	f.Add(false, TypeTimeExceeded, uint8(0), []byte{0, 1, 0, 0, 1, 2, 3, 4})
+	f.Add(false, uint8(13), uint8(0), []byte{1})
+	f.Add(true, TypeV6Echo, uint8(0), []byte{0, 1, 0, 2})
+	f.Add(true, TypeV6DestinationUnreachable, uint8(4), []byte{1, 0, 0, 0, 0x60})
+	f.Add(true, TypeV6TimeExceeded, uint8(0), []byte{0, 0, 0})
+	f.Fuzz(func(t *testing.T, v6 bool, typ, code uint8, body []byte) {
+		b := append([]byte{typ, code, 0, 0}, body...)
+		binary.BigEndian.PutUint16(b[2:], Checksum(b))
+
+		var m *Message
+		var err error
+		proto := protocolICMP
+		if v6 {
+			m, err = ParseMessageV6(b, nil, nil)
+			proto = protocolICMPv6
+		} else {
+			m, err = ParseMessage(b)
+		}
+		want, wantErr := icmp.ParseMessage(proto, b)
+
+		if err != nil {
+			if !errors.Is(err, ErrShortMessage) {
+				t.Fatalf("%x: %v", b, err)
+			}
+			if wantErr == nil {
+				t.Fatalf("%x: %v, x/net parses %+v", b, err, want.Body)
+			}
+			return
+		}
+		if wantErr != nil {
+			// x/net decodes more types, such as parameter problem
+			if _, ok := m.Body.(*RawBody); !ok {
+				t.Fatalf("%x: parsed %v, x/net: %v", b, m, wantErr)
+			}
+			return
+		}
+		if m.Code != uint8(want.Code) || int(m.Checksum) != want.Checksum {
+			t.Fatalf("%x: header %v, x/net %+v", b, m, want)
+		}
+
+		switch body := m.Body.(type) {
+		case *Echo:
+			e, ok := want.Body.(*icmp.Echo)
+			if !ok || e.ID != body.ID || e.Seq != body.Seq || !bytes.Equal(e.Data, body.Data) {
+				t.Fatalf("%x: echo %+v, x/net %+v", b, body, want.Body)
+			}
+		case *DstUnreach:
+			d, ok := want.Body.(*icmp.DstUnreach)
+			if !ok || !sameQuote(d.Data, body.Data) {
+				t.Fatalf("%x: unreachable %+v, x/net %+v", b, body, want.Body)
+			}
+		case *TimeExceeded:
+			d, ok := want.Body.(*icmp.TimeExceeded)
+			if !ok || !sameQuote(d.Data, body.Data) {
+				t.Fatalf("%x: time exceeded %+v, x/net %+v", b, body, want.Body)
+			}
+		case *RawBody:
+			if r, ok := want.Body.(*icmp.RawBody); ok && !bytes.Equal(r.Data, body.Data) {
+				t.Fatalf("%x: raw %x, x/net %x", b, body.Data, r.Data)
+			}
+		}
+
+		// nothing is lost between parsing and marshaling
+		var again []byte
+		if v6 {
+			again, err = m.MarshalV6(nil, nil)
+			binary.BigEndian.PutUint16(again[2:], m.Checksum)
+		} else {
+			again, err = m.Marshal()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, b) {
+			t.Fatalf("round trip\n got %x\nwant %x", again, b)
+		}
+	})
+}
+
+// sameQuote compares the quoted datagram, x/net cuts it short where
+// it finds an RFC 4884 extension header, either at the offset of the
+// length field or at 128 for the non-compliant implementations, while
+// ours keeps the extensions in Data
+func sameQuote(want, got []byte) bool {
+	if bytes.Equal(want, got) {
+		return true
+	}
+	return bytes.HasPrefix(got, want) && len(got) >= len(want)+4 && got[len(want)]>>4 == 2
+}
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		msg  *Message
+		want string
+	}{
+		{&Message{Type: TypeEcho, Body: &Echo{ID: 13, Seq: 37, Data: []byte("hello")}}, "type=8 code=0 id=13 seq=37"},
+		{&Message{Type: TypeTimeExceeded, Body: &TimeExceeded{Data: make([]byte, 28)}}, "type=11 code=0 len=32"},
+		{&Message{Type: TypeDestinationUnreachable, Code: 3}, "type=3 code=3 len=0"},
+		{&Message{Type: TypeEcho, Body: (*Echo)(nil)}, "type=8 code=0 len=0"},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+	if _, err := (&Message{Type: TypeEcho}).Marshal(); err == nil {
+		t.Error("message without body marshaled")
+	}
+}
@@ -0,0 +1,346 @@
+// Package pinger sends ICMP echo requests and collects ping(8) style
+// statistics.
+package pinger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCount    = 4
+	defaultInterval = time.Second
+	defaultTimeout  = 2 * time.Second
+	defaultSize     = 56
+
+	// the payload starts with the send time in unix nanoseconds
+	timestampLen = 8
+)
+
+// Packet is a received echo reply
+type Packet struct {
+	Addr  net.Addr
+	Seq   int
+	Bytes int
+	RTT   time.Duration
+}
+
+// Statistics summarizes a run like the last lines of ping(8)
+type Statistics struct {
+	Addr        string
+	PacketsSent int
+	PacketsRecv int
+	// Duplicates counts replies received more than once
+	Duplicates int
+	// PacketLoss is in percent
+	PacketLoss float64
+	RTTs       []time.Duration
+	MinRTT     time.Duration
+	AvgRTT     time.Duration
+	MaxRTT     time.Duration
+	StdDevRTT  time.Duration
+}
+
+// Pinger pings a single host, configure the exported fields
+// before calling Run
+type Pinger struct {
+	// Count is the number of echo requests to send, 0 means until
+	// ctx is cancelled
+	Count int
+	// Interval is the time between two requests
+	Interval time.Duration
+	// Timeout is how long to wait for a reply to the last request
+	Timeout time.Duration
+	// Size is the payload size in bytes, at least 8
+	Size int
+	// ID is the ICMP identifier, random by default.
+	// Unprivileged sockets ignore it and use one picked by the kernel.
+	ID int
+	// Mode selects between raw and datagram sockets
+	Mode Mode
+	// Source is the local address to send from, optional
+	Source string
+
+	// OnRecv is called for every matched reply
+	OnRecv func(*Packet)
+
+	addr *net.IPAddr
+	// id is the identifier replies are matched against
+	id uint16
+
+	mu    sync.Mutex
+	sent  map[uint16]time.Time
+	recvd map[uint16]bool
+	stats Statistics
+}
+
+// New resolves host, either IPv4 or IPv6, and returns a Pinger
+// with default settings
+func New(host string) (*Pinger, error) {
+	return NewWithNetwork("ip", host)
+}
+
+// NewWithNetwork is like New but network may be "ip4" or "ip6" to
+// force an address family
+func NewWithNetwork(network, host string) (*Pinger, error) {
+	addr, err := net.ResolveIPAddr(network, host)
+	if err != nil {
+		return nil, err
+	}
+	return &Pinger{
+		Count:    defaultCount,
+		Interval: defaultInterval,
+		Timeout:  defaultTimeout,
+		Size:     defaultSize,
+		ID:       rand.Intn(0xffff),
+		addr:     addr,
+	}, nil
+}
+
+// Addr returns the resolved address
+func (p *Pinger) Addr() *net.IPAddr {
+	return p.addr
+}
+
+// IsIPv6 reports whether the target is an IPv6 address
+func (p *Pinger) IsIPv6() bool {
+	return p.addr.IP.To4() == nil
+}
+
+// Run sends the echo requests and blocks until all replies arrived,
+// the last one timed out or ctx is done.
+func (p *Pinger) Run(ctx context.Context) (*Statistics, error) {
+	if p.Size < timestampLen {
+		return nil, errors.New("payload size must be at least 8 bytes")
+	}
+	conn, err := listen(p.Mode, p.IsIPv6(), p.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	p.reset(uint16(conn.echoID(p.ID)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- p.recvLoop(ctx, conn)
+	}()
+
+	sendErr := p.ping(ctx, conn)
+	cancel()
+	// unblock ReadFrom
+	conn.SetReadDeadline(time.Now())
+	err = <-recvErr
+	if sendErr != nil {
+		err = sendErr
+	}
+
+	return p.Statistics(), err
+}
+
+// reset prepares a run matching replies with identifier id
+func (p *Pinger) reset(id uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.id = id
+	p.sent = make(map[uint16]time.Time)
+	p.recvd = make(map[uint16]bool)
+	p.stats = Statistics{Addr: p.addr.String()}
+}
+
+// ping sends the requests and waits for the last reply,
+// replies are fed to handle by whoever reads conn
+func (p *Pinger) ping(ctx context.Context, conn *icmpConn) error {
+	if err := p.sendLoop(ctx, conn); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(p.Timeout):
+	case <-p.allReceived(ctx):
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (p *Pinger) sendLoop(ctx context.Context, conn *icmpConn) error {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for seq := 0; p.Count == 0 || seq < p.Count; seq++ {
+		if seq > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err := p.send(conn, uint16(seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pinger) send(conn *icmpConn, seq uint16) error {
+	now := time.Now()
+	data := make([]byte, p.Size)
+	binary.BigEndian.PutUint64(data, uint64(now.UnixNano()))
+
+	m := &Message{
+		Type: TypeEcho,
+		Body: &Echo{ID: int(p.id), Seq: int(seq), Data: data},
+	}
+	var msg []byte
+	var err error
+	if conn.v6 {
+		m.Type = TypeV6Echo
+		msg, err = m.MarshalV6(conn.sourceIP(), p.addr.IP)
+	} else {
+		msg, err = m.Marshal()
+	}
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	// the sequence number wraps after 65536 requests when Count is 0,
+	// forget the reply to the previous request with this number
+	p.sent[seq] = now
+	delete(p.recvd, seq)
+	p.stats.PacketsSent++
+	p.mu.Unlock()
+
+	_, err = conn.WriteTo(msg, conn.dst(p.addr.IP))
+	return err
+}
+
+func (p *Pinger) recvLoop(ctx context.Context, conn *icmpConn) error {
+	// one ReadFrom returns a whole datagram, truncated to buf, so
+	// there is no stream to bound with ioutils.ReadAll
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		p.handle(buf[:n], from, time.Now(), conn)
+	}
+}
+
+// handle matches a reply by source, identifier and sequence number
+func (p *Pinger) handle(b []byte, from net.Addr, at time.Time, conn *icmpConn) {
+	if !addrIP(from).Equal(p.addr.IP) {
+		return
+	}
+	msg, err := conn.parse(b, addrIP(from))
+	if err != nil {
+		return
+	}
+	reply, ok := msg.Body.(*Echo)
+	if !ok || msg.Type != conn.echoReplyType() || reply.ID != int(p.id) {
+		return
+	}
+	seq := uint16(reply.Seq)
+
+	p.mu.Lock()
+	sentAt, ok := p.sent[seq]
+	// a late reply to an earlier request with the same sequence
+	// number carries the send time of that request
+	if !ok || len(reply.Data) < timestampLen ||
+		int64(binary.BigEndian.Uint64(reply.Data)) != sentAt.UnixNano() {
+		p.mu.Unlock()
+		return
+	}
+	if p.recvd[seq] {
+		p.stats.Duplicates++
+		p.mu.Unlock()
+		return
+	}
+	p.recvd[seq] = true
+	rtt := at.Sub(sentAt)
+	p.stats.PacketsRecv++
+	p.stats.RTTs = append(p.stats.RTTs, rtt)
+	p.mu.Unlock()
+
+	if p.OnRecv != nil {
+		p.OnRecv(&Packet{
+			Addr:  from,
+			Seq:   int(seq),
+			Bytes: len(b),
+			RTT:   rtt,
+		})
+	}
+}
+
+// allReceived is closed once every request sent got a reply
+func (p *Pinger) allReceived(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			p.mu.Lock()
+			all := len(p.recvd) == len(p.sent)
+			p.mu.Unlock()
+			if all {
+				return
+			}
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// Statistics returns the statistics collected so far
+func (p *Pinger) Statistics() *Statistics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats
+	s.RTTs = append([]time.Duration(nil), p.stats.RTTs...)
+	s.compute()
+	return &s
+}
+
+func (s *Statistics) compute() {
+	if s.PacketsSent > 0 {
+		s.PacketLoss = float64(s.PacketsSent-s.PacketsRecv) / float64(s.PacketsSent) * 100
+	}
+	if len(s.RTTs) == 0 {
+		return
+	}
+
+	var sum, sumSq float64
+	s.MinRTT, s.MaxRTT = s.RTTs[0], s.RTTs[0]
+	for _, rtt := range s.RTTs {
+		if rtt < s.MinRTT {
+			s.MinRTT = rtt
+		}
+		if rtt > s.MaxRTT {
+			s.MaxRTT = rtt
+		}
+		sum += float64(rtt)
+		sumSq += float64(rtt) * float64(rtt)
+	}
+	n := float64(len(s.RTTs))
+	avg := sum / n
+	s.AvgRTT = time.Duration(avg)
+	// ping(8) reports this as mdev
+	s.StdDevRTT = time.Duration(math.Sqrt(math.Max(sumSq/n-avg*avg, 0)))
+}
@@ -0,0 +1,135 @@
+package pinger
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// recordConn keeps the written packets instead of sending them
+type recordConn struct {
+	net.PacketConn
+	written [][]byte
+}
+
+func (c *recordConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *recordConn) LocalAddr() net.Addr {
+	return &net.IPAddr{IP: net.IPv4zero}
+}
+
+// replyTo turns a sent echo request into the reply a host would send
+func replyTo(t *testing.T, request []byte) []byte {
+	t.Helper()
+	m, err := ParseMessage(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Type = TypeEchoReply
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newTestPinger(t *testing.T) (*Pinger, *icmpConn, *recordConn) {
+	t.Helper()
+	p, err := New("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &recordConn{}
+	conn := &icmpConn{PacketConn: rc, privileged: true}
+	p.reset(42)
+	return p, conn, rc
+}
+
+func TestPingerHandle(t *testing.T) {
+	p, conn, rc := newTestPinger(t)
+	from := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	var got []*Packet
+	p.OnRecv = func(pkt *Packet) { got = append(got, pkt) }
+
+	for seq := uint16(0); seq < 3; seq++ {
+		if err := p.send(conn, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	p.handle(replyTo(t, rc.written[1]), from, now, conn)
+	p.handle(replyTo(t, rc.written[0]), from, now, conn)
+	// duplicate
+	p.handle(replyTo(t, rc.written[0]), from, now, conn)
+	// another host
+	p.handle(replyTo(t, rc.written[2]), &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}, now, conn)
+	// the request itself, as seen on loopback with a raw socket
+	p.handle(rc.written[2], from, now, conn)
+
+	s := p.Statistics()
+	if s.PacketsSent != 3 || s.PacketsRecv != 2 || s.Duplicates != 1 {
+		t.Fatalf("sent %d, received %d, duplicates %d", s.PacketsSent, s.PacketsRecv, s.Duplicates)
+	}
+	if len(got) != 2 || got[0].Seq != 1 || got[1].Seq != 0 {
+		t.Fatalf("OnRecv got %+v", got)
+	}
+	if s.PacketLoss < 33 || s.PacketLoss > 34 {
+		t.Fatalf("loss %.1f%%", s.PacketLoss)
+	}
+}
+
+// with Count 0 the 16-bit sequence number wraps, the reply to the
+// reused number must count as new and a late reply to the previous
+// request with that number must be ignored
+func TestPingerSeqWrap(t *testing.T) {
+	p, conn, rc := newTestPinger(t)
+	from := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	if err := p.send(conn, 7); err != nil {
+		t.Fatal(err)
+	}
+	first := replyTo(t, rc.written[0])
+	p.handle(first, from, time.Now(), conn)
+
+	// make sure the second request gets another timestamp
+	time.Sleep(time.Millisecond)
+	if err := p.send(conn, 7); err != nil {
+		t.Fatal(err)
+	}
+	// the late copy of the first reply
+	p.handle(first, from, time.Now(), conn)
+	s := p.Statistics()
+	if s.PacketsRecv != 1 || s.Duplicates != 0 {
+		t.Fatalf("stale reply: received %d, duplicates %d", s.PacketsRecv, s.Duplicates)
+	}
+
+	second := replyTo(t, rc.written[1])
+	p.handle(second, from, time.Now(), conn)
+	p.handle(second, from, time.Now(), conn)
+	s = p.Statistics()
+	if s.PacketsSent != 2 || s.PacketsRecv != 2 || s.Duplicates != 1 {
+		t.Fatalf("sent %d, received %d, duplicates %d", s.PacketsSent, s.PacketsRecv, s.Duplicates)
+	}
+}
+
+func TestStatisticsCompute(t *testing.T) {
+	s := &Statistics{
+		PacketsSent: 4,
+		PacketsRecv: 3,
+		RTTs:        []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+	}
+	s.compute()
+	if s.PacketLoss != 25 {
+		t.Errorf("loss %.1f%%", s.PacketLoss)
+	}
+	if s.MinRTT != 10*time.Millisecond || s.MaxRTT != 30*time.Millisecond || s.AvgRTT != 20*time.Millisecond {
+		t.Errorf("min/avg/max %s/%s/%s", s.MinRTT, s.AvgRTT, s.MaxRTT)
+	}
+	// population standard deviation like ping's mdev
+	if d := s.StdDevRTT - 8164965*time.Nanosecond; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("stddev %s", s.StdDevRTT)
+	}
+}
@@ -0,0 +1,146 @@
+package pinger
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Mode selects the kind of socket used to send echo requests
+type Mode uint8
+
+const (
+	// ModeAuto tries a raw socket first and falls back to an
+	// unprivileged one when permission is denied
+	ModeAuto Mode = iota
+	// ModePrivileged uses a raw socket, which needs root or CAP_NET_RAW
+	ModePrivileged
+	// ModeUnprivileged uses a datagram ICMP socket, allowed on Linux
+	// for groups listed in net.ipv4.ping_group_range
+	ModeUnprivileged
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeAuto:
+		return "auto"
+	case ModePrivileged:
+		return "privileged"
+	case ModeUnprivileged:
+		return "unprivileged"
+	default:
+		return ""
+	}
+}
+
+// icmpConn hides the differences between raw and datagram ICMP sockets
+type icmpConn struct {
+	net.PacketConn
+	v6         bool
+	privileged bool
+}
+
+// listen opens an ICMP socket for the given family,
+// source is the local address to bind to and may be empty
+func listen(mode Mode, v6 bool, source string) (*icmpConn, error) {
+	switch mode {
+	case ModePrivileged:
+		return listenPrivileged(v6, source)
+	case ModeUnprivileged:
+		return listenUnprivileged(v6, source)
+	}
+
+	c, err := listenPrivileged(v6, source)
+	if err == nil || !isPermissionError(err) {
+		return c, err
+	}
+	c, uerr := listenUnprivileged(v6, source)
+	if uerr != nil {
+		// the raw socket error is usually the more helpful one
+		return nil, err
+	}
+	return c, nil
+}
+
+func listenPrivileged(v6 bool, source string) (*icmpConn, error) {
+	network, laddr := "ip4:icmp", "0.0.0.0"
+	if v6 {
+		network, laddr = "ip6:ipv6-icmp", "::"
+	}
+	if source != "" {
+		laddr = source
+	}
+	c, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &icmpConn{PacketConn: c, v6: v6, privileged: true}, nil
+}
+
+func isPermissionError(err error) bool {
+	return errors.Is(err, os.ErrPermission) ||
+		errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.EACCES) ||
+		errors.Is(err, syscall.EPROTONOSUPPORT)
+}
+
+// echoID returns the identifier replies will carry. Datagram sockets
+// replace the identifier with the local "port" chosen by the kernel.
+func (c *icmpConn) echoID(id int) int {
+	if !c.privileged {
+		if a, ok := c.LocalAddr().(*net.UDPAddr); ok {
+			return a.Port
+		}
+	}
+	return id
+}
+
+// dst returns the address type expected by WriteTo
+func (c *icmpConn) dst(ip net.IP) net.Addr {
+	if c.privileged {
+		return &net.IPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
+
+// sourceIP returns the bound local address, nil if unspecified
+func (c *icmpConn) sourceIP() net.IP {
+	var ip net.IP
+	switch a := c.LocalAddr().(type) {
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (c *icmpConn) echoReplyType() uint8 {
+	if c.v6 {
+		return TypeV6EchoReply
+	}
+	return TypeEchoReply
+}
+
+// parse decodes a received message, checksums of ICMPv6 can only be
+// verified when the socket is bound to a known address
+func (c *icmpConn) parse(b []byte, from net.IP) (*Message, error) {
+	if c.v6 {
+		return ParseMessageV6(b, from, c.sourceIP())
+	}
+	return ParseMessage(b)
+}
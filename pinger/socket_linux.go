@@ -0,0 +1,78 @@
+package pinger
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnprivileged opens a SOCK_DGRAM ICMP socket, the kernel then
+// manages the identifier and checksum and strips the IP header
+func listenUnprivileged(v6 bool, source string) (*icmpConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if v6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	var ip net.IP
+	if source != "" {
+		ip = net.ParseIP(source)
+		if ip == nil {
+			syscall.Close(fd)
+			return nil, &net.AddrError{Err: "invalid source address", Addr: source}
+		}
+	}
+	// binding with port 0 makes the kernel pick the identifier now,
+	// so LocalAddr reports it
+	var sa syscall.Sockaddr
+	if v6 {
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip.To4())
+		sa = sa4
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &icmpConn{PacketConn: c, v6: v6}, nil
+}
+
+// setTTL sets the TTL, or hop limit for IPv6, of outgoing packets
+func (c *icmpConn) setTTL(ttl int) error {
+	sc, ok := c.PacketConn.(syscall.Conn)
+	if !ok {
+		return errors.New("socket options are not supported")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if c.v6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,138 @@
+package pinger
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// skipUnavailable skips when the socket kind or the address family
+// isn't available to the test process
+func skipUnavailable(t *testing.T, mode Mode, err error) {
+	t.Helper()
+	switch {
+	case isPermissionError(err) && mode == ModeUnprivileged:
+		t.Skipf("unprivileged ICMP not permitted, check net.ipv4.ping_group_range: %v", err)
+	case isPermissionError(err):
+		t.Skipf("raw sockets need CAP_NET_RAW: %v", err)
+	case errors.Is(err, syscall.EAFNOSUPPORT), errors.Is(err, syscall.EADDRNOTAVAIL):
+		t.Skipf("address family unavailable: %v", err)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		mode   Mode
+		host   string
+		source string
+	}{
+		{ModeUnprivileged, "127.0.0.1", ""},
+		{ModeUnprivileged, "127.0.0.1", "127.0.0.1"},
+		{ModeUnprivileged, "::1", ""},
+		// a bound source lets ICMPv6 checksums be verified
+		{ModeUnprivileged, "::1", "::1"},
+		{ModePrivileged, "127.0.0.1", ""},
+		{ModePrivileged, "::1", ""},
+		{ModePrivileged, "::1", "::1"},
+		{ModeAuto, "127.0.0.1", ""},
+		{ModeAuto, "::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String()+"/"+tt.host+"/"+tt.source, func(t *testing.T) {
+			p, err := New(tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Mode = tt.mode
+			p.Source = tt.source
+			p.Count = 3
+			p.Interval = 10 * time.Millisecond
+			p.Timeout = time.Second
+			var seqs []int
+			p.OnRecv = func(pkt *Packet) { seqs = append(seqs, pkt.Seq) }
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			s, err := p.Run(ctx)
+			skipUnavailable(t, tt.mode, err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.PacketsSent != 3 || s.PacketsRecv != 3 || s.Duplicates != 0 || s.PacketLoss != 0 {
+				t.Fatalf("sent %d, received %d, duplicates %d, loss %.0f%%",
+					s.PacketsSent, s.PacketsRecv, s.Duplicates, s.PacketLoss)
+			}
+			if len(seqs) != 3 || seqs[0] != 0 || seqs[2] != 2 {
+				t.Fatalf("replies to %v", seqs)
+			}
+			if s.MinRTT <= 0 || s.MaxRTT > time.Second {
+				t.Fatalf("rtt min %s max %s", s.MinRTT, s.MaxRTT)
+			}
+		})
+	}
+}
+
+// datagram sockets use the local "port" picked by the kernel as the
+// identifier, whatever the Pinger asked for
+func TestUnprivilegedEchoID(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		c, err := listenUnprivileged(v6, "")
+		skipUnavailable(t, ModeUnprivileged, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.privileged || c.v6 != v6 {
+			t.Fatalf("conn %+v", c)
+		}
+		a, ok := c.LocalAddr().(*net.UDPAddr)
+		if !ok || a.Port == 0 {
+			t.Fatalf("local address %v", c.LocalAddr())
+		}
+		if id := c.echoID(1234); id != a.Port {
+			t.Fatalf("echoID = %d, want %d", id, a.Port)
+		}
+		if _, ok := c.dst(net.IPv6loopback).(*net.UDPAddr); !ok {
+			t.Fatal("datagram sockets take UDP addresses")
+		}
+	}
+}
+
+func TestUnprivilegedInvalidSource(t *testing.T) {
+	if _, err := listenUnprivileged(false, "not-an-ip"); err == nil {
+		t.Fatal("invalid source accepted")
+	}
+}
+
+// the same host listed twice, and once more by name, shares the
+// kernel's identifier on an unprivileged socket
+func TestSweepDuplicateHosts(t *testing.T) {
+	for _, mode := range []Mode{ModeUnprivileged, ModePrivileged} {
+		t.Run(mode.String(), func(t *testing.T) {
+			s := NewSweeper()
+			s.Mode = mode
+			s.Count = 3
+			s.Interval = 10 * time.Millisecond
+			s.Timeout = time.Second
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			results, err := s.Run(ctx, []string{"127.0.0.1", "127.0.0.1", "localhost", "::1", "::1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				skipUnavailable(t, mode, r.Err)
+				if r.Err != nil {
+					t.Fatalf("%s: %v", r.Host, r.Err)
+				}
+				if r.Stats.PacketsRecv != 3 || r.Stats.Duplicates != 0 {
+					t.Errorf("%s: received %d, duplicates %d", r.Host, r.Stats.PacketsRecv, r.Stats.Duplicates)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pinger
+
+import "errors"
+
+func listenUnprivileged(v6 bool, source string) (*icmpConn, error) {
+	return nil, errors.New("unprivileged ICMP sockets are only supported on Linux")
+}
+
+func (c *icmpConn) setTTL(ttl int) error {
+	return errors.New("setting the TTL is only supported on Linux")
+}
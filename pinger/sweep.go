@@ -0,0 +1,299 @@
+package pinger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxSweepHosts bounds CIDR expansion, a /16 is the largest accepted range
+const maxSweepHosts = 1 << 16
+
+// Result is the outcome of pinging one host in a sweep
+type Result struct {
+	Host  string
+	Stats *Statistics
+	Err   error
+}
+
+// Sweeper pings many hosts concurrently, fping style. All hosts of an
+// address family share one socket, replies are dispatched by
+// identifier, or by source address for unprivileged sockets where the
+// kernel owns the identifier. A host listed twice is pinged twice, on
+// unprivileged sockets its pingers tell their replies apart by the
+// send time carried in the payload.
+type Sweeper struct {
+	Count    int
+	Interval time.Duration
+	Timeout  time.Duration
+	Size     int
+	Mode     Mode
+	Source   string
+	// MaxInFlight bounds the number of hosts pinged at the same time
+	MaxInFlight int
+
+	// OnResult is called as soon as a host is done
+	OnResult func(*Result)
+}
+
+// NewSweeper returns a Sweeper with the defaults of New
+func NewSweeper() *Sweeper {
+	return &Sweeper{
+		Count:       defaultCount,
+		Interval:    defaultInterval,
+		Timeout:     defaultTimeout,
+		Size:        defaultSize,
+		MaxInFlight: 64,
+	}
+}
+
+// sharedConn reads one socket and hands replies to registered pingers
+type sharedConn struct {
+	conn *icmpConn
+
+	mu   sync.Mutex
+	byID map[uint16]*Pinger
+	// all pingers of an address share the kernel's identifier
+	byAddr map[string][]*Pinger
+	nextID uint16
+}
+
+func (c *sharedConn) register(p *Pinger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn.privileged {
+		// skip identifiers still in use, there are far more
+		// identifiers than hosts in flight
+		for {
+			c.nextID++
+			if _, ok := c.byID[c.nextID]; !ok {
+				break
+			}
+		}
+		p.reset(c.nextID)
+		c.byID[p.id] = p
+		return
+	}
+	p.reset(uint16(c.conn.echoID(0)))
+	addr := p.addr.IP.String()
+	c.byAddr[addr] = append(c.byAddr[addr], p)
+}
+
+func (c *sharedConn) unregister(p *Pinger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn.privileged {
+		delete(c.byID, p.id)
+		return
+	}
+	addr := p.addr.IP.String()
+	pingers := c.byAddr[addr]
+	for i, q := range pingers {
+		if q == p {
+			pingers = append(pingers[:i:i], pingers[i+1:]...)
+			break
+		}
+	}
+	if len(pingers) == 0 {
+		delete(c.byAddr, addr)
+		return
+	}
+	c.byAddr[addr] = pingers
+}
+
+// lookup returns the pingers a reply may belong to. Pingers of the
+// same address can't be told apart by identifier on unprivileged
+// sockets, they all get the reply and handle only accepts it when the
+// sequence number and send time match a request of its own.
+func (c *sharedConn) lookup(b []byte, from net.Addr) []*Pinger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.conn.privileged {
+		return append([]*Pinger(nil), c.byAddr[addrIP(from).String()]...)
+	}
+	msg, err := c.conn.parse(b, addrIP(from))
+	if err != nil {
+		return nil
+	}
+	if e, ok := msg.Body.(*Echo); ok {
+		if p, ok := c.byID[uint16(e.ID)]; ok {
+			return []*Pinger{p}
+		}
+	}
+	return nil
+}
+
+func (c *sharedConn) dispatch(ctx context.Context) error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		at := time.Now()
+		for _, p := range c.lookup(buf[:n], from) {
+			p.handle(buf[:n], from, at, c.conn)
+		}
+	}
+}
+
+// Run pings hosts, which may be names, addresses or CIDR ranges, and
+// returns one result per address in input order
+func (s *Sweeper) Run(ctx context.Context, hosts []string) ([]*Result, error) {
+	if s.Size < timestampLen {
+		return nil, errors.New("payload size must be at least 8 bytes")
+	}
+	if s.MaxInFlight < 1 {
+		return nil, fmt.Errorf("invalid number of hosts in flight: %d", s.MaxInFlight)
+	}
+
+	targets := []string{}
+	for _, h := range hosts {
+		if _, _, err := net.ParseCIDR(h); err == nil {
+			addrs, err := ExpandCIDR(h)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, addrs...)
+			continue
+		}
+		targets = append(targets, h)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var connMu sync.Mutex
+	conns := map[bool]*sharedConn{}
+	var dispatchers sync.WaitGroup
+	// getConn opens the socket of a family on first use
+	getConn := func(v6 bool) (*sharedConn, error) {
+		connMu.Lock()
+		defer connMu.Unlock()
+		if c, ok := conns[v6]; ok {
+			return c, nil
+		}
+		conn, err := listen(s.Mode, v6, s.Source)
+		if err != nil {
+			return nil, err
+		}
+		c := &sharedConn{
+			conn:   conn,
+			byID:   make(map[uint16]*Pinger),
+			byAddr: make(map[string][]*Pinger),
+			nextID: uint16(rand.Intn(0xffff)),
+		}
+		conns[v6] = c
+		dispatchers.Add(1)
+		go func() {
+			defer dispatchers.Done()
+			c.dispatch(ctx)
+		}()
+		return c, nil
+	}
+
+	results := make([]*Result, len(targets))
+	sem := make(chan struct{}, s.MaxInFlight)
+	var wg sync.WaitGroup
+	for i, host := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			results[i] = &Result{Host: host, Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, host string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r := s.pingOne(ctx, host, getConn)
+			results[i] = r
+			if s.OnResult != nil {
+				s.OnResult(r)
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	cancel()
+	for _, c := range conns {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	dispatchers.Wait()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+	return results, nil
+}
+
+func (s *Sweeper) pingOne(ctx context.Context, host string, getConn func(bool) (*sharedConn, error)) *Result {
+	r := &Result{Host: host}
+	p, err := New(host)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	p.Count = s.Count
+	p.Interval = s.Interval
+	p.Timeout = s.Timeout
+	p.Size = s.Size
+
+	c, err := getConn(p.IsIPv6())
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	c.register(p)
+	defer c.unregister(p)
+
+	r.Err = p.ping(ctx, c.conn)
+	r.Stats = p.Statistics()
+	return r
+}
+
+// ExpandCIDR lists the host addresses of an IPv4 or IPv6 range,
+// leaving out the network and broadcast addresses of IPv4 ranges
+// larger than /31
+func ExpandCIDR(cidr string) ([]string, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("range %s is larger than %d addresses", cidr, maxSweepHosts)
+	}
+
+	addrs := []string{}
+	for cur := ip.Mask(ipnet.Mask); ipnet.Contains(cur); cur = nextIP(cur) {
+		addrs = append(addrs, cur.String())
+	}
+	if bits == 32 && bits-ones > 1 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	return addrs, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
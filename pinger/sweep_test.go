@@ -0,0 +1,121 @@
+package pinger
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSharedConn(privileged bool) (*sharedConn, *recordConn) {
+	rc := &recordConn{}
+	return &sharedConn{
+		conn:   &icmpConn{PacketConn: rc, privileged: privileged},
+		byID:   make(map[uint16]*Pinger),
+		byAddr: make(map[string][]*Pinger),
+	}, rc
+}
+
+// deliver hands a reply to the pingers the shared socket routes it to
+func deliver(c *sharedConn, b []byte, from net.Addr) {
+	for _, p := range c.lookup(b, from) {
+		p.handle(b, from, time.Now(), c.conn)
+	}
+}
+
+// on an unprivileged socket every pinger of an address gets the
+// kernel's identifier, a host listed twice must not steal the replies
+// of the other
+func TestSharedConnDuplicateAddr(t *testing.T) {
+	c, rc := newTestSharedConn(false)
+	from := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a, _ := New("127.0.0.1")
+	b, _ := New("127.0.0.1")
+	c.register(a)
+	c.register(b)
+	if a.id != b.id {
+		t.Fatalf("identifiers %d and %d", a.id, b.id)
+	}
+
+	for seq := uint16(0); seq < 2; seq++ {
+		if err := a.send(c.conn, seq); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := b.send(c.conn, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, w := range rc.written {
+		deliver(c, replyTo(t, w), from)
+	}
+	for name, p := range map[string]*Pinger{"first": a, "second": b} {
+		s := p.Statistics()
+		if s.PacketsSent != 2 || s.PacketsRecv != 2 || s.Duplicates != 0 {
+			t.Errorf("%s: sent %d, received %d, duplicates %d", name, s.PacketsSent, s.PacketsRecv, s.Duplicates)
+		}
+	}
+
+	// the remaining pinger still gets its replies
+	c.unregister(a)
+	if err := b.send(c.conn, 2); err != nil {
+		t.Fatal(err)
+	}
+	deliver(c, replyTo(t, rc.written[len(rc.written)-1]), from)
+	if s := b.Statistics(); s.PacketsRecv != 3 {
+		t.Errorf("after unregister: received %d", s.PacketsRecv)
+	}
+	c.unregister(b)
+	if len(c.byAddr) != 0 {
+		t.Errorf("left registered: %v", c.byAddr)
+	}
+}
+
+func TestSharedConnByID(t *testing.T) {
+	c, rc := newTestSharedConn(true)
+	from := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a, _ := New("127.0.0.1")
+	b, _ := New("127.0.0.1")
+	c.register(a)
+	c.register(b)
+	if a.id == b.id {
+		t.Fatalf("both pingers got identifier %d", a.id)
+	}
+	a.send(c.conn, 0)
+	if got := c.lookup(replyTo(t, rc.written[0]), from); len(got) != 1 || got[0] != a {
+		t.Fatalf("routed to %v", got)
+	}
+	c.unregister(a)
+	if got := c.lookup(replyTo(t, rc.written[0]), from); len(got) != 0 {
+		t.Fatalf("routed to %v after unregister", got)
+	}
+}
+
+func TestExpandCIDR(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+		err  bool
+	}{
+		{"192.0.2.0/30", []string{"192.0.2.1", "192.0.2.2"}, false},
+		{"192.0.2.4/31", []string{"192.0.2.4", "192.0.2.5"}, false},
+		{"192.0.2.7/32", []string{"192.0.2.7"}, false},
+		{"192.0.2.9/30", []string{"192.0.2.9", "192.0.2.10"}, false},
+		{"2001:db8::/127", []string{"2001:db8::", "2001:db8::1"}, false},
+		{"10.0.0.0/15", nil, true},
+		{"10.0.0.0", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ExpandCIDR(tt.cidr)
+		if tt.err != (err != nil) {
+			t.Errorf("%s: error %v", tt.cidr, err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.cidr, got, tt.want)
+		}
+	}
+	if got, _ := ExpandCIDR("10.0.0.0/16"); len(got) != maxSweepHosts-2 {
+		t.Errorf("/16 expands to %d addresses", len(got))
+	}
+}
@@ -0,0 +1,271 @@
+package pinger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultMaxHops = 30
+
+// Hop is one line of traceroute output
+type Hop struct {
+	TTL int
+	// Addr is the first address which answered, nil if none did
+	Addr net.IP
+	// Name is the reverse-resolved Addr, only with ResolveNames
+	Name string
+	// RTTs has one entry per probe, -1 marks a lost probe
+	RTTs []time.Duration
+	// Addrs has the address which answered each probe, nil for a
+	// lost one. They differ when the path is load balanced (ECMP)
+	Addrs []net.IP
+	// Names maps the responders to their reverse-resolved names,
+	// only with ResolveNames
+	Names map[string]string
+	// Reached is set when the destination itself answered
+	Reached bool
+	// Unreachable holds the code of a destination unreachable
+	// message, -1 if none was received
+	Unreachable int
+}
+
+// Responders returns the distinct addresses which answered,
+// in the order they first did
+func (h *Hop) Responders() []net.IP {
+	seen := map[string]bool{}
+	addrs := []net.IP{}
+	for _, addr := range h.Addrs {
+		if addr != nil && !seen[addr.String()] {
+			seen[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Lost counts the probes which got no answer
+func (h *Hop) Lost() int {
+	n := 0
+	for _, rtt := range h.RTTs {
+		if rtt < 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Tracer discovers the path to a host by sending echo requests with
+// increasing TTL and reading the time exceeded replies of each hop.
+// It needs a raw socket: datagram ICMP sockets only report errors
+// through the socket error queue.
+type Tracer struct {
+	// MaxHops is the largest TTL tried
+	MaxHops int
+	// Probes is the number of requests sent per hop
+	Probes int
+	// Timeout is how long to wait for the answer of a probe
+	Timeout time.Duration
+	// Size is the payload size in bytes, at least 8
+	Size   int
+	Source string
+	// ResolveNames reverse-resolves hop addresses
+	ResolveNames bool
+
+	// OnHop is called as soon as a hop is done
+	OnHop func(*Hop)
+
+	addr *net.IPAddr
+	id   uint16
+}
+
+// NewTracer resolves host, network is "ip", "ip4" or "ip6"
+func NewTracer(network, host string) (*Tracer, error) {
+	addr, err := net.ResolveIPAddr(network, host)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{
+		MaxHops: defaultMaxHops,
+		Probes:  3,
+		Timeout: defaultTimeout,
+		Size:    defaultSize,
+		addr:    addr,
+	}, nil
+}
+
+// Addr returns the resolved destination
+func (t *Tracer) Addr() *net.IPAddr {
+	return t.addr
+}
+
+// Run probes one hop after another until the destination answers,
+// reports it unreachable or MaxHops is reached
+func (t *Tracer) Run(ctx context.Context) ([]*Hop, error) {
+	if t.Size < timestampLen {
+		return nil, errors.New("payload size must be at least 8 bytes")
+	}
+	v6 := t.addr.IP.To4() == nil
+	conn, err := listen(ModePrivileged, v6, t.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	t.id = uint16(conn.echoID(rand.Intn(0xffff)))
+
+	hops := []*Hop{}
+	for ttl := 1; ttl <= t.MaxHops; ttl++ {
+		if err := conn.setTTL(ttl); err != nil {
+			return hops, err
+		}
+		hop := &Hop{TTL: ttl, Unreachable: -1}
+		for probe := 0; probe < t.Probes; probe++ {
+			if ctx.Err() != nil {
+				return hops, ctx.Err()
+			}
+			seq := uint16(ttl*t.Probes + probe)
+			rtt, from, err := t.probe(ctx, conn, seq, hop)
+			if err != nil {
+				return hops, err
+			}
+			hop.RTTs = append(hop.RTTs, rtt)
+			hop.Addrs = append(hop.Addrs, from)
+			if hop.Addr == nil {
+				hop.Addr = from
+			}
+		}
+		if t.ResolveNames {
+			hop.Names = map[string]string{}
+			for _, addr := range hop.Responders() {
+				if names, err := net.DefaultResolver.LookupAddr(ctx, addr.String()); err == nil && len(names) > 0 {
+					hop.Names[addr.String()] = strings.TrimSuffix(names[0], ".")
+				}
+			}
+			if hop.Addr != nil {
+				hop.Name = hop.Names[hop.Addr.String()]
+			}
+		}
+
+		hops = append(hops, hop)
+		if t.OnHop != nil {
+			t.OnHop(hop)
+		}
+		if hop.Reached || hop.Unreachable >= 0 {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// probe sends one request and waits for its echo reply, time exceeded
+// or destination unreachable, returning the round trip time and the
+// address which answered, or -1 and nil on timeout
+func (t *Tracer) probe(ctx context.Context, conn *icmpConn, seq uint16, hop *Hop) (time.Duration, net.IP, error) {
+	data := make([]byte, t.Size)
+	sentAt := time.Now()
+	binary.BigEndian.PutUint64(data, uint64(sentAt.UnixNano()))
+
+	m := &Message{Type: TypeEcho, Body: &Echo{ID: int(t.id), Seq: int(seq), Data: data}}
+	var msg []byte
+	var err error
+	if conn.v6 {
+		m.Type = TypeV6Echo
+		msg, err = m.MarshalV6(conn.sourceIP(), t.addr.IP)
+	} else {
+		msg, err = m.Marshal()
+	}
+	if err != nil {
+		return -1, nil, err
+	}
+	if _, err := conn.WriteTo(msg, conn.dst(t.addr.IP)); err != nil {
+		return -1, nil, err
+	}
+
+	deadline := sentAt.Add(t.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return -1, nil, nil
+			}
+			return -1, nil, err
+		}
+		rtt := time.Since(sentAt)
+
+		reply, err := conn.parse(buf[:n], addrIP(from))
+		if err != nil {
+			continue
+		}
+		var echo *Echo
+		switch body := reply.Body.(type) {
+		case *Echo:
+			if reply.Type == conn.echoReplyType() {
+				echo = body
+			}
+		case *TimeExceeded:
+			echo, _ = OriginalEcho(body.Data, conn.v6)
+		case *DstUnreach:
+			echo, _ = OriginalEcho(body.Data, conn.v6)
+		}
+		if echo == nil || echo.ID != int(t.id) || echo.Seq != int(seq) {
+			continue
+		}
+
+		switch reply.Body.(type) {
+		case *Echo:
+			hop.Reached = true
+		case *DstUnreach:
+			hop.Unreachable = int(reply.Code)
+		}
+		return rtt, addrIP(from), nil
+	}
+}
+
+// OriginalEcho extracts the echo request quoted in a time exceeded
+// or destination unreachable message. Only the identifier and the
+// sequence number are available, routers quote just 8 bytes.
+func OriginalEcho(data []byte, v6 bool) (*Echo, error) {
+	var hdrLen int
+	if v6 {
+		hdrLen = 40
+		if len(data) < hdrLen || data[6] != protocolICMPv6 {
+			return nil, errors.New("quoted datagram is not ICMPv6")
+		}
+	} else {
+		if len(data) < 20 {
+			return nil, ErrShortMessage
+		}
+		hdrLen = int(data[0]&0x0f) * 4
+		if data[0]>>4 != 4 || hdrLen < 20 {
+			return nil, errors.New("quoted datagram is not IPv4")
+		}
+		if data[9] != protocolICMP {
+			return nil, errors.New("quoted datagram is not ICMP")
+		}
+	}
+	if len(data) < hdrLen+8 {
+		return nil, ErrShortMessage
+	}
+	inner := data[hdrLen:]
+	echoType := TypeEcho
+	if v6 {
+		echoType = TypeV6Echo
+	}
+	if inner[0] != echoType {
+		return nil, errors.New("quoted message is not an echo request")
+	}
+	return &Echo{
+		ID:  int(binary.BigEndian.Uint16(inner[4:])),
+		Seq: int(binary.BigEndian.Uint16(inner[6:])),
+	}, nil
+}
@@ -0,0 +1,154 @@
+package pinger
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// quotedV4 is the start of an IPv4 datagram as routers quote it,
+// optLen bytes of options are added to the header
+func quotedV4(proto uint8, optLen int, icmpType uint8, id, seq uint16) []byte {
+	hdrLen := 20 + optLen
+	b := make([]byte, hdrLen+8)
+	b[0] = 0x40 | uint8(hdrLen/4)
+	binary.BigEndian.PutUint16(b[2:], uint16(hdrLen+64))
+	b[8] = 1 // ttl
+	b[9] = proto
+	copy(b[12:], net.IPv4(192, 0, 2, 1).To4())
+	copy(b[16:], net.IPv4(198, 51, 100, 1).To4())
+	b[hdrLen] = icmpType
+	binary.BigEndian.PutUint16(b[hdrLen+4:], id)
+	binary.BigEndian.PutUint16(b[hdrLen+6:], seq)
+	return b
+}
+
+func quotedV6(next uint8, icmpType uint8, id, seq uint16) []byte {
+	b := make([]byte, 48)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], 64)
+	b[6] = next
+	b[7] = 1 // hop limit
+	copy(b[8:], net.ParseIP("2001:db8::1"))
+	copy(b[24:], net.ParseIP("2001:db8::2"))
+	b[40] = icmpType
+	binary.BigEndian.PutUint16(b[44:], id)
+	binary.BigEndian.PutUint16(b[46:], seq)
+	return b
+}
+
+func TestOriginalEcho(t *testing.T) {
+	const id, seq = 0x1234, 0xbeef
+	tests := []struct {
+		name   string
+		data   []byte
+		v6     bool
+		wantOK bool
+	}{
+		{"v4", quotedV4(protocolICMP, 0, TypeEcho, id, seq), false, true},
+		{"v4 with options", quotedV4(protocolICMP, 8, TypeEcho, id, seq), false, true},
+		{"v4 whole datagram", append(quotedV4(protocolICMP, 0, TypeEcho, id, seq), make([]byte, 56)...), false, true},
+		{"v4 udp", quotedV4(17, 0, TypeEcho, id, seq), false, false},
+		{"v4 echo reply", quotedV4(protocolICMP, 0, TypeEchoReply, id, seq), false, false},
+		{"v4 truncated header", quotedV4(protocolICMP, 0, TypeEcho, id, seq)[:19], false, false},
+		{"v4 truncated echo", quotedV4(protocolICMP, 0, TypeEcho, id, seq)[:27], false, false},
+		{"v4 options cut off", quotedV4(protocolICMP, 8, TypeEcho, id, seq)[:30], false, false},
+		{"v6", quotedV6(protocolICMPv6, TypeV6Echo, id, seq), true, true},
+		{"v6 udp", quotedV6(17, TypeV6Echo, id, seq), true, false},
+		{"v6 echo reply", quotedV6(protocolICMPv6, TypeV6EchoReply, id, seq), true, false},
+		{"v6 v4 echo type", quotedV6(protocolICMPv6, TypeEcho, id, seq), true, false},
+		{"v6 truncated header", quotedV6(protocolICMPv6, TypeV6Echo, id, seq)[:39], true, false},
+		{"v6 truncated echo", quotedV6(protocolICMPv6, TypeV6Echo, id, seq)[:47], true, false},
+		{"v6 datagram read as v4", quotedV6(protocolICMPv6, TypeV6Echo, id, seq), false, false},
+		{"empty", nil, false, false},
+	}
+	for _, tt := range tests {
+		echo, err := OriginalEcho(tt.data, tt.v6)
+		if !tt.wantOK {
+			if err == nil {
+				t.Errorf("%s: got %+v", tt.name, echo)
+			}
+			continue
+		}
+		if err != nil || echo.ID != id || echo.Seq != seq {
+			t.Errorf("%s: got %+v, %v", tt.name, echo, err)
+		}
+	}
+}
+
+// the quoted request is found in time exceeded and destination
+// unreachable messages built by another implementation
+func TestOriginalEchoFromMessage(t *testing.T) {
+	const id, seq = 7, 42
+	src, dst := net.ParseIP("2001:db8::fe"), net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name string
+		msg  icmp.Message
+		v6   bool
+	}{
+		{"v4 time exceeded", icmp.Message{Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quotedV4(protocolICMP, 0, TypeEcho, id, seq)}}, false},
+		{"v4 port unreachable", icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3,
+			Body: &icmp.DstUnreach{Data: quotedV4(protocolICMP, 0, TypeEcho, id, seq)}}, false},
+		{"v6 time exceeded", icmp.Message{Type: ipv6.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quotedV6(protocolICMPv6, TypeV6Echo, id, seq)}}, true},
+		{"v6 address unreachable", icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 3,
+			Body: &icmp.DstUnreach{Data: quotedV6(protocolICMPv6, TypeV6Echo, id, seq)}}, true},
+	}
+	for _, tt := range tests {
+		var psh []byte
+		if tt.v6 {
+			psh = icmp.IPv6PseudoHeader(src, dst)
+		}
+		b, err := tt.msg.Marshal(psh)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var m *Message
+		if tt.v6 {
+			m, err = ParseMessageV6(b, src, dst)
+		} else {
+			m, err = ParseMessage(b)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var data []byte
+		switch body := m.Body.(type) {
+		case *TimeExceeded:
+			data = body.Data
+		case *DstUnreach:
+			data = body.Data
+		default:
+			t.Fatalf("%s: body %T", tt.name, m.Body)
+		}
+		echo, err := OriginalEcho(data, tt.v6)
+		if err != nil || echo.ID != id || echo.Seq != seq {
+			t.Errorf("%s: got %+v, %v", tt.name, echo, err)
+		}
+	}
+}
+
+func TestHopResponders(t *testing.T) {
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	h := &Hop{
+		Addr:  a,
+		RTTs:  []time.Duration{time.Millisecond, -1, 2 * time.Millisecond, 3 * time.Millisecond},
+		Addrs: []net.IP{a, nil, b, net.ParseIP("192.0.2.1")},
+	}
+	if got := h.Responders(); !reflect.DeepEqual(got, []net.IP{a, b}) {
+		t.Errorf("Responders = %v", got)
+	}
+	if h.Lost() != 1 {
+		t.Errorf("Lost = %d", h.Lost())
+	}
+	if got := (&Hop{Addrs: []net.IP{nil, nil}}).Responders(); len(got) != 0 {
+		t.Errorf("no answer: %v", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+// pingsweep pings a list of hosts or CIDR ranges concurrently, like fping
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lryong/golang-snippets/pinger"
+)
+
+// hostResult is the JSON form of a pinger.Result, RTTs in milliseconds
+type hostResult struct {
+	Host       string  `json:"host"`
+	Addr       string  `json:"addr,omitempty"`
+	Sent       int     `json:"sent"`
+	Recv       int     `json:"recv"`
+	PacketLoss float64 `json:"packet_loss"`
+	MinRTT     float64 `json:"min_rtt_ms"`
+	AvgRTT     float64 `json:"avg_rtt_ms"`
+	MaxRTT     float64 `json:"max_rtt_ms"`
+	StdDevRTT  float64 `json:"stddev_rtt_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newHostResult(r *pinger.Result) hostResult {
+	h := hostResult{Host: r.Host}
+	if r.Err != nil {
+		h.Error = r.Err.Error()
+	}
+	if s := r.Stats; s != nil {
+		h.Addr = s.Addr
+		h.Sent = s.PacketsSent
+		h.Recv = s.PacketsRecv
+		h.PacketLoss = s.PacketLoss
+		h.MinRTT = ms(s.MinRTT)
+		h.AvgRTT = ms(s.AvgRTT)
+		h.MaxRTT = ms(s.MaxRTT)
+		h.StdDevRTT = ms(s.StdDevRTT)
+	}
+	return h
+}
+
+func main() {
+	count := flag.Int("c", 3, "number of requests per host")
+	interval := flag.Duration("i", time.Second, "wait interval between requests to the same host")
+	timeout := flag.Duration("W", 2*time.Second, "time to wait for the last reply")
+	size := flag.Int("s", 56, "payload size in bytes")
+	inflight := flag.Int("n", 64, "maximum number of hosts pinged at the same time")
+	unprivileged := flag.Bool("u", false, "use unprivileged ICMP sockets")
+	asJSON := flag.Bool("json", false, "print results as JSON")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ", os.Args[0], "[options] host|cidr ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	s := pinger.NewSweeper()
+	s.Count = *count
+	s.Interval = *interval
+	s.Timeout = *timeout
+	s.Size = *size
+	s.MaxInFlight = *inflight
+	if *unprivileged {
+		s.Mode = pinger.ModeUnprivileged
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	results, err := s.Run(ctx, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	out := make([]hostResult, 0, len(results))
+	alive := 0
+	for _, r := range results {
+		h := newHostResult(r)
+		if h.Recv > 0 {
+			alive++
+		}
+		out = append(out, h)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	} else {
+		printTable(out)
+	}
+
+	// like fping, fail unless every host answered
+	if alive != len(out) {
+		os.Exit(1)
+	}
+}
+
+func printTable(results []hostResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tADDR\tSENT\tRECV\tLOSS\tMIN\tAVG\tMAX\tSTDDEV\tERROR")
+	for _, h := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t%.3f\t%.3f\t%.3f\t%.3f\t%s\n",
+			h.Host, h.Addr, h.Sent, h.Recv, h.PacketLoss,
+			h.MinRTT, h.AvgRTT, h.MaxRTT, h.StdDevRTT, h.Error)
+	}
+	tw.Flush()
+}
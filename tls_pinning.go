@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SPKIFingerprint returns the SHA-256 digest of the certificate's
+// SubjectPublicKeyInfo, which survives re-issuing with the same key
+func SPKIFingerprint(c *x509.Certificate) Hash32 {
+	return sha256.Sum256(c.RawSubjectPublicKeyInfo)
+}
+
+// ParseSPKIPin accepts a pin as hex, as base64 or in the
+// "sha256/<base64>" form printed by curl and HPKP tooling
+func ParseSPKIPin(s string) (Hash32, error) {
+	var pin Hash32
+	s = strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+	if err := (HexCodec{AllowPrefix: true}).decodeFixed(pin[:], s); err == nil {
+		return pin, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return pin, fmt.Errorf("invalid SPKI pin %q: neither hex nor base64", s)
+	}
+	if len(b) != len(pin) {
+		return pin, fmt.Errorf("invalid SPKI pin %q: want %d bytes, got %d", s, len(pin), len(b))
+	}
+	copy(pin[:], b)
+	return pin, nil
+}
+
+// PinMismatchError is returned when no certificate presented by the
+// peer matches any of the configured pins
+type PinMismatchError struct {
+	// Got holds the SPKI fingerprints of the checked certificates
+	Got []Hash32
+}
+
+func (e *PinMismatchError) Error() string {
+	got := make([]string, 0, len(e.Got))
+	for _, h := range e.Got {
+		got = append(got, "sha256/"+base64.StdEncoding.EncodeToString(h[:]))
+	}
+	return fmt.Sprintf("certificate pin mismatch, peer presented %s", strings.Join(got, ", "))
+}
+
+// spkiPinVerifier builds a tls.Config.VerifyPeerCertificate callback.
+// Several pins are accepted so keys can be rotated.
+func spkiPinVerifier(pins []Hash32) func([][]byte, [][]*x509.Certificate) error {
+	pinned := pinSet(pins)
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		// intermediates can only be trusted once the chain was verified,
+		// otherwise only the leaf is checked
+		candidates := []*x509.Certificate{}
+		for _, chain := range verifiedChains {
+			candidates = append(candidates, chain...)
+		}
+		if len(candidates) == 0 {
+			if len(rawCerts) == 0 {
+				return errors.New("no peer certificate")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, leaf)
+		}
+		return matchPins(pinned, candidates)
+	}
+}
+
+// spkiPinConnVerifier builds a tls.Config.VerifyConnection callback for
+// configs that verify the chain themselves, such as the one of
+// ReloadingTLSProvider where crypto/tls passes no verified chains.
+// verify returns the chains the peer's certificates were verified with.
+func spkiPinConnVerifier(pins []Hash32, verify func(tls.ConnectionState) ([][]*x509.Certificate, error)) func(tls.ConnectionState) error {
+	pinned := pinSet(pins)
+
+	return func(cs tls.ConnectionState) error {
+		chains, err := verify(cs)
+		if err != nil {
+			return err
+		}
+		candidates := []*x509.Certificate{}
+		for _, chain := range chains {
+			candidates = append(candidates, chain...)
+		}
+		return matchPins(pinned, candidates)
+	}
+}
+
+func pinSet(pins []Hash32) map[Hash32]bool {
+	pinned := make(map[Hash32]bool, len(pins))
+	for _, p := range pins {
+		pinned[p] = true
+	}
+	return pinned
+}
+
+func matchPins(pinned map[Hash32]bool, candidates []*x509.Certificate) error {
+	mismatch := &PinMismatchError{}
+	for _, c := range candidates {
+		fp := SPKIFingerprint(c)
+		if pinned[fp] {
+			return nil
+		}
+		mismatch.Got = append(mismatch.Got, fp)
+	}
+	return mismatch
+}
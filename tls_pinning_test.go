@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func spkiPinOf(c *testCert) string {
+	fp := SPKIFingerprint(c.cert)
+	return "sha256/" + base64.StdEncoding.EncodeToString(fp[:])
+}
+
+func TestParseSPKIPin(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	fp := SPKIFingerprint(ca.cert)
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{hex.EncodeToString(fp[:]), true},
+		{"0x" + hex.EncodeToString(fp[:]), true},
+		{base64.StdEncoding.EncodeToString(fp[:]), true},
+		{" sha256/" + base64.StdEncoding.EncodeToString(fp[:]) + "\n", true},
+		{hex.EncodeToString(fp[:31]), false},
+		{base64.StdEncoding.EncodeToString(fp[:16]), false},
+		{"sha256/not base64!", false},
+	}
+	for _, tt := range tests {
+		pin, err := ParseSPKIPin(tt.in)
+		if tt.ok != (err == nil) {
+			t.Errorf("ParseSPKIPin(%q) error %v", tt.in, err)
+			continue
+		}
+		if tt.ok && pin != fp {
+			t.Errorf("ParseSPKIPin(%q) = %s, want %s", tt.in, pin, fp)
+		}
+	}
+}
+
+func TestPinnedSPKI(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	leaf := ca.issue(t, "server")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{leaf.tlsCertificate(ca)}}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writeTestFile(t, t.TempDir(), "ca.pem", ca.certPEM())
+	other := newTestCA(t, "other ca")
+
+	tests := []struct {
+		name string
+		pins []string
+		ok   bool
+	}{
+		{"leaf key", []string{spkiPinOf(leaf)}, true},
+		{"ca key", []string{spkiPinOf(ca)}, true},
+		{"rotation", []string{spkiPinOf(other), spkiPinOf(ca)}, true},
+		{"mismatch", []string{spkiPinOf(other)}, false},
+	}
+	for _, tt := range tests {
+		c, err := NewHTTPClient(WithCAFile(caFile), WithPinnedSPKI(tt.pins...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = getBody(t, c, srv.URL)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		var mismatch *PinMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Errorf("%s: got %v, want *PinMismatchError", tt.name, err)
+			continue
+		}
+		// the verified chain is leaf then CA
+		if len(mismatch.Got) != 2 || mismatch.Got[0] != SPKIFingerprint(leaf.cert) {
+			t.Errorf("%s: mismatch reports %v", tt.name, mismatch.Got)
+		}
+	}
+}
+
+// under the reloading provider crypto/tls verifies nothing, the pins
+// must still be matched against a chain verified with its roots
+func TestPinnedSPKIWithTLSProvider(t *testing.T) {
+	pinnedCA := newTestCA(t, "pinned ca")
+	otherCA := newTestCA(t, "other ca")
+	dir := t.TempDir()
+	// both CAs are trusted, only one is pinned
+	caFile := writeTestFile(t, dir, "ca.pem", append(pinnedCA.certPEM(), otherCA.certPEM()...))
+	p, err := NewReloadingTLSProvider(caFile, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewHTTPClient(WithTLSProvider(p), WithPinnedSPKI(spkiPinOf(pinnedCA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newServer := func(cert tls.Certificate) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	good := newServer(pinnedCA.issue(t, "manager").tlsCertificate(pinnedCA))
+	if _, err := getBody(t, c, good.URL); err != nil {
+		t.Fatalf("pinned chain: %v", err)
+	}
+
+	// a server of the other CA which also sends the pinned CA's
+	// certificate, it isn't part of the verified chain
+	rogue := newServer(otherCA.issue(t, "manager").tlsCertificate(pinnedCA))
+	var mismatch *PinMismatchError
+	if _, err := getBody(t, c, rogue.URL); !errors.As(err, &mismatch) {
+		t.Fatalf("rogue chain: got %v, want *PinMismatchError", err)
+	}
+
+	// an untrusted chain fails verification before the pins
+	untrusted := newTestCA(t, "untrusted ca")
+	bad := newServer(untrusted.issue(t, "manager").tlsCertificate(untrusted))
+	if _, err := getBody(t, c, bad.URL); err == nil || errors.As(err, &mismatch) {
+		t.Fatalf("untrusted chain: got %v, want a verification error", err)
+	}
+}
+
+func TestPinVerifierUnverifiedChecksLeafOnly(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	leaf := ca.issue(t, "server")
+	pin, _ := ParseSPKIPin(spkiPinOf(ca))
+	verify := spkiPinVerifier([]Hash32{pin})
+
+	// without verified chains the CA sent by the peer proves nothing
+	err := verify([][]byte{leaf.cert.Raw, ca.cert.Raw}, nil)
+	var mismatch *PinMismatchError
+	if !errors.As(err, &mismatch) || len(mismatch.Got) != 1 {
+		t.Fatalf("got %v", err)
+	}
+	if !bytes.Contains([]byte(err.Error()), []byte(spkiPinOf(leaf))) {
+		t.Fatalf("error doesn't name the leaf pin: %v", err)
+	}
+	if err := verify(nil, nil); err == nil {
+		t.Fatal("no certificate accepted")
+	}
+}
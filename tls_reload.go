@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReloadingTLSProvider polls a CA bundle and a client certificate for
+// changes and swaps them in without rebuilding the http.Client, so the
+// manager's CA can be rotated without restarting every worker.
+type ReloadingTLSProvider struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	state   atomic.Value // *tlsState
+	lastErr atomic.Value // errorHolder
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type tlsState struct {
+	roots   *x509.CertPool
+	caCerts []*x509.Certificate
+	cert    *tls.Certificate
+	mtimes  map[string]time.Time
+}
+
+// atomic.Value can't store nil or mixed concrete types
+type errorHolder struct {
+	err error
+}
+
+// CertInfo describes a loaded certificate
+type CertInfo struct {
+	// Role is either "ca" or "client"
+	Role        string
+	Subject     string
+	Fingerprint Hash32 // SHA-256 of the DER encoding
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+// NewReloadingTLSProvider loads the files once and fails if they are
+// invalid. caFile may be empty to use the system roots, certFile and
+// keyFile may be empty when no client certificate is needed.
+func NewReloadingTLSProvider(caFile, certFile, keyFile string, interval time.Duration) (*ReloadingTLSProvider, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both client certificate and key are required")
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	p := &ReloadingTLSProvider{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	st, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	p.state.Store(st)
+	p.lastErr.Store(errorHolder{})
+	return p, nil
+}
+
+// Start polls the files in background until Stop is called
+func (p *ReloadingTLSProvider) Start() {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Reload()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling
+func (p *ReloadingTLSProvider) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// Reload reloads the files if any of their mtimes changed. On error
+// the previous certificates are kept and the error is remembered.
+func (p *ReloadingTLSProvider) Reload() error {
+	cur := p.current()
+	changed := false
+	for _, f := range p.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			p.lastErr.Store(errorHolder{err})
+			return err
+		}
+		if !fi.ModTime().Equal(cur.mtimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	st, err := p.load()
+	if err != nil {
+		p.lastErr.Store(errorHolder{err})
+		return err
+	}
+	p.state.Store(st)
+	p.lastErr.Store(errorHolder{})
+	return nil
+}
+
+// LastError returns the error of the latest failed reload,
+// nil if the latest reload succeeded
+func (p *ReloadingTLSProvider) LastError() error {
+	return p.lastErr.Load().(errorHolder).err
+}
+
+// Certificates returns the fingerprints and validity of the
+// currently loaded CA and client certificates
+func (p *ReloadingTLSProvider) Certificates() []CertInfo {
+	st := p.current()
+	infos := make([]CertInfo, 0, len(st.caCerts)+1)
+	for _, c := range st.caCerts {
+		infos = append(infos, newCertInfo("ca", c))
+	}
+	if st.cert != nil && st.cert.Leaf != nil {
+		infos = append(infos, newCertInfo("client", st.cert.Leaf))
+	}
+	return infos
+}
+
+func newCertInfo(role string, c *x509.Certificate) CertInfo {
+	return CertInfo{
+		Role:        role,
+		Subject:     c.Subject.String(),
+		Fingerprint: sha256.Sum256(c.Raw),
+		NotBefore:   c.NotBefore,
+		NotAfter:    c.NotAfter,
+	}
+}
+
+// TLSConfig returns a config which always uses the latest certificates.
+// Chain verification is done in VerifyConnection rather than by
+// crypto/tls, since RootCAs can't be swapped on a live config.
+// crypto/tls reports no server name for IP addresses, so connections
+// to those are refused, use TLSConfigFor instead.
+func (p *ReloadingTLSProvider) TLSConfig() *tls.Config {
+	return p.TLSConfigFor("")
+}
+
+// TLSConfigFor is TLSConfig for connections to host, which the server
+// certificate is checked against when the handshake has no server name
+func (p *ReloadingTLSProvider) TLSConfigFor(host string) *tls.Config {
+	return &tls.Config{
+		ServerName: host,
+		// verification is done by VerifyConnection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := p.verifyChains(cs, host)
+			return err
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := p.current().cert; cert != nil {
+				return cert, nil
+			}
+			// no certificate is sent
+			return &tls.Certificate{}, nil
+		},
+	}
+}
+
+// verifyChains verifies the peer's certificates against the current
+// roots and the server name, or host if there is none, and returns
+// the verified chains
+func (p *ReloadingTLSProvider) verifyChains(cs tls.ConnectionState, host string) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	name := cs.ServerName
+	if name == "" {
+		name = host
+	}
+	if name == "" {
+		return nil, errors.New("no server name to verify the certificate against")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         p.current().roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	return cs.PeerCertificates[0].Verify(opts)
+}
+
+func (p *ReloadingTLSProvider) current() *tlsState {
+	return p.state.Load().(*tlsState)
+}
+
+func (p *ReloadingTLSProvider) files() []string {
+	files := []string{}
+	for _, f := range []string{p.caFile, p.certFile, p.keyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (p *ReloadingTLSProvider) load() (*tlsState, error) {
+	st := &tlsState{mtimes: make(map[string]time.Time)}
+	// stat before reading, so a write racing with the load
+	// is picked up by the next poll
+	for _, f := range p.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		st.mtimes[f] = fi.ModTime()
+	}
+
+	if p.caFile != "" {
+		caCert, err := ioutil.ReadFile(p.caFile)
+		if err != nil {
+			return nil, err
+		}
+		st.caCerts, err = parseCertificates(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p.caFile, err.Error())
+		}
+		st.roots = x509.NewCertPool()
+		for _, c := range st.caCerts {
+			st.roots.AddCert(c)
+		}
+	}
+
+	if p.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		st.cert = &cert
+	}
+	return st, nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
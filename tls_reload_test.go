@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rewrite replaces the content of path and moves its mtime forward,
+// so the change is seen even within the resolution of the mtime
+func rewrite(t *testing.T, path string, data []byte) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newReloadClient makes a new connection, so a new handshake, for
+// every request
+func newReloadClient(t *testing.T, p *ReloadingTLSProvider) *http.Client {
+	t.Helper()
+	c, err := NewHTTPClient(WithTLSProvider(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Transport.(*http.Transport).DisableKeepAlives = true
+	return c
+}
+
+func fingerprints(infos []CertInfo) map[string][]Hash32 {
+	fps := map[string][]Hash32{}
+	for _, info := range infos {
+		fps[info.Role] = append(fps[info.Role], info.Fingerprint)
+	}
+	return fps
+}
+
+func TestReloadingTLSProviderRejectsUntrusted(t *testing.T) {
+	ca := newTestCA(t, "manager ca")
+	p, err := NewReloadingTLSProvider(writeTestFile(t, t.TempDir(), "ca.pem", ca.certPEM()), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newReloadClient(t, p)
+
+	good := newTestTLSServer(t, ca, http.HandlerFunc(okHandler))
+	if _, err := getBody(t, c, good.URL); err != nil {
+		t.Fatalf("trusted server: %v", err)
+	}
+
+	untrusted := newTestCA(t, "untrusted ca")
+	bad := newTestTLSServer(t, untrusted, http.HandlerFunc(okHandler))
+	if _, err := getBody(t, c, bad.URL); err == nil {
+		t.Fatal("untrusted server accepted")
+	}
+
+	// trusted, but issued for another name
+	other := signTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "other"},
+		DNSNames:    []string{"other.example.com"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{other.tlsCertificate(ca)}}
+	srv.StartTLS()
+	defer srv.Close()
+	if _, err := getBody(t, c, srv.URL); err == nil {
+		t.Fatal("certificate of another host accepted")
+	}
+
+	// crypto/tls has no server name for IPs, the bare config refuses them
+	bare := &http.Client{Transport: &http.Transport{TLSClientConfig: p.TLSConfig()}}
+	if _, err := getBody(t, bare, good.URL); err == nil || !strings.Contains(err.Error(), "no server name") {
+		t.Fatalf("IP address without a host to check: %v", err)
+	}
+	bare = &http.Client{Transport: &http.Transport{TLSClientConfig: p.TLSConfigFor("127.0.0.1")}}
+	if _, err := getBody(t, bare, good.URL); err != nil {
+		t.Fatalf("TLSConfigFor: %v", err)
+	}
+	bare = &http.Client{Transport: &http.Transport{TLSClientConfig: p.TLSConfigFor("127.0.0.1")}}
+	if _, err := getBody(t, bare, srv.URL); err == nil {
+		t.Fatal("TLSConfigFor: certificate of another host accepted")
+	}
+
+	// the leaf only, a self-signed one in the CA's name
+	fake := newTestCA(t, "manager ca").issue(t, "manager")
+	srv2 := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+	srv2.TLS = &tls.Config{Certificates: []tls.Certificate{fake.tlsCertificate()}}
+	srv2.StartTLS()
+	defer srv2.Close()
+	if _, err := getBody(t, c, srv2.URL); err == nil {
+		t.Fatal("certificate of a CA with the same name accepted")
+	}
+}
+
+func TestReloadingTLSProviderRotation(t *testing.T) {
+	oldCA, newCA := newTestCA(t, "old ca"), newTestCA(t, "new ca")
+	clientCA := newTestCA(t, "client ca")
+	oldClient, newClient := clientCA.issue(t, "worker 1"), clientCA.issue(t, "worker 2")
+
+	dir := t.TempDir()
+	caFile := writeTestFile(t, dir, "ca.pem", oldCA.certPEM())
+	certFile := writeTestFile(t, dir, "client.pem", oldClient.certPEM())
+	keyFile := writeTestFile(t, dir, "client.key", oldClient.keyPEM(t))
+	p, err := NewReloadingTLSProvider(caFile, certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newReloadClient(t, p)
+
+	// the servers require a client certificate and answer with its name
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.cert)
+	newServer := func(ca *testCert) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}))
+		srv.TLS = &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "manager").tlsCertificate(ca)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientPool,
+		}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	oldSrv, newSrv := newServer(oldCA), newServer(newCA)
+
+	want := map[string][]Hash32{
+		"ca":     {sha256.Sum256(oldCA.cert.Raw)},
+		"client": {sha256.Sum256(oldClient.cert.Raw)},
+	}
+	check := func(step string, trusted, distrusted *httptest.Server, client string) {
+		t.Helper()
+		if got, err := getBody(t, c, trusted.URL); err != nil || got != client {
+			t.Fatalf("%s: got %q, %v, want %q", step, got, err, client)
+		}
+		if _, err := getBody(t, c, distrusted.URL); err == nil {
+			t.Fatalf("%s: server of the previous CA accepted", step)
+		}
+		if got := fingerprints(p.Certificates()); !equalFingerprints(got, want) {
+			t.Fatalf("%s: certificates %v, want %v", step, got, want)
+		}
+	}
+	check("initial", oldSrv, newSrv, "worker 1")
+
+	// unchanged files are not reloaded
+	if err := p.Reload(); err != nil || p.LastError() != nil {
+		t.Fatalf("unchanged: %v, %v", err, p.LastError())
+	}
+
+	// rotate the CA, the bundle holds the new one only
+	rewrite(t, caFile, newCA.certPEM())
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	want["ca"] = []Hash32{sha256.Sum256(newCA.cert.Raw)}
+	check("new ca", newSrv, oldSrv, "worker 1")
+
+	// a broken bundle keeps the previous state
+	rewrite(t, caFile, []byte("-----BEGIN CERTIFICATE-----\nbroken\n"))
+	if err := p.Reload(); err == nil {
+		t.Fatal("broken bundle loaded")
+	}
+	if p.LastError() == nil {
+		t.Fatal("LastError not set")
+	}
+	check("broken ca", newSrv, oldSrv, "worker 1")
+
+	// as does a key not matching the certificate
+	rewrite(t, caFile, newCA.certPEM())
+	rewrite(t, certFile, newClient.certPEM())
+	if err := p.Reload(); err == nil || p.LastError() == nil {
+		t.Fatalf("mismatched key: %v, %v", err, p.LastError())
+	}
+	check("mismatched key", newSrv, oldSrv, "worker 1")
+
+	// the next good load clears the error
+	rewrite(t, keyFile, newClient.keyPEM(t))
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.LastError(); err != nil {
+		t.Fatalf("LastError %v after a good load", err)
+	}
+	want["client"] = []Hash32{sha256.Sum256(newClient.cert.Raw)}
+	check("new client certificate", newSrv, oldSrv, "worker 2")
+
+	// a missing file is reported too
+	os.Remove(keyFile)
+	if err := p.Reload(); err == nil || p.LastError() == nil {
+		t.Fatalf("missing key: %v, %v", err, p.LastError())
+	}
+	check("missing key", newSrv, oldSrv, "worker 2")
+}
+
+func TestReloadingTLSProviderCertificates(t *testing.T) {
+	ca1, ca2 := newTestCA(t, "ca 1"), newTestCA(t, "ca 2")
+	client := ca1.issue(t, "worker")
+	dir := t.TempDir()
+	p, err := NewReloadingTLSProvider(
+		writeTestFile(t, dir, "ca.pem", append(ca1.certPEM(), ca2.certPEM()...)),
+		writeTestFile(t, dir, "client.pem", client.certPEM()),
+		writeTestFile(t, dir, "client.key", client.keyPEM(t)),
+		0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := p.Certificates()
+	want := []struct {
+		role    string
+		subject string
+		cert    *testCert
+	}{
+		{"ca", "CN=ca 1", ca1},
+		{"ca", "CN=ca 2", ca2},
+		{"client", "CN=worker", client},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("got %d certificates", len(infos))
+	}
+	for i, w := range want {
+		info := infos[i]
+		if info.Role != w.role || info.Subject != w.subject ||
+			info.Fingerprint != Hash32(sha256.Sum256(w.cert.cert.Raw)) ||
+			!info.NotAfter.Equal(w.cert.cert.NotAfter) {
+			t.Errorf("%d: got %+v", i, info)
+		}
+	}
+
+	// invalid at start
+	if _, err := NewReloadingTLSProvider(writeTestFile(t, dir, "empty.pem", nil), "", "", 0); err == nil {
+		t.Fatal("empty bundle accepted")
+	}
+	if _, err := NewReloadingTLSProvider("", writeTestFile(t, dir, "only.pem", client.certPEM()), "", 0); err == nil {
+		t.Fatal("certificate without key accepted")
+	}
+}
+
+func equalFingerprints(a, b map[string][]Hash32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for role, fps := range a {
+		if len(fps) != len(b[role]) {
+			return false
+		}
+		for i := range fps {
+			if fps[i] != b[role][i] {
+				return false
+			}
+		}
+	}
+	return true
+}
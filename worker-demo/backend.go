@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// execution backends decide where a cmdJob runs: as a local
+// process group or inside a container started by a local cli
+
+const (
+	backendNative = "native"
+	backendDocker = "docker"
+	backendPodman = "podman"
+
+	// grace period between SIGTERM and SIGKILL
+	terminateTimeout = 2 * time.Second
+
+	// where containers see the mirror's log dir
+	containerLogDir = "/var/log/tunasync"
+)
+
+var errSandboxInContainer = errors.New("rlimits and privileges are not supported by the container backend, use the container options")
+
+type execBackend interface {
+	// command returns the process running cmdAndArgs
+	command(cmdAndArgs []string, workingDir string, env map[string]string) *exec.Cmd
+	// terminate stops a started job, killing it if it doesn't
+	// exit in time
+	terminate(c *cmdJob) error
+	// path returns where the command sees hostPath
+	path(hostPath string) string
+}
+
+// newExecBackend returns the backend configured for the mirror,
+// mirrorDir is mounted into containers at the same path and logDir
+// at containerLogDir
+func newExecBackend(mirror mirrorConfig, mirrorDir, logDir string) (execBackend, error) {
+	switch mirror.Backend {
+	case "", backendNative:
+		return &nativeBackend{}, nil
+	case backendDocker, backendPodman:
+		if mirror.ContainerImage == "" {
+			return nil, fmt.Errorf("mirror %s: container_image is required by the %s backend", mirror.Name, mirror.Backend)
+		}
+		if mirror.ContainerMemory < 0 {
+			return nil, errors.New("container_memory must not be negative")
+		}
+		cli := mirror.ContainerCLI
+		if cli == "" {
+			cli = mirror.Backend
+		}
+		if _, err := exec.LookPath(cli); err != nil {
+			return nil, err
+		}
+		return &containerBackend{
+			cli:       cli,
+			podman:    mirror.Backend == backendPodman,
+			name:      "mirror-job-" + mirror.Name,
+			image:     mirror.ContainerImage,
+			mirrorDir: mirrorDir,
+			logDir:    logDir,
+			volumes:   mirror.ContainerVolumes,
+			memory:    mirror.ContainerMemory,
+			options:   mirror.ContainerOptions,
+		}, nil
+	default:
+		return nil, fmt.Errorf("mirror %s: unknown backend %s", mirror.Name, mirror.Backend)
+	}
+}
+
+type nativeBackend struct{}
+
+func (b *nativeBackend) command(cmdAndArgs []string, workingDir string, env map[string]string) *exec.Cmd {
+	cmd := exec.Command(cmdAndArgs[0], cmdAndArgs[1:]...)
+	cmd.Dir = workingDir
+	cmd.Env = newEnviron(env, true)
+	// run in a process group of its own so that terminate
+	// reaches the children as well, e.g. rsync's receiver
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+func (b *nativeBackend) path(hostPath string) string {
+	return hostPath
+}
+
+func (b *nativeBackend) terminate(c *cmdJob) error {
+	// a negative pid signals the whole process group
+	pgid := -c.cmd.Process.Pid
+	err := syscall.Kill(pgid, syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.After(terminateTimeout)
+	select {
+	case <-deadline:
+		syscall.Kill(pgid, syscall.SIGKILL)
+		return errors.New("SIGTERM failed to kill the job")
+	case <-c.finished:
+	}
+
+	// the leader is gone, give the rest of the group
+	// the remaining grace period before killing it
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for groupAlive(pgid) {
+		select {
+		case <-deadline:
+			syscall.Kill(pgid, syscall.SIGKILL)
+			return errors.New("SIGTERM failed to kill the job's children")
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// groupAlive reports whether any process is left in the group,
+// pgid is negative as for kill. ESRCH means the group is gone, EPERM
+// that its id was reused by processes of another user, neither can
+// be waited for. Zombies don't count, nobody may be reaping them.
+func groupAlive(pgid int) bool {
+	if syscall.Kill(pgid, 0) != nil {
+		return false
+	}
+	return groupRunning(-pgid)
+}
+
+// containerBackend runs the job with `docker run` or `podman run`,
+// the cli stays in the foreground so its output goes to the log
+// and its exit status is the job's
+type containerBackend struct {
+	cli    string
+	podman bool
+	// prefix of the container names, each run gets a suffix so a
+	// container left over by a crashed worker can't block the next
+	name  string
+	image string
+
+	mirrorDir string
+	logDir    string
+	// extra host:container[:options] mounts
+	volumes []string
+	// in bytes, 0 means unlimited
+	memory  int64
+	options []string
+}
+
+func (b *containerBackend) command(cmdAndArgs []string, workingDir string, env map[string]string) *exec.Cmd {
+	args := []string{
+		"run", "--rm",
+		"-a", "STDOUT", "-a", "STDERR",
+		"--name", b.name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		"-w", b.path(workingDir),
+		"-v", b.mirrorDir + ":" + b.mirrorDir,
+	}
+	if b.logDir != "" {
+		args = append(args, "-v", b.logDir+":"+containerLogDir)
+	}
+	for _, v := range b.volumes {
+		args = append(args, "-v", v)
+	}
+	if b.memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(b.memory, 10))
+	}
+	if b.podman && os.Getuid() != 0 {
+		// rootless: map the worker's uid into the container so
+		// the synced files belong to it on the host
+		args = append(args, "--userns=keep-id")
+	}
+	// pass names only, the cli takes the values from its own
+	// environment so they don't show up in ps
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-e", k)
+	}
+	args = append(args, b.options...)
+	args = append(args, b.image)
+	args = append(args, cmdAndArgs...)
+
+	cmd := exec.Command(b.cli, args...)
+	cmd.Env = newEnviron(env, true)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// path maps hostPath through the mount holding it, the deepest
+// one if they nest. Paths outside the mounts are returned as they
+// are.
+func (b *containerBackend) path(hostPath string) string {
+	mounts := [][2]string{{b.mirrorDir, b.mirrorDir}}
+	if b.logDir != "" {
+		mounts = append(mounts, [2]string{b.logDir, containerLogDir})
+	}
+	for _, v := range b.volumes {
+		if parts := strings.SplitN(v, ":", 3); len(parts) >= 2 {
+			mounts = append(mounts, [2]string{parts[0], parts[1]})
+		}
+	}
+	best, mapped := -1, hostPath
+	for _, m := range mounts {
+		rel, err := filepath.Rel(m[0], hostPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if len(m[0]) > best {
+			best, mapped = len(m[0]), filepath.Join(m[1], rel)
+		}
+	}
+	return mapped
+}
+
+// containerName returns the name command gave the container of cmd
+func containerName(cmd *exec.Cmd) string {
+	for i, arg := range cmd.Args {
+		if arg == "--name" && i+1 < len(cmd.Args) {
+			return cmd.Args[i+1]
+		}
+	}
+	return ""
+}
+
+func (b *containerBackend) terminate(c *cmdJob) error {
+	name := containerName(c.cmd)
+	// stop sends SIGTERM and SIGKILL after the timeout itself
+	timeout := strconv.Itoa(int(terminateTimeout / time.Second))
+	stopErr := exec.Command(b.cli, "stop", "-t", timeout, name).Run()
+
+	select {
+	case <-c.finished:
+		return nil
+	case <-time.After(terminateTimeout):
+	}
+
+	// the container is gone or never came up but the cli hangs
+	exec.Command(b.cli, "kill", name).Run()
+	syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+	if stopErr != nil {
+		return fmt.Errorf("failed to stop container %s: %v", name, stopErr)
+	}
+	return fmt.Errorf("container %s didn't stop in time", name)
+}
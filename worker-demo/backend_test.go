@@ -0,0 +1,310 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCLI writes a docker look-alike into dir. Every call is appended
+// to dir/calls. run records its pid and environment under the
+// container name and runs the last argument with sh, the files are
+// left behind like a container of a crashed worker and a name in use
+// is refused. stop and kill terminate the run of the named container.
+func fakeCLI(t *testing.T, dir string) string {
+	t.Helper()
+	script := `#!/bin/sh
+dir=` + dir + `
+echo "$*" >> $dir/calls
+case $1 in
+run)
+	prev=
+	for arg; do
+		[ "$prev" = --name ] && name=$arg
+		prev=$arg
+		last=$arg
+	done
+	if [ -e $dir/$name.pid ]; then
+		echo "Conflict. The container name \"/$name\" is already in use." >&2
+		exit 125
+	fi
+	echo $$ > $dir/$name.pid
+	env > $dir/$name.env
+	exec sh -c "$last"
+	;;
+stop)
+	kill $(cat $dir/$4.pid)
+	;;
+kill)
+	kill -9 $(cat $dir/$2.pid)
+	;;
+esac
+`
+	path := filepath.Join(dir, "docker")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readCalls(t *testing.T, dir string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestContainerBackendCommand(t *testing.T) {
+	cli := fakeCLI(t, t.TempDir())
+	b, err := newExecBackend(mirrorConfig{
+		Name:             "debian",
+		Backend:          backendDocker,
+		ContainerCLI:     cli,
+		ContainerImage:   "rsync:latest",
+		ContainerVolumes: []string{"/etc/ssl:/etc/ssl:ro"},
+		ContainerMemory:  1 << 30,
+		ContainerOptions: []string{"--network", "host"},
+	}, "/srv/mirrors/debian", "/var/log/mirrors/debian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"RSYNC_PASSWORD": "secret", "LANG": "C"}
+	cmd := b.command([]string{"rsync", "-a"}, "/srv/mirrors/debian", env)
+
+	name := containerName(cmd)
+	if !strings.HasPrefix(name, "mirror-job-debian-") {
+		t.Fatalf("container name %q", name)
+	}
+	want := []string{
+		cli, "run", "--rm",
+		"-a", "STDOUT", "-a", "STDERR",
+		"--name", name,
+		"-w", "/srv/mirrors/debian",
+		"-v", "/srv/mirrors/debian:/srv/mirrors/debian",
+		"-v", "/var/log/mirrors/debian:/var/log/tunasync",
+		"-v", "/etc/ssl:/etc/ssl:ro",
+		"--memory", "1073741824",
+		"-e", "LANG", "-e", "RSYNC_PASSWORD",
+		"--network", "host",
+		"rsync:latest", "rsync", "-a",
+	}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Fatalf("got %q\nwant %q", cmd.Args, want)
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "secret") {
+		t.Fatal("env value on the command line")
+	}
+
+	// a new container name for every run
+	time.Sleep(time.Microsecond)
+	if next := containerName(b.command([]string{"true"}, "/", nil)); next == name {
+		t.Fatalf("container name %q reused", name)
+	}
+}
+
+func TestNewExecBackend(t *testing.T) {
+	cli := fakeCLI(t, t.TempDir())
+	tests := []struct {
+		mirror mirrorConfig
+		ok     bool
+	}{
+		{mirrorConfig{}, true},
+		{mirrorConfig{Backend: backendNative}, true},
+		{mirrorConfig{Backend: backendPodman, ContainerCLI: cli, ContainerImage: "alpine"}, true},
+		{mirrorConfig{Backend: backendDocker, ContainerCLI: cli}, false},
+		{mirrorConfig{Backend: backendDocker, ContainerCLI: cli, ContainerImage: "alpine", ContainerMemory: -1}, false},
+		{mirrorConfig{Backend: backendDocker, ContainerCLI: filepath.Join(t.TempDir(), "missing"), ContainerImage: "alpine"}, false},
+		{mirrorConfig{Backend: "lxc"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := newExecBackend(tt.mirror, "/srv", "/var/log"); tt.ok != (err == nil) {
+			t.Errorf("%+v: %v", tt.mirror, err)
+		}
+	}
+}
+
+func TestContainerBackendPath(t *testing.T) {
+	b := &containerBackend{
+		mirrorDir: "/srv/mirrors/debian",
+		logDir:    "/var/log/mirrors/debian",
+		volumes:   []string{"/etc/ssl:/etc/ssl:ro", "/srv/keys:/keys", "/srv/mirrors/debian/.cache:/cache"},
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"/srv/mirrors/debian", "/srv/mirrors/debian"},
+		{"/srv/mirrors/debian/pool", "/srv/mirrors/debian/pool"},
+		{"/var/log/mirrors/debian", "/var/log/tunasync"},
+		{"/var/log/mirrors/debian/latest.log", "/var/log/tunasync/latest.log"},
+		{"/srv/keys/debian.gpg", "/keys/debian.gpg"},
+		// the deeper mount wins
+		{"/srv/mirrors/debian/.cache/x", "/cache/x"},
+		// not mounted
+		{"/var/log/mirrors/debian-security", "/var/log/mirrors/debian-security"},
+		{"/tmp", "/tmp"},
+	}
+	for _, tt := range tests {
+		if got := b.path(tt.in); got != tt.want {
+			t.Errorf("path(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := (&nativeBackend{}).path("/var/log/mirrors/debian"); got != "/var/log/mirrors/debian" {
+		t.Errorf("native path %q", got)
+	}
+}
+
+// limits are applied by wrapping the command on the host, they'd
+// only wrap the cli of a container backend
+func TestSandboxRejectedWithContainer(t *testing.T) {
+	cli := fakeCLI(t, t.TempDir())
+	dir := t.TempDir()
+	cfg := &Config{Global: globalConfig{MirrorDir: dir, LogDir: dir}}
+	mirror := mirrorConfig{
+		Name:           "debian",
+		Provider:       provCommand,
+		Command:        "true",
+		Backend:        backendDocker,
+		ContainerCLI:   cli,
+		ContainerImage: "alpine",
+		Nice:           10,
+	}
+	if _, err := newMirrorProvider(mirror, cfg); err == nil || !strings.Contains(err.Error(), errSandboxInContainer.Error()) {
+		t.Fatalf("got %v", err)
+	}
+	mirror.Nice = 0
+	if _, err := newMirrorProvider(mirror, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newContainerJob(t *testing.T, dir, script string, env map[string]string) *cmdJob {
+	t.Helper()
+	p := newTestProvider(t, mirrorConfig{
+		Backend:        backendDocker,
+		ContainerCLI:   fakeCLI(t, dir),
+		ContainerImage: "alpine",
+	})
+	c := newCmdJob(p, []string{"sh", "-c", script}, p.WorkingDir(), env)
+	logFile, err := os.Create(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetLogFile(logFile)
+	return c
+}
+
+func TestContainerBackendRun(t *testing.T) {
+	dir := t.TempDir()
+	c := newContainerJob(t, dir, "echo synced; exit 3", map[string]string{"RSYNC_PASSWORD": "secret"})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the exit status of the cli is the job's
+	if err := c.Wait(); err == nil || err.Error() != "exit status 3" {
+		t.Fatalf("got %v", err)
+	}
+	log, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if string(log) != "synced\n" {
+		t.Fatalf("log %q", log)
+	}
+	// the cli gets the values from its environment
+	name := containerName(c.cmd)
+	env, err := ioutil.ReadFile(filepath.Join(dir, name+".env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(env), "RSYNC_PASSWORD=secret\n") {
+		t.Fatal("env value not passed to the cli")
+	}
+}
+
+func TestContainerBackendRerun(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		c := newContainerJob(t, dir, "true", nil)
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Wait(); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
+
+func TestContainerBackendTerminate(t *testing.T) {
+	dir := t.TempDir()
+	c := newContainerJob(t, dir, "sleep 100", nil)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	name := containerName(c.cmd)
+	for i := 0; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, name+".pid")); err == nil {
+			break
+		}
+		if i == 500 {
+			t.Fatal("container didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := c.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	calls := readCalls(t, dir)
+	if len(calls) != 2 || calls[1] != "stop -t 2 "+name {
+		t.Fatalf("calls %q", calls)
+	}
+}
+
+// the command provider's TUNASYNC_* paths are the ones the container
+// sees
+func TestContainerBackendProviderEnv(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProvider(t, mirrorConfig{
+		Backend:        backendDocker,
+		ContainerCLI:   fakeCLI(t, dir),
+		ContainerImage: "alpine",
+	})
+	if err := os.MkdirAll(p.LogDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	calls := readCalls(t, dir)
+	if !strings.Contains(calls[0], "-v "+p.LogDir()+":"+containerLogDir+" ") {
+		t.Fatalf("log dir not mounted: %s", calls[0])
+	}
+	envs, _ := filepath.Glob(filepath.Join(dir, "*.env"))
+	if len(envs) != 1 {
+		t.Fatalf("env dumps %q", envs)
+	}
+	env, err := ioutil.ReadFile(envs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		envWorkingDir + "=" + p.WorkingDir() + "\n",
+		envLogDir + "=" + containerLogDir + "\n",
+		envLogFile + "=" + containerLogDir + "/" + filepath.Base(p.LogFile()) + "\n",
+	} {
+		if !strings.Contains(string(env), want) {
+			t.Errorf("no %q in the env", want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the command provider runs a custom sync script, the script learns
+// about the job through these variables
+const (
+	envMirrorName = "TUNASYNC_MIRROR_NAME"
+	envWorkingDir = "TUNASYNC_WORKING_DIR"
+	envUpstream   = "TUNASYNC_UPSTREAM_URL"
+	envLogDir     = "TUNASYNC_LOG_DIR"
+	envLogFile    = "TUNASYNC_LOG_FILE"
+	envJobID      = "TUNASYNC_JOB_ID"
+
+	// longest log line matched against the patterns
+	maxLogLineSize = 1 << 20
+)
+
+type cmdProvider struct {
+	*baseProvider
+	command          []string
+	successExitCodes map[int]bool
+	failOnMatch      *regexp.Regexp
+	sizePattern      *regexp.Regexp
+}
+
+func newCmdProvider(base *baseProvider, mirror mirrorConfig) (*cmdProvider, error) {
+	command, err := splitCommand(mirror.Command)
+	if err != nil {
+		return nil, err
+	}
+	if len(command) == 0 {
+		return nil, errors.New("command is required")
+	}
+	p := &cmdProvider{
+		baseProvider:     base,
+		command:          command,
+		successExitCodes: map[int]bool{},
+	}
+	for _, code := range mirror.SuccessExitCodes {
+		if code <= 0 || code > 255 {
+			return nil, fmt.Errorf("invalid success exit code %d", code)
+		}
+		p.successExitCodes[code] = true
+	}
+	if mirror.FailOnMatch != "" {
+		if p.failOnMatch, err = regexp.Compile(mirror.FailOnMatch); err != nil {
+			return nil, fmt.Errorf("fail_on_match: %s", err.Error())
+		}
+	}
+	if mirror.SizePattern != "" {
+		if p.sizePattern, err = regexp.Compile(mirror.SizePattern); err != nil {
+			return nil, fmt.Errorf("size_pattern: %s", err.Error())
+		}
+		if p.sizePattern.NumSubexp() < 1 {
+			return nil, errors.New("size_pattern needs a group capturing the size")
+		}
+	}
+	return p, nil
+}
+
+// splitCommand splits s at spaces, quotes group words and are removed
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command %q", s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+func (p *cmdProvider) Type() string {
+	return provCommand
+}
+
+func (p *cmdProvider) Run() error {
+	p.dataSize.Store("")
+	if err := p.Start(); err != nil {
+		return err
+	}
+	log := logger.WithMirror(p.Name())
+	if err := p.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || !p.successExitCodes[exitErr.ExitCode()] {
+			return err
+		}
+		log.Debugf("exit code %d counted as success", exitErr.ExitCode())
+	}
+
+	if p.failOnMatch == nil && p.sizePattern == nil {
+		return nil
+	}
+	matches, size, err := p.scanLog()
+	if err != nil {
+		return err
+	}
+	if matches > 0 {
+		return fmt.Errorf("fail-on-match regexp found %d matches", matches)
+	}
+	if size != "" {
+		p.dataSize.Store(size)
+	}
+	return nil
+}
+
+// scanLog counts the lines matching failOnMatch and extracts the
+// size from the last line matching sizePattern
+func (p *cmdProvider) scanLog() (matches int, size string, err error) {
+	f, err := os.Open(p.LogFile())
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if p.failOnMatch != nil && p.failOnMatch.Match(line) {
+			matches++
+		}
+		if p.sizePattern != nil {
+			if m := p.sizePattern.FindSubmatch(line); m != nil {
+				size = string(m[1])
+			}
+		}
+	}
+	return matches, size, scanner.Err()
+}
+
+func (p *cmdProvider) Start() error {
+	p.Lock()
+	defer p.Unlock()
+
+	// the paths as the command sees them, a container has the
+	// dirs mounted elsewhere
+	backend := p.Backend()
+	env := map[string]string{
+		envMirrorName: p.Name(),
+		envWorkingDir: backend.path(p.WorkingDir()),
+		envUpstream:   p.upstream,
+		envLogDir:     backend.path(p.LogDir()),
+		envLogFile:    backend.path(p.LogFile()),
+		// unique per attempt
+		envJobID: p.Name() + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+	return p.startCmd(p, p.command, env)
+}
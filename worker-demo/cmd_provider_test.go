@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  \t\n", nil},
+		{"/usr/bin/sync.sh", []string{"/usr/bin/sync.sh"}},
+		{" sync.sh  -v\t--all\n", []string{"sync.sh", "-v", "--all"}},
+		{`sync.sh "two words" 'single quoted'`, []string{"sync.sh", "two words", "single quoted"}},
+		{`sh -c 'echo "$HOME"'`, []string{"sh", "-c", `echo "$HOME"`}},
+		{`echo "it's"`, []string{"echo", "it's"}},
+		{`--exclude="a b"/c`, []string{"--exclude=a b/c"}},
+		{`a "" ''`, []string{"a", "", ""}},
+		{`a"b c"d`, []string{"ab cd"}},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.in)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{`echo "unterminated`, `echo 'it"s`} {
+		if got, err := splitCommand(in); err == nil {
+			t.Errorf("splitCommand(%q) = %q", in, got)
+		}
+	}
+}
+
+func TestNewCmdProvider(t *testing.T) {
+	base := newBaseProvider(mirrorConfig{Name: "mirror"}, t.TempDir(), t.TempDir(), &nativeBackend{}, nil)
+	tests := []struct {
+		name   string
+		mirror mirrorConfig
+		ok     bool
+	}{
+		{"plain", mirrorConfig{Command: "sync.sh"}, true},
+		{"all options", mirrorConfig{Command: "sync.sh", SuccessExitCodes: []int{1, 255},
+			FailOnMatch: "^ERROR", SizePattern: `size: (\S+)`}, true},
+		{"no command", mirrorConfig{Command: "  "}, false},
+		{"unterminated quote", mirrorConfig{Command: `sync.sh "a`}, false},
+		{"exit code 0", mirrorConfig{Command: "sync.sh", SuccessExitCodes: []int{0}}, false},
+		{"exit code 256", mirrorConfig{Command: "sync.sh", SuccessExitCodes: []int{256}}, false},
+		{"invalid fail_on_match", mirrorConfig{Command: "sync.sh", FailOnMatch: "("}, false},
+		{"invalid size_pattern", mirrorConfig{Command: "sync.sh", SizePattern: "("}, false},
+		{"size_pattern without group", mirrorConfig{Command: "sync.sh", SizePattern: `size: \S+`}, false},
+	}
+	for _, tt := range tests {
+		if _, err := newCmdProvider(base, tt.mirror); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestCmdProviderRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		mirror mirrorConfig
+		err    string
+		size   string
+	}{
+		{"success", "echo synced", mirrorConfig{}, "", ""},
+		{"failure", "exit 3", mirrorConfig{}, "exit status 3", ""},
+		{"success exit code", "exit 3", mirrorConfig{SuccessExitCodes: []int{3}}, "", ""},
+		{"other exit code", "exit 4", mirrorConfig{SuccessExitCodes: []int{3}}, "exit status 4", ""},
+		{"killed", "kill -9 $$", mirrorConfig{SuccessExitCodes: []int{9, 137}}, "killed", ""},
+		{"fail on match", "echo ok; echo 'ERROR: mirror broken'; echo ERROR again",
+			mirrorConfig{FailOnMatch: "^ERROR"}, "found 2 matches", ""},
+		{"fail on match with success exit code", "echo ERROR; exit 3",
+			mirrorConfig{FailOnMatch: "^ERROR", SuccessExitCodes: []int{3}}, "found 1 matches", ""},
+		{"no match", "echo 'no ERROR here'", mirrorConfig{FailOnMatch: "^ERROR"}, "", ""},
+		{"size", "echo 'Total size: 1.5G'; echo done; echo 'Total size: 2.1G'",
+			mirrorConfig{SizePattern: `^Total size: (\S+)`}, "", "2.1G"},
+		{"size on a long line", "printf 'Total size: 3T'; head -c 100000 /dev/zero | tr '\\0' ' '; echo",
+			mirrorConfig{SizePattern: `^Total size: (\S+)`}, "", "3T"},
+		{"no size", "echo synced", mirrorConfig{SizePattern: `^Total size: (\S+)`}, "", ""},
+		{"size of a failed run", "echo 'Total size: 2.1G'; exit 1",
+			mirrorConfig{SizePattern: `^Total size: (\S+)`}, "exit status 1", ""},
+		{"size and match", "echo 'Total size: 2.1G'; echo ERROR",
+			mirrorConfig{SizePattern: `^Total size: (\S+)`, FailOnMatch: "^ERROR"}, "found 1 matches", ""},
+	}
+	for _, tt := range tests {
+		mirror := tt.mirror
+		mirror.Provider = provCommand
+		mirror.Command = "sh -c '" + strings.ReplaceAll(tt.script, "'", `'"'"'`) + "'"
+		p := newTestProvider(t, mirror)
+		if err := os.MkdirAll(p.LogDir(), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := p.Run()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+		if p.DataSize() != tt.size {
+			t.Errorf("%s: size %q, want %q", tt.name, p.DataSize(), tt.size)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+// Config represents worker config options
+type Config struct {
+	Global  globalConfig   `toml:"global"`
+	Manager managerConfig  `toml:"manager"`
+	Server  serverConfig   `toml:"server"`
+	Mirrors []mirrorConfig `toml:"mirrors"`
+}
+
+type globalConfig struct {
+	Name       string `toml:"name"`
+	LogDir     string `toml:"log_dir"`
+	MirrorDir  string `toml:"mirror_dir"`
+	Concurrent int    `toml:"concurrent"`
+	Interval   int    `toml:"interval"`
+	Retry      int    `toml:"retry"`
+	// log output: "text" or "json"
+	LogFormat string `toml:"log_format"`
+	LogLevel  string `toml:"log_level"`
+}
+
+type managerConfig struct {
+	APIBase string `toml:"api_base"`
+	// this option overrides the APIBase
+	APIList []string `toml:"api_base_list"`
+	CACert  string   `toml:"ca_cert"`
+	// client certificate for mutual TLS
+	ClientCert string `toml:"client_cert"`
+	ClientKey  string `toml:"client_key"`
+	// how often the certificate files are checked for changes,
+	// in seconds, default 60
+	TLSReloadInterval int `toml:"tls_reload_interval"`
+}
+
+// APIBaseList returns the manager urls to report to
+func (mc managerConfig) APIBaseList() []string {
+	if len(mc.APIList) > 0 {
+		return mc.APIList
+	}
+	return []string{mc.APIBase}
+}
+
+type serverConfig struct {
+	Hostname string `toml:"hostname"`
+	Addr     string `toml:"listen_addr"`
+	Port     int    `toml:"listen_port"`
+	SSLCert  string `toml:"ssl_cert"`
+	SSLKey   string `toml:"ssl_key"`
+}
+
+type mirrorConfig struct {
+	Name string `toml:"name"`
+	// "rsync", "two-stage-rsync", "command", "http" or "git"
+	Provider  string            `toml:"provider"`
+	Upstream  string            `toml:"upstream"`
+	Interval  int               `toml:"interval"`
+	Retry     int               `toml:"retry"`
+	MirrorDir string            `toml:"mirror_dir"`
+	LogDir    string            `toml:"log_dir"`
+	Env       map[string]string `toml:"env"`
+	// overrides the global log level for this mirror
+	LogLevel string `toml:"log_level"`
+
+	// health check before each job: "", "icmp", "tcp" or "http"
+	HealthCheck string `toml:"health_check"`
+	// host, host:port or url to probe, derived from Upstream if empty
+	HealthCheckTarget string `toml:"health_check_target"`
+	// in seconds
+	HealthCheckTimeout int `toml:"health_check_timeout"`
+
+	// log retention, a zero value disables the limit,
+	// except LogRetainCount which defaults to 10
+	LogRetainCount int `toml:"log_retain_count"`
+	// in days
+	LogMaxAge int `toml:"log_max_age"`
+	// total size of the mirror's logs in bytes
+	LogMaxTotalBytes int64 `toml:"log_max_total_bytes"`
+	// compress finished logs: "", "gzip" or "zstd"
+	LogCompression string `toml:"log_compression"`
+
+	// resource limits of the sync command, zero means unlimited.
+	// in seconds of cpu time
+	RLimitCPU int `toml:"rlimit_cpu"`
+	// address space in bytes
+	RLimitAS int64 `toml:"rlimit_as"`
+	// max open files
+	RLimitNOFILE int `toml:"rlimit_nofile"`
+	// scheduling priority, -20 to 19
+	Nice int `toml:"nice"`
+	// io priority: "", "realtime", "best-effort" or "idle"
+	IONiceClass string `toml:"ionice_class"`
+	// 0 to 7, for realtime and best-effort
+	IONiceLevel int `toml:"ionice_level"`
+	// run the command as this user and group, name or id
+	RunAsUser  string `toml:"run_as_user"`
+	RunAsGroup string `toml:"run_as_group"`
+	// linux only, require root
+	PrivateMount   bool `toml:"private_mount"`
+	PrivateNetwork bool `toml:"private_network"`
+
+	// where the command runs: "native", "docker" or "podman"
+	Backend string `toml:"backend"`
+	// path of the docker or podman binary, found in PATH by default
+	ContainerCLI     string   `toml:"container_cli"`
+	ContainerImage   string   `toml:"container_image"`
+	ContainerVolumes []string `toml:"container_volumes"`
+	// in bytes
+	ContainerMemory  int64    `toml:"container_memory"`
+	ContainerOptions []string `toml:"container_options"`
+
+	// rsync provider
+	RsyncCmd     string   `toml:"rsync_cmd"`
+	RsyncOptions []string `toml:"rsync_options"`
+	Username     string   `toml:"username"`
+	Password     string   `toml:"password"`
+	Exclude      []string `toml:"exclude"`
+	ExcludeFile  string   `toml:"exclude_file"`
+	// in KiB/s
+	BandwidthLimit int `toml:"bwlimit"`
+	// i/o timeout in seconds, defaults to 120
+	RsyncTimeout int  `toml:"rsync_timeout"`
+	UseIPv4      bool `toml:"use_ipv4"`
+	UseIPv6      bool `toml:"use_ipv6"`
+	// when to delete extraneous files: "after" (default),
+	// "delay", "during" or "none"
+	DeleteMode string `toml:"delete_mode"`
+	// two-stage-rsync: what the first stage leaves out, a profile
+	// of "debian", "ubuntu" or "custom" with the patterns given by
+	// stage1_exclude
+	Stage1Profile string   `toml:"stage1_profile"`
+	Stage1Exclude []string `toml:"stage1_exclude"`
+
+	// command provider, arguments are split at spaces, single and
+	// double quotes group them
+	Command string `toml:"command"`
+	// exit codes besides 0 counted as success
+	SuccessExitCodes []int `toml:"success_exit_codes"`
+	// fail the job if a line of the log matches
+	FailOnMatch string `toml:"fail_on_match"`
+	// the first group of the last matching line is the mirror size
+	SizePattern string `toml:"size_pattern"`
+
+	// http provider: the files are found by crawling the directory
+	// listings below upstream, or read from a manifest listing one
+	// path relative to upstream per line
+	HTTPManifest string `toml:"http_manifest"`
+	// parallel downloads, defaults to 4
+	HTTPParallel int `toml:"http_parallel"`
+	// i/o timeout in seconds, defaults to 120
+	HTTPTimeout int `toml:"http_timeout"`
+
+	// git provider
+	GitCmd string `toml:"git_cmd"`
+	// fetch the lfs objects of all refs as well
+	GitLFS bool `toml:"git_lfs"`
+	// days between two gc runs, defaults to 7, negative disables gc
+	GitGCInterval int `toml:"git_gc_interval"`
+}
@@ -0,0 +1,47 @@
+package main
+
+// Context stores the runtime configuration of a provider in layers,
+// values set after Enter are dropped again by Exit
+type Context struct {
+	parent *Context
+	store  map[string]interface{}
+}
+
+// NewContext returns a new empty context
+func NewContext() *Context {
+	return &Context{
+		parent: nil,
+		store:  make(map[string]interface{}),
+	}
+}
+
+// Enter generates a new layer of context
+func (ctx *Context) Enter() *Context {
+	return &Context{
+		parent: ctx,
+		store:  make(map[string]interface{}),
+	}
+}
+
+// Exit returns the upper layer of context
+func (ctx *Context) Exit() *Context {
+	if ctx.parent == nil {
+		return ctx
+	}
+	return ctx.parent
+}
+
+// Get returns the value of key from the nearest layer having it
+func (ctx *Context) Get(key string) (value interface{}, ok bool) {
+	for c := ctx; c != nil; c = c.parent {
+		if value, ok = c.store[key]; ok {
+			return
+		}
+	}
+	return nil, false
+}
+
+// Set sets the value of key in the current layer
+func (ctx *Context) Set(key string, value interface{}) {
+	ctx.store[key] = value
+}
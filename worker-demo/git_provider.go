@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the git provider keeps a bare mirror clone of the upstream
+// repository, updated with fetch --prune
+
+const (
+	defaultGitGCInterval = 7
+	// touched after each gc, its mtime tells when gc is due
+	gitGCStamp = "worker-last-gc"
+)
+
+type gitProvider struct {
+	*baseProvider
+	gitCmd     string
+	lfs        bool
+	gcInterval time.Duration
+
+	terminated bool
+}
+
+func newGitProvider(base *baseProvider, mirror mirrorConfig) (*gitProvider, error) {
+	if mirror.Upstream == "" {
+		return nil, errors.New("upstream is required")
+	}
+	p := &gitProvider{
+		baseProvider: base,
+		gitCmd:       mirror.GitCmd,
+		lfs:          mirror.GitLFS,
+	}
+	if p.gitCmd == "" {
+		p.gitCmd = "git"
+	}
+	switch days := mirror.GitGCInterval; {
+	case days == 0:
+		p.gcInterval = defaultGitGCInterval * 24 * time.Hour
+	case days > 0:
+		p.gcInterval = time.Duration(days) * 24 * time.Hour
+	}
+	return p, nil
+}
+
+func (p *gitProvider) Type() string {
+	return provGit
+}
+
+// isCloned tells a bare repository by its HEAD and objects
+func (p *gitProvider) isCloned() bool {
+	dir := p.WorkingDir()
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && fi.IsDir()
+}
+
+// gcDue reports whether the last gc is older than the interval
+func (p *gitProvider) gcDue() bool {
+	if p.gcInterval == 0 {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(p.WorkingDir(), gitGCStamp))
+	return err != nil || time.Since(fi.ModTime()) >= p.gcInterval
+}
+
+func (p *gitProvider) Run() error {
+	p.dataSize.Store("")
+	p.Lock()
+	p.terminated = false
+	p.Unlock()
+
+	// clone or fetch
+	if err := p.Start(); err != nil {
+		return err
+	}
+	if err := p.Wait(); err != nil {
+		return err
+	}
+
+	if p.lfs {
+		if err := p.runStep("lfs", "lfs", "fetch", "--all", "origin"); err != nil {
+			return err
+		}
+	}
+	if p.gcDue() {
+		// with the default prune expiry, readers of the served
+		// mirror may still use the unreachable objects
+		if err := p.runStep("gc", "gc"); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(p.WorkingDir(), gitGCStamp), nil, 0644); err != nil {
+			logger.WithMirror(p.Name()).WithError(err).Warning("failed to record gc")
+		}
+	}
+
+	size, err := dirSize(p.WorkingDir())
+	if err != nil {
+		logger.WithMirror(p.Name()).WithError(err).Warning("failed to get repository size")
+		return nil
+	}
+	p.dataSize.Store(formatSize(size))
+	return nil
+}
+
+// Start clones the upstream on the first run and fetches it later
+func (p *gitProvider) Start() error {
+	if !p.isCloned() {
+		// an interrupted clone leaves files git refuses to clone into
+		if err := cleanPartialClone(p.WorkingDir()); err != nil {
+			return err
+		}
+		// clone into the working dir, created empty by cmdJob
+		return p.startStep("clone", "--mirror", p.upstream, ".")
+	}
+	// follow upstream changes of the config
+	if err := p.runStep("set-url", "remote", "set-url", "origin", p.upstream); err != nil {
+		return err
+	}
+	return p.startStep("fetch", "--prune", "origin")
+}
+
+// bareRepoEntries are the files git creates in a bare repository
+var bareRepoEntries = map[string]bool{
+	"HEAD": true, "FETCH_HEAD": true, "config": true, "description": true,
+	"branches": true, "hooks": true, "info": true, "lfs": true, "logs": true,
+	"objects": true, "packed-refs": true, "refs": true, "shallow": true,
+}
+
+// cleanPartialClone empties dir if it only holds what git creates,
+// anything else is left alone and reported, so a misconfigured
+// working dir is never wiped
+func cleanPartialClone(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if !bareRepoEntries[e.Name()] {
+			return fmt.Errorf("working dir %s is neither empty nor a git repository", dir)
+		}
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startStep starts git with args, refused once terminated
+func (p *gitProvider) startStep(args ...string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.terminated {
+		return errors.New("terminated")
+	}
+	command := append([]string{p.gitCmd}, args...)
+	env := map[string]string{
+		// fail instead of waiting for credentials
+		"GIT_TERMINAL_PROMPT": "0",
+	}
+	return p.startCmd(p, command, env)
+}
+
+// runStep runs a git command to completion
+func (p *gitProvider) runStep(name string, args ...string) error {
+	logger.WithMirror(p.Name()).WithFields(logFields{"step": name}).Debug("git step started")
+	if err := p.startStep(args...); err != nil {
+		return fmt.Errorf("git %s: %w", name, err)
+	}
+	if err := p.Wait(); err != nil {
+		return fmt.Errorf("git %s: %w", name, err)
+	}
+	return nil
+}
+
+// Terminate stops the running step and keeps the next one from
+// starting
+func (p *gitProvider) Terminate() error {
+	p.Lock()
+	p.terminated = true
+	p.Unlock()
+	return p.baseProvider.Terminate()
+}
+
+// dirSize sums the sizes of the regular files below dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// git runs git in dir and returns its trimmed output
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newGitUpstream creates a repository with a commit on master, a
+// topic branch and a tag
+func newGitUpstream(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	git(t, dir, "init", "-q", "-b", "master")
+	writeTestFile(t, filepath.Join(dir, "README"), "hello\n")
+	git(t, dir, "add", "README")
+	git(t, dir, "commit", "-q", "-m", "initial")
+	git(t, dir, "branch", "topic")
+	git(t, dir, "tag", "v1")
+	return dir
+}
+
+func newTestGitProvider(t *testing.T, upstream string, mirror mirrorConfig) *gitProvider {
+	t.Helper()
+	mirror.Provider = provGit
+	mirror.Upstream = "file://" + upstream
+	p := newTestProvider(t, mirror).(*gitProvider)
+	if err := os.MkdirAll(p.LogDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGitProviderMirror(t *testing.T) {
+	up := newGitUpstream(t)
+	p := newTestGitProvider(t, up, mirrorConfig{})
+
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.isCloned() {
+		t.Fatal("no bare clone")
+	}
+	refs := "for-each-ref --format=%(refname) %(objectname)"
+	if got, want := git(t, p.WorkingDir(), strings.Fields(refs)...), git(t, up, strings.Fields(refs)...); got != want {
+		t.Fatalf("refs:\n%s\nwant\n%s", got, want)
+	}
+	if p.DataSize() == "" {
+		t.Fatal("no data size")
+	}
+
+	// new commits, a deleted branch and a moved tag upstream
+	writeTestFile(t, filepath.Join(up, "README"), "hello again\n")
+	git(t, up, "commit", "-q", "-a", "-m", "second")
+	git(t, up, "branch", "-D", "topic")
+	git(t, up, "tag", "-f", "v1")
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := git(t, p.WorkingDir(), strings.Fields(refs)...), git(t, up, strings.Fields(refs)...); got != want {
+		t.Fatalf("refs after fetch:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGitProviderGC(t *testing.T) {
+	up := newGitUpstream(t)
+	p := newTestGitProvider(t, up, mirrorConfig{})
+	stamp := func() time.Time {
+		fi, err := os.Stat(filepath.Join(p.WorkingDir(), gitGCStamp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.ModTime()
+	}
+
+	// due on the first run
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(p.WorkingDir(), "objects", "info", "packs")); err != nil {
+		t.Fatalf("not packed by gc: %v", err)
+	}
+	last := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(p.WorkingDir(), gitGCStamp), last, last); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !stamp().Equal(last) {
+		t.Fatal("gc ran before the interval")
+	}
+
+	// a recent unreachable object, e.g. of a push being served,
+	// outlives gc
+	cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+	cmd.Dir = p.WorkingDir()
+	cmd.Stdin = strings.NewReader("unreachable\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last = time.Now().Add(-8 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(p.WorkingDir(), gitGCStamp), last, last); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !stamp().After(last) {
+		t.Fatal("gc not run after the interval")
+	}
+	git(t, p.WorkingDir(), "cat-file", "-e", strings.TrimSpace(string(out)))
+
+	off := newTestGitProvider(t, up, mirrorConfig{GitGCInterval: -1})
+	if err := off.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(off.WorkingDir(), gitGCStamp)); !os.IsNotExist(err) {
+		t.Fatalf("gc ran while disabled: %v", err)
+	}
+}
+
+func TestGitProviderUnreachable(t *testing.T) {
+	up := newGitUpstream(t)
+	p := newTestGitProvider(t, filepath.Join(up, "missing"), mirrorConfig{})
+	if err := p.Run(); err == nil {
+		t.Fatal("cloned a missing repository")
+	}
+	if p.isCloned() {
+		t.Fatal("failed clone left a repository")
+	}
+}
+
+// a clone killed before HEAD or the objects were written is redone
+func TestGitProviderInterruptedClone(t *testing.T) {
+	up := newGitUpstream(t)
+	partials := [][]string{
+		{"config", "description", "hooks/", "refs/heads/"},
+		{"HEAD", "config", "refs/tags/"},
+		{"config", "objects/pack/", "packed-refs"},
+	}
+	for _, partial := range partials {
+		p := newTestGitProvider(t, up, mirrorConfig{})
+		for _, name := range partial {
+			path := filepath.Join(p.WorkingDir(), name)
+			if strings.HasSuffix(name, "/") {
+				os.MkdirAll(path, 0755)
+			} else {
+				os.MkdirAll(filepath.Dir(path), 0755)
+				writeTestFile(t, path, "partial\n")
+			}
+		}
+		if p.isCloned() {
+			t.Fatalf("%v: taken for a clone", partial)
+		}
+		if err := p.Run(); err != nil {
+			t.Fatalf("%v: %v", partial, err)
+		}
+		if !p.isCloned() || git(t, p.WorkingDir(), "rev-parse", "v1") != git(t, up, "rev-parse", "v1") {
+			t.Fatalf("%v: not cloned", partial)
+		}
+	}
+
+	// anything git doesn't create is kept and the run fails
+	p := newTestGitProvider(t, up, mirrorConfig{})
+	os.MkdirAll(p.WorkingDir(), 0755)
+	data := filepath.Join(p.WorkingDir(), "debian.iso")
+	writeTestFile(t, data, "data\n")
+	writeTestFile(t, filepath.Join(p.WorkingDir(), "config"), "partial\n")
+	if err := p.Run(); err == nil || !strings.Contains(err.Error(), "neither empty nor a git repository") {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := os.Stat(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitProviderLFS(t *testing.T) {
+	up := newGitUpstream(t)
+	if err := exec.Command("git", "lfs", "version").Run(); err != nil {
+		t.Skip("git-lfs not installed")
+	}
+	p := newTestGitProvider(t, up, mirrorConfig{GitLFS: true})
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
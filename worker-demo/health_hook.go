@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lryong/golang-snippets/pinger"
+)
+
+// probe the upstream before a job, so a dead upstream fails fast
+// instead of after a full sync attempt
+
+const (
+	healthCheckICMP = "icmp"
+	healthCheckTCP  = "tcp"
+	healthCheckHTTP = "http"
+
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+// default ports of the upstream schemes, used by tcp checks
+var schemePorts = map[string]string{
+	"rsync": "873",
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+	"git":   "9418",
+	"ssh":   "22",
+}
+
+// errUpstreamUnreachable is returned by preJob, the job is marked
+// failed but still rescheduled
+type errUpstreamUnreachable struct {
+	upstream string
+	method   string
+	err      error
+}
+
+func (e *errUpstreamUnreachable) Error() string {
+	return fmt.Sprintf("upstream %s unreachable (%s check): %s", e.upstream, e.method, e.err.Error())
+}
+
+func (e *errUpstreamUnreachable) Unwrap() error {
+	return e.err
+}
+
+type healthChecker struct {
+	emptyHook
+	provider mirrorProvider
+	method   string
+	target   string
+	timeout  time.Duration
+
+	sync.Mutex
+	latency time.Duration
+}
+
+// newHealthChecker returns nil if the mirror has no health check
+func newHealthChecker(provider mirrorProvider, mirror mirrorConfig) (*healthChecker, error) {
+	if mirror.HealthCheck == "" {
+		return nil, nil
+	}
+	h := &healthChecker{
+		provider: provider,
+		method:   mirror.HealthCheck,
+		timeout:  defaultHealthCheckTimeout,
+	}
+	if mirror.HealthCheckTimeout > 0 {
+		h.timeout = time.Duration(mirror.HealthCheckTimeout) * time.Second
+	}
+
+	target := mirror.HealthCheckTarget
+	if target == "" {
+		target = mirror.Upstream
+	}
+	var err error
+	switch h.method {
+	case healthCheckICMP:
+		h.target, err = upstreamHost(target)
+	case healthCheckTCP:
+		h.target, err = upstreamHostPort(target)
+	case healthCheckHTTP:
+		h.target, err = upstreamURL(target)
+	default:
+		err = fmt.Errorf("unknown health check %q", h.method)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mirror %s: %s", mirror.Name, err.Error())
+	}
+	return h, nil
+}
+
+// Latency returns the latency measured by the latest successful check
+func (h *healthChecker) Latency() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return h.latency
+}
+
+func (h *healthChecker) preJob() error {
+	log := logger.WithMirror(h.provider.Name())
+	log.Debugf("checking upstream: %s %s", h.method, h.target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var latency time.Duration
+	var err error
+	switch h.method {
+	case healthCheckICMP:
+		latency, err = h.checkICMP(ctx)
+	case healthCheckTCP:
+		latency, err = h.checkTCP(ctx)
+	case healthCheckHTTP:
+		latency, err = h.checkHTTP(ctx)
+	}
+	if err != nil {
+		return &errUpstreamUnreachable{h.provider.Upstream(), h.method, err}
+	}
+
+	h.Lock()
+	h.latency = latency
+	h.Unlock()
+	log.WithFields(logFields{"duration": latency}).Info("upstream is reachable")
+	return nil
+}
+
+func (h *healthChecker) checkICMP(ctx context.Context) (time.Duration, error) {
+	p, err := pinger.New(h.target)
+	if err != nil {
+		return 0, err
+	}
+	p.Count = 3
+	p.Interval = 200 * time.Millisecond
+	p.Timeout = h.timeout
+	stats, err := p.Run(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if stats.PacketsRecv == 0 {
+		return 0, errors.New("no echo reply")
+	}
+	return stats.AvgRTT, nil
+}
+
+func (h *healthChecker) checkTCP(ctx context.Context) (time.Duration, error) {
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", h.target)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	conn.Close()
+	return latency, nil
+}
+
+func (h *healthChecker) checkHTTP(ctx context.Context) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.target, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	resp.Body.Close()
+	// any answer below 500 proves the server is up,
+	// some refuse HEAD or list directories only with auth
+	if resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return latency, nil
+}
+
+// parseUpstream splits the upstream forms of the providers: urls,
+// rsync daemon host::module, scp-like [user@]host:path, host:port
+// and bare hosts. scheme is guessed for the forms without one.
+func parseUpstream(upstream string) (scheme, host, port string, err error) {
+	if upstream == "" {
+		return "", "", "", errors.New("no upstream to check")
+	}
+	if strings.Contains(upstream, "://") {
+		u, err := url.Parse(upstream)
+		if err != nil || u.Hostname() == "" {
+			return "", "", "", fmt.Errorf("can't find host in %q", upstream)
+		}
+		return u.Scheme, u.Hostname(), u.Port(), nil
+	}
+	if net.ParseIP(upstream) != nil {
+		return "", upstream, "", nil
+	}
+
+	rest := upstream
+	if i := strings.Index(rest, "@"); i >= 0 && !strings.ContainsAny(rest[:i], ":/") {
+		rest = rest[i+1:]
+	}
+	var after string
+	if strings.HasPrefix(rest, "[") {
+		i := strings.Index(rest, "]")
+		if i < 0 {
+			return "", "", "", fmt.Errorf("can't find host in %q", upstream)
+		}
+		host, after = rest[1:i], rest[i+1:]
+	} else if i := strings.IndexAny(rest, ":/"); i >= 0 {
+		host, after = rest[:i], rest[i:]
+	} else {
+		host = rest
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("can't find host in %q", upstream)
+	}
+
+	switch {
+	case strings.HasPrefix(after, "::"):
+		return "rsync", host, "", nil
+	case strings.HasPrefix(after, ":"):
+		if _, err := strconv.ParseUint(after[1:], 10, 16); err == nil {
+			return "", host, after[1:], nil
+		}
+		return "ssh", host, "", nil
+	}
+	return "", host, "", nil
+}
+
+// upstreamHost extracts the host of any form of upstream
+func upstreamHost(upstream string) (string, error) {
+	_, host, _, err := parseUpstream(upstream)
+	return host, err
+}
+
+// upstreamHostPort extracts host:port, using the default port
+// of the scheme if missing
+func upstreamHostPort(upstream string) (string, error) {
+	scheme, host, port, err := parseUpstream(upstream)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		var ok bool
+		if port, ok = schemePorts[scheme]; !ok {
+			return "", fmt.Errorf("no port in %q", upstream)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func upstreamURL(upstream string) (string, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("http health check needs an http(s) target, got %q", upstream)
+	}
+	return upstream, nil
+}
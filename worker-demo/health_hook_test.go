@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHost(t *testing.T) {
+	tests := []struct {
+		upstream string
+		host     string
+		hostPort string
+	}{
+		{"rsync://mirrors.example.com/debian/", "mirrors.example.com", "mirrors.example.com:873"},
+		{"rsync://user@mirrors.example.com:8873/debian/", "mirrors.example.com", "mirrors.example.com:8873"},
+		{"https://mirrors.example.com/debian/", "mirrors.example.com", "mirrors.example.com:443"},
+		{"http://[2001:db8::1]:8080/debian/", "2001:db8::1", "[2001:db8::1]:8080"},
+		{"git://git.example.com/repo.git", "git.example.com", "git.example.com:9418"},
+		// rsync daemon
+		{"mirrors.example.com::debian/", "mirrors.example.com", "mirrors.example.com:873"},
+		{"user@mirrors.example.com::debian", "mirrors.example.com", "mirrors.example.com:873"},
+		{"[2001:db8::1]::debian/", "2001:db8::1", "[2001:db8::1]:873"},
+		// scp-like, over ssh
+		{"git@git.example.com:org/repo.git", "git.example.com", "git.example.com:22"},
+		{"mirror@mirrors.example.com:/srv/debian/", "mirrors.example.com", "mirrors.example.com:22"},
+		// host:port and bare hosts
+		{"mirrors.example.com:873", "mirrors.example.com", "mirrors.example.com:873"},
+		{"[2001:db8::1]:873", "2001:db8::1", "[2001:db8::1]:873"},
+		{"mirrors.example.com", "mirrors.example.com", ""},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"192.0.2.1", "192.0.2.1", ""},
+	}
+	for _, tt := range tests {
+		host, err := upstreamHost(tt.upstream)
+		if err != nil || host != tt.host {
+			t.Errorf("upstreamHost(%q) = %q, %v, want %q", tt.upstream, host, err, tt.host)
+		}
+		hostPort, err := upstreamHostPort(tt.upstream)
+		if tt.hostPort == "" {
+			if err == nil {
+				t.Errorf("upstreamHostPort(%q) = %q, want an error", tt.upstream, hostPort)
+			}
+		} else if err != nil || hostPort != tt.hostPort {
+			t.Errorf("upstreamHostPort(%q) = %q, %v, want %q", tt.upstream, hostPort, err, tt.hostPort)
+		}
+	}
+
+	for _, upstream := range []string{"", "::debian", "file:///srv/debian", "[2001:db8::1"} {
+		if host, err := upstreamHost(upstream); err == nil {
+			t.Errorf("upstreamHost(%q) = %q", upstream, host)
+		}
+	}
+	if hp, err := upstreamHostPort("ftp+x://mirrors.example.com/"); err == nil {
+		t.Errorf("unknown scheme: %q", hp)
+	}
+}
+
+func TestNewHealthChecker(t *testing.T) {
+	tests := []struct {
+		mirror mirrorConfig
+		target string
+	}{
+		{mirrorConfig{HealthCheck: healthCheckICMP, Upstream: "mirrors.example.com::debian/"}, "mirrors.example.com"},
+		{mirrorConfig{HealthCheck: healthCheckTCP, Upstream: "mirrors.example.com::debian/"}, "mirrors.example.com:873"},
+		{mirrorConfig{HealthCheck: healthCheckHTTP, Upstream: "rsync://mirrors.example.com/debian/",
+			HealthCheckTarget: "https://mirrors.example.com/"}, "https://mirrors.example.com/"},
+		{mirrorConfig{HealthCheck: healthCheckHTTP, Upstream: "mirrors.example.com::debian/"}, ""},
+		{mirrorConfig{HealthCheck: "dns", Upstream: "mirrors.example.com"}, ""},
+	}
+	for _, tt := range tests {
+		h, err := newHealthChecker(nil, tt.mirror)
+		if tt.target == "" {
+			if err == nil {
+				t.Errorf("%+v accepted", tt.mirror)
+			}
+			continue
+		}
+		if err != nil || h.target != tt.target {
+			t.Errorf("%+v: %v", tt.mirror, err)
+		}
+	}
+	if h, err := newHealthChecker(nil, mirrorConfig{Upstream: "mirrors.example.com::debian"}); h != nil || err != nil {
+		t.Fatalf("no check configured: %v, %v", h, err)
+	}
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestHealthCheckerPreJob(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer up.Close()
+
+	tests := []struct {
+		method   string
+		upstream string
+		ok       bool
+	}{
+		{healthCheckTCP, l.Addr().String(), true},
+		{healthCheckTCP, closedAddr(t), false},
+		{healthCheckHTTP, up.URL + "/", true},
+		{healthCheckHTTP, up.URL + "/broken", false},
+	}
+	for _, tt := range tests {
+		p := newTestProvider(t, mirrorConfig{
+			Upstream:           tt.upstream,
+			HealthCheck:        tt.method,
+			HealthCheckTimeout: 2,
+		})
+		var h *healthChecker
+		for _, hook := range p.Hooks() {
+			if hc, ok := hook.(*healthChecker); ok {
+				h = hc
+			}
+		}
+		if h == nil {
+			t.Fatal("health check not added to the provider")
+		}
+		err := h.preJob()
+		if tt.ok {
+			if err != nil || h.Latency() <= 0 {
+				t.Errorf("%s %s: %v, latency %s", tt.method, tt.upstream, err, h.Latency())
+			}
+			continue
+		}
+		var unreachable *errUpstreamUnreachable
+		if !errors.As(err, &unreachable) {
+			t.Errorf("%s %s: got %v", tt.method, tt.upstream, err)
+		}
+	}
+}
+
+// an unreachable upstream fails the job without a sync attempt and
+// keeps it scheduled
+func TestJobUnreachableUpstream(t *testing.T) {
+	p := newTestProvider(t, mirrorConfig{
+		Upstream:           closedAddr(t),
+		HealthCheck:        healthCheckTCP,
+		HealthCheckTimeout: 2,
+	})
+	job := newMirrorJob(p)
+	managerChan := make(chan jobMessage, 10)
+	semaphore := make(chan empty, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- job.Run(managerChan, semaphore)
+	}()
+	job.ctrlChan <- jobStart
+
+	var msgs []jobMessage
+	for len(msgs) < 2 {
+		select {
+		case msg := <-managerChan:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %+v", msgs)
+		}
+	}
+	if msgs[0].status != PreSyncing {
+		t.Fatalf("got %+v", msgs[0])
+	}
+	if msgs[1].status != Failed || !msgs[1].schedule || !strings.Contains(msgs[1].msg, "unreachable") {
+		t.Fatalf("got %+v", msgs[1])
+	}
+
+	job.ctrlChan <- jobDisable
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for len(managerChan) > 0 {
+		if msg := <-managerChan; msg.status == Syncing {
+			t.Fatal("synced with the upstream unreachable")
+		}
+	}
+}
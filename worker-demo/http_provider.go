@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lryong/golang-snippets/ioutils"
+)
+
+// the http provider mirrors plain files over http(s) without any
+// external binary. partial downloads and the validators of the
+// mirrored files live in the temp dir rsync already uses, so a
+// restarted job resumes where the last one stopped
+
+const (
+	httpTmpDir        = ".~tmp~"
+	httpStateFile     = "http-state.json"
+	httpPartialSuffix = ".part"
+
+	defaultHTTPParallel = 4
+	// seconds
+	defaultHTTPIOTimeout = 120
+	// bound of the listings and the manifest
+	maxHTTPIndexSize = 16 << 20
+)
+
+var (
+	errHTTPTerminated = errors.New("terminated")
+	errHTTPTimeout    = errors.New("i/o timeout")
+
+	hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+)
+
+// httpFileState keeps the validators of a file, Partial tells they
+// belong to the partial download rather than the mirrored file
+type httpFileState struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Partial      bool   `json:"partial,omitempty"`
+}
+
+type httpProvider struct {
+	*baseProvider
+	upstreamURL *url.URL
+	manifest    string
+	parallel    int
+	// a request fails when the upstream sends nothing for this long
+	timeout time.Duration
+	client  *http.Client
+
+	cancel context.CancelFunc
+	done   chan error
+
+	// for one run
+	stateMu sync.Mutex
+	state   map[string]httpFileState
+	logMu   sync.Mutex
+	logFile *os.File
+}
+
+func newHTTPProvider(base *baseProvider, mirror mirrorConfig) (*httpProvider, error) {
+	u, err := url.Parse(mirror.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		return nil, errors.New("http upstream URL should ends with /")
+	}
+	if mirror.HTTPParallel < 0 {
+		return nil, errors.New("http_parallel must not be negative")
+	}
+	if mirror.HTTPTimeout < 0 {
+		return nil, errors.New("http_timeout must not be negative")
+	}
+	if _, ok := base.backend.(*nativeBackend); !ok {
+		return nil, errors.New("the http provider runs in the worker, backends are not supported")
+	}
+	if base.sandbox != nil {
+		return nil, errors.New("the http provider runs in the worker, limits are not supported")
+	}
+	p := &httpProvider{
+		baseProvider: base,
+		upstreamURL:  u,
+		manifest:     mirror.HTTPManifest,
+		parallel:     mirror.HTTPParallel,
+		timeout:      time.Duration(mirror.HTTPTimeout) * time.Second,
+		client: &http.Client{
+			Transport: http.DefaultTransport,
+		},
+	}
+	if p.parallel == 0 {
+		p.parallel = defaultHTTPParallel
+	}
+	if p.timeout == 0 {
+		p.timeout = defaultHTTPIOTimeout * time.Second
+	}
+	return p, nil
+}
+
+func (p *httpProvider) Type() string {
+	return provHTTP
+}
+
+func (p *httpProvider) Run() error {
+	p.dataSize.Store("")
+	if err := p.Start(); err != nil {
+		return err
+	}
+	return p.Wait()
+}
+
+func (p *httpProvider) Start() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.IsRunning() {
+		return errProviderRunning
+	}
+	logFile, err := os.OpenFile(p.LogFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.logFile = logFile
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan error, 1)
+	p.isRunning.Store(true)
+	go func() {
+		err := p.sync(ctx)
+		if err != nil && ctx.Err() != nil {
+			err = errHTTPTerminated
+		}
+		p.logf("sync finished: %v", err)
+		logFile.Close()
+		p.done <- err
+	}()
+	return nil
+}
+
+func (p *httpProvider) Wait() error {
+	defer func() {
+		p.Lock()
+		p.isRunning.Store(false)
+		p.cancel()
+		p.Unlock()
+	}()
+	return <-p.done
+}
+
+func (p *httpProvider) Terminate() error {
+	p.Lock()
+	defer p.Unlock()
+	logger.WithMirror(p.Name()).Debug("terminating provider")
+	if !p.IsRunning() {
+		return nil
+	}
+	p.cancel()
+	return nil
+}
+
+// logf writes a line to the log of the run
+func (p *httpProvider) logf(format string, args ...interface{}) {
+	p.logMu.Lock()
+	defer p.logMu.Unlock()
+	fmt.Fprintf(p.logFile, time.Now().Format("2006-01-02 15:04:05 ")+format+"\n", args...)
+}
+
+// sync mirrors the upstream into the working dir
+func (p *httpProvider) sync(ctx context.Context) error {
+	dir := p.WorkingDir()
+	tmpDir := filepath.Join(dir, httpTmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	p.loadState(tmpDir)
+	defer p.saveState(tmpDir)
+
+	var files []string
+	var err error
+	if p.manifest != "" {
+		files, err = p.readManifest(ctx)
+	} else {
+		files, err = p.crawl(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	p.logf("found %d files", len(files))
+
+	var failed, downloaded, transferred int64
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < p.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				n, fetched, err := p.fetch(ctx, rel, tmpDir)
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					p.logf("%s: %v", rel, err)
+					continue
+				}
+				if fetched {
+					atomic.AddInt64(&downloaded, 1)
+					atomic.AddInt64(&transferred, n)
+				}
+			}
+		}()
+	}
+	for _, rel := range files {
+		select {
+		case jobs <- rel:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	p.logf("downloaded %d files, %d bytes", downloaded, transferred)
+	if failed > 0 {
+		// keep the local files, the next run retries
+		return fmt.Errorf("failed to download %d of %d files", failed, len(files))
+	}
+
+	total, err := p.deleteExtraneous(files)
+	if err != nil {
+		return err
+	}
+	p.dataSize.Store(formatSize(total))
+	logger.WithMirror(p.Name()).WithFields(logFields{
+		"files":             len(files),
+		"files_transferred": downloaded,
+		"bytes_transferred": transferred,
+		"total_size":        total,
+	}).Info("http stats")
+	return nil
+}
+
+// cleanRelPath validates a path relative to the upstream
+func cleanRelPath(rel string) (string, bool) {
+	if strings.Contains("/"+rel+"/", "/../") {
+		return "", false
+	}
+	rel = path.Clean("/" + rel)[1:]
+	if rel == "" || rel == httpTmpDir || strings.HasPrefix(rel, httpTmpDir+"/") {
+		return "", false
+	}
+	return rel, true
+}
+
+// get sends a request that is cancelled once the upstream stays
+// silent for p.timeout, a Timeout of the client would limit the
+// whole download instead and fail large files
+func (p *httpProvider) get(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	body := &idleTimeoutBody{timeout: p.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(p.timeout, body.expire)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		body.Close()
+		if body.expired() {
+			err = fmt.Errorf("GET %s: %s", u, errHTTPTimeout.Error())
+		}
+		return nil, err
+	}
+	body.ReadCloser = resp.Body
+	resp.Body = body
+	return resp, nil
+}
+
+// idleTimeoutBody cancels its request when a read doesn't return
+// in time
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	fired   int32
+}
+
+func (b *idleTimeoutBody) expire() {
+	atomic.StoreInt32(&b.fired, 1)
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) expired() bool {
+	return atomic.LoadInt32(&b.fired) == 1
+}
+
+func (b *idleTimeoutBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err != nil && b.expired() {
+		return n, errHTTPTimeout
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	if b.ReadCloser == nil {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// readIndex returns the body of a listing or manifest
+func (p *httpProvider) readIndex(ctx context.Context, u string) ([]byte, error) {
+	resp, err := p.get(ctx, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	body, err := ioutils.ReadAll(resp.Body, maxHTTPIndexSize)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %s", u, err.Error())
+	}
+	return body, nil
+}
+
+func (p *httpProvider) readManifest(ctx context.Context) ([]string, error) {
+	ref, err := url.Parse(p.manifest)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.readIndex(ctx, p.upstreamURL.ResolveReference(ref).String())
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rel, ok := cleanRelPath(line)
+		if !ok {
+			return nil, fmt.Errorf("invalid path %q in manifest", line)
+		}
+		files = append(files, rel)
+	}
+	return files, scanner.Err()
+}
+
+// crawl follows the links of the directory listings below the
+// upstream, links ending with / are directories
+func (p *httpProvider) crawl(ctx context.Context) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	dirs := []*url.URL{p.upstreamURL}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		body, err := p.readIndex(ctx, dir.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range hrefPattern.FindAllSubmatch(body, -1) {
+			ref, err := url.Parse(string(m[1]))
+			if err != nil || ref.RawQuery != "" || ref.Fragment != "" {
+				continue
+			}
+			u := dir.ResolveReference(ref)
+			// stay below the listed dir, this skips the parent
+			// and absolute links elsewhere
+			if u.Scheme != dir.Scheme || u.Host != dir.Host ||
+				!strings.HasPrefix(u.Path, dir.Path) || u.Path == dir.Path {
+				continue
+			}
+			rel, ok := cleanRelPath(strings.TrimPrefix(u.Path, p.upstreamURL.Path))
+			if !ok || seen[u.Path] {
+				continue
+			}
+			seen[u.Path] = true
+			if strings.HasSuffix(u.Path, "/") {
+				dirs = append(dirs, u)
+			} else {
+				files = append(files, rel)
+			}
+		}
+	}
+	return files, nil
+}
+
+// fetch downloads rel unless the local copy is current, it returns
+// the bytes received and whether the file was replaced
+func (p *httpProvider) fetch(ctx context.Context, rel, tmpDir string) (int64, bool, error) {
+	dest := filepath.Join(p.WorkingDir(), filepath.FromSlash(rel))
+	partial := filepath.Join(tmpDir, url.PathEscape(rel)+httpPartialSuffix)
+	u := p.upstreamURL.ResolveReference(&url.URL{Path: rel}).String()
+
+	p.stateMu.Lock()
+	st, known := p.state[rel]
+	p.stateMu.Unlock()
+
+	header := http.Header{}
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil && known && st.Partial && (st.ETag != "" || st.LastModified != "") {
+		// resume, If-Range restarts the download if the file
+		// changed meanwhile
+		offset = fi.Size()
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if st.ETag != "" {
+			header.Set("If-Range", st.ETag)
+		} else {
+			header.Set("If-Range", st.LastModified)
+		}
+	} else if fi, err := os.Stat(dest); err == nil {
+		if known && !st.Partial && st.ETag != "" {
+			header.Set("If-None-Match", st.ETag)
+		}
+		if known && !st.Partial && st.LastModified != "" {
+			header.Set("If-Modified-Since", st.LastModified)
+		} else {
+			header.Set("If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat))
+		}
+	}
+
+	resp, err := p.get(ctx, u, header)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return 0, false, nil
+	case http.StatusPartialContent:
+		if offset == 0 || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return 0, false, fmt.Errorf("unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return 0, false, errors.New(resp.Status)
+		}
+		// the worker stopped between the end of the download and
+		// the rename, or the file shrank upstream. start over, the
+		// partial is gone so this doesn't loop
+		p.logf("%s: %s, discarding the partial download", rel, resp.Status)
+		resp.Body.Close()
+		if err := os.Remove(partial); err != nil {
+			return 0, false, err
+		}
+		p.stateMu.Lock()
+		delete(p.state, rel)
+		p.stateMu.Unlock()
+		return p.fetch(ctx, rel, tmpDir)
+	default:
+		return 0, false, errors.New(resp.Status)
+	}
+
+	st = httpFileState{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Partial:      true,
+	}
+	p.setState(rel, st)
+
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return n, false, io.ErrUnexpectedEOF
+	}
+
+	if t, err := http.ParseTime(st.LastModified); err == nil {
+		os.Chtimes(partial, t, t)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return n, false, err
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return n, false, err
+	}
+	st.Partial = false
+	p.setState(rel, st)
+	p.logf("%s: %d bytes", rel, n)
+	return n, true, nil
+}
+
+func (p *httpProvider) setState(rel string, st httpFileState) {
+	p.stateMu.Lock()
+	p.state[rel] = st
+	p.stateMu.Unlock()
+}
+
+func (p *httpProvider) loadState(tmpDir string) {
+	p.state = map[string]httpFileState{}
+	b, err := os.ReadFile(filepath.Join(tmpDir, httpStateFile))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(b, &p.state); err != nil {
+		logger.WithMirror(p.Name()).WithError(err).Warning("ignoring broken http state")
+		p.state = map[string]httpFileState{}
+	}
+}
+
+// saveState replaces the state file atomically
+func (p *httpProvider) saveState(tmpDir string) {
+	p.stateMu.Lock()
+	b, err := json.Marshal(p.state)
+	p.stateMu.Unlock()
+	if err == nil {
+		name := filepath.Join(tmpDir, httpStateFile)
+		if err = os.WriteFile(name+".new", b, 0644); err == nil {
+			err = os.Rename(name+".new", name)
+		}
+	}
+	if err != nil {
+		logger.WithMirror(p.Name()).WithError(err).Warning("failed to save http state")
+	}
+}
+
+// deleteExtraneous removes local files gone upstream along with
+// their state and empty dirs, it returns the size of the mirror
+func (p *httpProvider) deleteExtraneous(files []string) (int64, error) {
+	root := p.WorkingDir()
+	keep := make(map[string]bool, len(files))
+	for _, rel := range files {
+		keep[rel] = true
+	}
+
+	var total int64
+	var dirs []string
+	err := filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, name)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case rel == ".":
+			return nil
+		case rel == httpTmpDir:
+			return filepath.SkipDir
+		case fi.IsDir():
+			dirs = append(dirs, name)
+			return nil
+		case keep[rel]:
+			total += fi.Size()
+			return nil
+		}
+		p.logf("deleting %s", rel)
+		return os.Remove(name)
+	})
+	if err != nil {
+		return total, err
+	}
+
+	p.stateMu.Lock()
+	for rel := range p.state {
+		if !keep[rel] {
+			delete(p.state, rel)
+		}
+	}
+	p.stateMu.Unlock()
+
+	// deepest first, non-empty dirs fail to be removed
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return total, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpUpstream serves dir like a plain http mirror and records the
+// Range header of every request
+type httpUpstream struct {
+	*httptest.Server
+	dir string
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newHTTPUpstream(t *testing.T, files map[string]string) *httpUpstream {
+	t.Helper()
+	u := &httpUpstream{dir: t.TempDir()}
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(u.dir, name), content)
+	}
+	fs := http.FileServer(http.Dir(u.dir))
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.ranges = append(u.ranges, r.Header.Get("Range"))
+		u.mu.Unlock()
+		fs.ServeHTTP(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// requested tells whether a request asked for rng
+func (u *httpUpstream) requested(rng string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, r := range u.ranges {
+		if r == rng {
+			return true
+		}
+	}
+	return false
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestHTTPProvider(t *testing.T, mirror mirrorConfig) *httpProvider {
+	t.Helper()
+	mirror.Provider = provHTTP
+	p := newTestProvider(t, mirror).(*httpProvider)
+	if err := os.MkdirAll(p.LogDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// mirroredFiles returns the files below dir besides the temp dir
+func mirroredFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == httpTmpDir {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() {
+			rel, _ := filepath.Rel(dir, name)
+			b, err := ioutil.ReadFile(name)
+			files[filepath.ToSlash(rel)] = string(b)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func checkMirrored(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	got := mirroredFiles(t, dir)
+	if len(got) != len(want) {
+		t.Fatalf("got %d files %v, want %d", len(got), got, len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Fatalf("%s: got %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+func TestHTTPProviderCrawl(t *testing.T) {
+	files := map[string]string{
+		"README":                      "hello\n",
+		"dists/stable/Release":        "Suite: stable\n",
+		"pool/main/a/apt/apt.deb":     strings.Repeat("apt", 1000),
+		"pool/main/z/zsh/zsh_5.9.deb": strings.Repeat("zsh", 1000),
+	}
+	up := newHTTPUpstream(t, files)
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: up.URL + "/"})
+
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkMirrored(t, p.WorkingDir(), files)
+	if p.DataSize() == "" {
+		t.Fatal("no data size")
+	}
+
+	// gone upstream, the file and its empty dirs are removed
+	if err := os.RemoveAll(filepath.Join(up.dir, "pool/main/z")); err != nil {
+		t.Fatal(err)
+	}
+	delete(files, "pool/main/z/zsh/zsh_5.9.deb")
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkMirrored(t, p.WorkingDir(), files)
+	if _, err := os.Stat(filepath.Join(p.WorkingDir(), "pool/main/z")); !os.IsNotExist(err) {
+		t.Fatalf("empty dir left: %v", err)
+	}
+}
+
+func TestHTTPProviderNotModified(t *testing.T) {
+	up := newHTTPUpstream(t, map[string]string{"a": "a", "b": "b"})
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: up.URL + "/"})
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stat := func() time.Time {
+		fi, err := os.Stat(filepath.Join(p.WorkingDir(), "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.ModTime()
+	}
+	before := stat()
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !stat().Equal(before) {
+		t.Fatal("unchanged file downloaded again")
+	}
+	log, _ := ioutil.ReadFile(p.LogFile())
+	if !strings.Contains(string(log), "downloaded 0 files") {
+		t.Fatalf("log:\n%s", log)
+	}
+}
+
+func TestHTTPProviderManifest(t *testing.T) {
+	up := newHTTPUpstream(t, map[string]string{
+		"MANIFEST": "# the files to mirror\nx/a\n\ny/b\n",
+		"x/a":      "a",
+		"y/b":      "b",
+		"unlisted": "c",
+	})
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: up.URL + "/", HTTPManifest: "MANIFEST"})
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkMirrored(t, p.WorkingDir(), map[string]string{"x/a": "a", "y/b": "b"})
+
+	writeTestFile(t, filepath.Join(up.dir, "MANIFEST"), "../etc/passwd\n")
+	if err := p.Run(); err == nil || !strings.Contains(err.Error(), "invalid path") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// seedPartial leaves a partial download of rel like an interrupted
+// run would
+func seedPartial(t *testing.T, p *httpProvider, up *httpUpstream, rel, content string) {
+	t.Helper()
+	fi, err := os.Stat(filepath.Join(up.dir, rel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir := filepath.Join(p.WorkingDir(), httpTmpDir)
+	writeTestFile(t, filepath.Join(tmpDir, rel+httpPartialSuffix), content)
+	p.state = map[string]httpFileState{rel: {
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+		Partial:      true,
+	}}
+	p.saveState(tmpDir)
+}
+
+func TestHTTPProviderResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	up := newHTTPUpstream(t, map[string]string{"big": content})
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: up.URL + "/"})
+	seedPartial(t, p, up, "big", content[:300])
+
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkMirrored(t, p.WorkingDir(), map[string]string{"big": content})
+	if !up.requested("bytes=300-") {
+		t.Fatal("not resumed")
+	}
+}
+
+// the worker stopped after the download but before the rename, the
+// range past the end is refused with 416
+func TestHTTPProviderCompletePartial(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	up := newHTTPUpstream(t, map[string]string{"big": content, "small": "s"})
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: up.URL + "/"})
+	seedPartial(t, p, up, "big", content)
+	writeTestFile(t, filepath.Join(p.WorkingDir(), "extraneous"), "x")
+
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// downloaded again and the extraneous file deleted
+	checkMirrored(t, p.WorkingDir(), map[string]string{"big": content, "small": "s"})
+	log, _ := ioutil.ReadFile(p.LogFile())
+	if !up.requested("bytes=1000-") || !strings.Contains(string(log), "416") {
+		t.Fatalf("log:\n%s", log)
+	}
+	if _, err := os.Stat(filepath.Join(p.WorkingDir(), httpTmpDir, "big"+httpPartialSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("partial left: %v", err)
+	}
+}
+
+func TestHTTPProviderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="stalled">stalled</a> <a href="silent">silent</a>`))
+		case "/stalled":
+			// headers and the start of the body, then nothing
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-release
+		case "/silent":
+			<-release
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: srv.URL + "/"})
+	p.timeout = 200 * time.Millisecond
+	start := time.Now()
+	err := p.Run()
+	if err == nil || !strings.Contains(err.Error(), "failed to download 2 of 2 files") {
+		t.Fatalf("got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("stopped after %s", d)
+	}
+	log, _ := ioutil.ReadFile(p.LogFile())
+	if strings.Count(string(log), errHTTPTimeout.Error()) != 2 {
+		t.Fatalf("log:\n%s", log)
+	}
+}
+
+func TestHTTPProviderTerminate(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := newTestHTTPProvider(t, mirrorConfig{Upstream: srv.URL + "/"})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != errHTTPTerminated {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCleanRelPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"a/b", "a/b", true},
+		{"./a//b", "a/b", true},
+		{"/a", "a", true},
+		{"../a", "", false},
+		{"a/../../b", "", false},
+		{"", "", false},
+		{httpTmpDir, "", false},
+		{httpTmpDir + "/http-state.json", "", false},
+		{httpTmpDir + "x", httpTmpDir + "x", true},
+	}
+	for _, tt := range tests {
+		got, ok := cleanRelPath(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanRelPath(%q) = %q, %v", tt.in, got, ok)
+		}
+	}
+}
@@ -23,6 +23,24 @@ const (
 
 type SyncStatus uint8
 
+var syncStatusNames = map[SyncStatus]string{
+	None:       "none",
+	Failed:     "failed",
+	Success:    "success",
+	Syncing:    "syncing",
+	PreSyncing: "pre-syncing",
+	Paused:     "paused",
+	Disabled:   "disabled",
+}
+
+// String names the status in logs
+func (s SyncStatus) String() string {
+	if name, ok := syncStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncStatus(%d)", uint8(s))
+}
+
 type jobMessage struct {
 	status   SyncStatus
 	name     string
@@ -52,6 +70,16 @@ type mirrorJob struct {
 	ctrlChan chan ctrlAction
 	disabled chan empty
 	state    uint32
+	// size of the mirror reported by the last successful sync
+	size atomic.Value
+}
+
+func newMirrorJob(provider mirrorProvider) *mirrorJob {
+	return &mirrorJob{
+		provider: provider,
+		ctrlChan: make(chan ctrlAction, 1),
+		state:    stateNone,
+	}
 }
 
 func (m *mirrorJob) Name() string {
@@ -66,6 +94,12 @@ func (m *mirrorJob) SetState(state uint32) {
 	atomic.StoreUint32(&(m.state), state)
 }
 
+// Size returns the mirror size, "" if unknown
+func (m *mirrorJob) Size() string {
+	size, _ := m.size.Load().(string)
+	return size
+}
+
 func (m *mirrorJob) SetProvider(provider mirrorProvider) error {
 	s := m.State()
 	if (s != stateNone) && (s != stateDisabled) {
@@ -91,14 +125,20 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 	}()
 
 	provider := m.provider
+	maxRetry := provider.Retry()
+	log := logger.WithMirror(m.Name())
 
 	runHooks := func(Hooks []jobHook, action func(h jobHook) error, hookname string) error {
 		for _, hook := range Hooks {
 			if err := action(hook); err != nil {
-				logger.Errorf(
-					"failed at %s hooks for %s: %s",
-					hookname, m.Name(), err.Error(),
-				)
+				log.WithError(err).WithFields(logFields{"status": Failed}).Errorf("failed at %s hooks", hookname)
+				// an unreachable upstream is not a broken job,
+				// try again at the next interval
+				var unreachable *errUpstreamUnreachable
+				if errors.As(err, &unreachable) {
+					managerChan <- jobMessage{Failed, m.Name(), err.Error(), (m.State() == stateReady)}
+					return err
+				}
 				managerChan <- jobMessage{
 					Failed, m.Name(),
 					fmt.Sprintf("error exec hook %s: %s", hookname, err.Error()),
@@ -113,8 +153,9 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 	runJobWrapper := func(kill <-chan empty, jobDone chan<- empty) error {
 		defer close(jobDone)
 
-		managerChan <- jobMessage{PreSyncing, m.name(), "", false}
-		logger.Noticef("start syncing: %s", m.Name())
+		managerChan <- jobMessage{PreSyncing, m.Name(), "", false}
+		log.WithFields(logFields{"status": PreSyncing}).Notice("start syncing")
+		started := time.Now()
 
 		Hooks := provider.Hooks()
 		rHooks := []jobHook{}
@@ -122,7 +163,7 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 			rHooks = append(rHooks, Hooks[i-1])
 		}
 
-		logger.Debug("hooks: pre-job")
+		log.Debug("hooks: pre-job")
 
 		err := runHooks(Hooks, func(h jobHook) error { return h.preJob() }, "pre-job")
 		if err != nil {
@@ -131,17 +172,20 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 
 		for retry := 0; retry < maxRetry; retry++ {
 			stopASAP := false // stop job as soon as possible
+			rlog := log.WithFields(logFields{"retry": retry})
 
 			if retry > 0 {
-				logger.Noticef("retry syncing: %s, retry: %d", m.Name(), retry)
+				rlog.Notice("retry syncing")
 			}
-			err := runHooks(Hooks, func(h jobHook) error { return h.preJob() }, "pre-exec")
+			err := runHooks(Hooks, func(h jobHook) error { return h.preExec() }, "pre-exec")
 			if err != nil {
 				return err
 			}
 
 			// start syncing
 			managerChan <- jobMessage{Syncing, m.Name(), "", false}
+			rlog.WithFields(logFields{"status": Syncing}).Info("syncing")
+			syncStart := time.Now()
 
 			var syncErr error
 			syncDone := make(chan error, 1)
@@ -152,13 +196,13 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 
 			select {
 			case syncErr = <-syncDone:
-				logger.Debug("syncing done")
+				rlog.WithFields(logFields{"duration": time.Since(syncStart)}).Debug("syncing done")
 			case <-kill:
-				logger.Debug("received kill")
+				rlog.Debug("received kill")
 				stopASAP = true
 				err := provider.Terminate()
 				if err != nil {
-					logger.Errorf("failed to terminate provider %s: %s", m.Name(), err.Error())
+					rlog.WithError(err).Error("failed to terminate provider")
 					return err
 				}
 				syncErr = errors.New("killed by manager")
@@ -172,7 +216,13 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 
 			if syncErr == nil {
 				// syncing success
-				logger.Noticef("succeeded syncing %s", m.Name())
+				rlog.WithFields(logFields{
+					"status":   Success,
+					"duration": time.Since(started),
+				}).Notice("succeeded syncing")
+				if size := provider.DataSize(); size != "" {
+					m.size.Store(size)
+				}
 				managerChan <- jobMessage{Success, m.Name(), "", (m.State() == stateReady)}
 
 				// post-success hooks
@@ -184,11 +234,14 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 			}
 
 			// syncing failed
-			logger.Warningf("failed syncing %s: %s", m.Name(), syncErr.Error())
+			rlog.WithError(syncErr).WithFields(logFields{
+				"status":   Failed,
+				"duration": time.Since(syncStart),
+			}).Warning("failed syncing")
 			managerChan <- jobMessage{Failed, m.Name(), syncErr.Error(), (retry == maxRetry-1) && (m.State() == stateReady)}
 
 			// post-fail hooks
-			logger.Debug("post-fail hooks")
+			rlog.Debug("post-fail hooks")
 			err = runHooks(rHooks, func(h jobHook) error { return h.postFail() }, "post-fail")
 			if err != nil {
 				return err
@@ -196,7 +249,7 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 
 			// gracefully exit
 			if stopASAP {
-				logger.Debug("No retry, exit directly")
+				rlog.Debug("No retry, exit directly")
 				return nil
 			}
 			// continue to next retry
@@ -210,7 +263,7 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 			defer func() { <-semaphore }()
 			runJobWrapper(kill, jobDone)
 		case <-bypassSemaphore:
-			logger.Noticef("Concurrent limit ignored by %s", m.Name())
+			log.Notice("Concurrent limit ignored")
 			runJobWrapper(kill, jobDone)
 		case <-kill:
 			jobDone <- empty{}
@@ -228,7 +281,7 @@ func (m *mirrorJob) Run(managerChan chan<- jobMessage, semaphore chan empty) err
 		_wait_for_job:
 			select {
 			case <-jobDone:
-				logger.Debug("job done")
+				log.Debug("job done")
 			case ctrl := <-m.ctrlChan:
 				switch crtl {
 				case jobStop:
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress rotated sync logs, the current log stays plain
+// so it can still be followed through the "latest" link
+
+type logCompression string
+
+const (
+	logCompressNone logCompression = ""
+	logCompressGzip logCompression = "gzip"
+	logCompressZstd logCompression = "zstd"
+)
+
+func (c logCompression) ext() string {
+	switch c {
+	case logCompressGzip:
+		return ".gz"
+	case logCompressZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+func parseLogCompression(s string) (logCompression, error) {
+	switch c := logCompression(s); c {
+	case logCompressNone, logCompressGzip, logCompressZstd:
+		return c, nil
+	default:
+		return logCompressNone, fmt.Errorf("unsupported log compression %q", s)
+	}
+}
+
+// isCompressedLog tells compressed logs by their extension
+func isCompressedLog(name string) bool {
+	return strings.HasSuffix(name, logCompressGzip.ext()) ||
+		strings.HasSuffix(name, logCompressZstd.ext())
+}
+
+// compressLog replaces path by path+ext, keeping its mtime so the
+// retention policy still sees the log's age
+func compressLog(path string, c logCompression) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dstPath := path + c.ext()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(dstPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	// no-op once renamed
+	defer os.Remove(tmp.Name())
+
+	var w io.WriteCloser
+	switch c {
+	case logCompressGzip:
+		w = gzip.NewWriter(tmp)
+	case logCompressZstd:
+		w, err = zstd.NewWriter(tmp)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	default:
+		tmp.Close()
+		return fmt.Errorf("unsupported log compression %q", c)
+	}
+
+	if _, err = io.Copy(w, src); err == nil {
+		err = w.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// openLog opens a plain or compressed log, decompressing transparently
+func openLog(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, logCompressGzip.ext()):
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &stackedReadCloser{r, []io.Closer{r, f}}, nil
+	case strings.HasSuffix(path, logCompressZstd.ext()):
+		d, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		rc := d.IOReadCloser()
+		return &stackedReadCloser{rc, []io.Closer{rc, f}}, nil
+	default:
+		return f, nil
+	}
+}
+
+// stackedReadCloser closes a decompressor and the file beneath it
+type stackedReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *stackedReadCloser) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	r, err := openLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCompressLog(t *testing.T) {
+	content := strings.Repeat("sending incremental file list\n", 1000)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, c := range []logCompression{logCompressGzip, logCompressZstd} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "mirror_2020-01-01_00_00.log")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+
+		if err := compressLog(path, c); err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: plain log left: %v", c, err)
+		}
+		fi, err := os.Stat(path + c.ext())
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %s, want %s", c, fi.ModTime(), mtime)
+		}
+		if fi.Size() >= int64(len(content)) {
+			t.Errorf("%s: %d bytes, not compressed", c, fi.Size())
+		}
+		if !isCompressedLog(fi.Name()) {
+			t.Errorf("%s: %s not seen as compressed", c, fi.Name())
+		}
+		if got := readLog(t, path+c.ext()); got != content {
+			t.Errorf("%s: round trip got %d bytes, want %d", c, len(got), len(content))
+		}
+		// no temp file is left over
+		if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+			t.Errorf("%s: %d files in the log dir", c, len(files))
+		}
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mirror.log")
+	ioutil.WriteFile(path, []byte(content), 0644)
+	if err := compressLog(path, "xz"); err == nil {
+		t.Fatal("unsupported compression accepted")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || readLog(t, path) != content {
+		t.Fatal("unsupported compression touched the log")
+	}
+	if err := compressLog(filepath.Join(dir, "missing.log"), logCompressGzip); !os.IsNotExist(err) {
+		t.Fatalf("missing log: %v", err)
+	}
+}
+
+func TestOpenLog(t *testing.T) {
+	dir := t.TempDir()
+	// a plain log is read as is
+	plain := filepath.Join(dir, "mirror_2020-01-01_00_00.log")
+	ioutil.WriteFile(plain, []byte("plain\n"), 0644)
+	if got := readLog(t, plain); got != "plain\n" {
+		t.Fatalf("plain: got %q", got)
+	}
+
+	// files that aren't what their extension says
+	for _, ext := range []string{".gz", ".zst"} {
+		path := plain + ext
+		ioutil.WriteFile(path, []byte("plain\n"), 0644)
+		r, err := openLog(path)
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+			r.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: plain text decompressed", ext)
+		}
+	}
+
+	if _, err := openLog(filepath.Join(dir, "missing.log.gz")); !os.IsNotExist(err) {
+		t.Fatalf("missing log: %v", err)
+	}
+}
+
+func TestParseLogCompression(t *testing.T) {
+	for _, s := range []string{"", "gzip", "zstd"} {
+		if c, err := parseLogCompression(s); err != nil || string(c) != s {
+			t.Errorf("%q: %q, %v", s, c, err)
+		}
+	}
+	if _, err := parseLogCompression("xz"); err == nil {
+		t.Error("xz accepted")
+	}
+}
+
+func findLogLimiter(t *testing.T, p mirrorProvider) *logLimiter {
+	t.Helper()
+	for _, hook := range p.Hooks() {
+		if l, ok := hook.(*logLimiter); ok {
+			return l
+		}
+	}
+	t.Fatal("no log limiter")
+	return nil
+}
+
+func TestLogLimiterCompress(t *testing.T) {
+	for _, failed := range []bool{false, true} {
+		p := newTestProvider(t, mirrorConfig{LogCompression: "zstd"})
+		l := findLogLimiter(t, p)
+		logDir := p.LogDir()
+		os.MkdirAll(logDir, 0755)
+		old := map[string]string{
+			"mirror_2020-01-01_00_00.log":      "first\n",
+			"mirror_2020-01-02_00_00.log.fail": "second\n",
+			"mirror_2020-01-03_00_00.log.gz":   "already compressed",
+			"mirror2_2020-01-01_00_00.log":     "another mirror\n",
+		}
+		for name, content := range old {
+			ioutil.WriteFile(filepath.Join(logDir, name), []byte(content), 0644)
+		}
+
+		if err := l.preExec(); err != nil {
+			t.Fatal(err)
+		}
+		current := p.LogFile()
+		ioutil.WriteFile(current, []byte("current\n"), 0644)
+		if failed {
+			l.postFail()
+			current += ".fail"
+		} else {
+			l.postSuccess()
+		}
+		l.compressWG.Wait()
+
+		files, _ := ioutil.ReadDir(logDir)
+		names := []string{}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		want := []string{
+			filepath.Base(current),
+			"latest",
+			"mirror2_2020-01-01_00_00.log",
+			"mirror_2020-01-01_00_00.log.zst",
+			"mirror_2020-01-02_00_00.log.fail.zst",
+			"mirror_2020-01-03_00_00.log.gz",
+		}
+		sort.Strings(want)
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Fatalf("failed %v: got %v, want %v", failed, names, want)
+		}
+		// the newest log is left alone and still linked
+		if got := readLog(t, filepath.Join(logDir, "latest")); got != "current\n" {
+			t.Errorf("failed %v: latest %q", failed, got)
+		}
+		if got := readLog(t, filepath.Join(logDir, "mirror_2020-01-02_00_00.log.fail.zst")); got != "second\n" {
+			t.Errorf("failed %v: got %q", failed, got)
+		}
+	}
+}
+
+func TestLogLimiterNoCompression(t *testing.T) {
+	p := newTestProvider(t, mirrorConfig{})
+	l := findLogLimiter(t, p)
+	os.MkdirAll(p.LogDir(), 0755)
+	old := filepath.Join(p.LogDir(), "mirror_2020-01-01_00_00.log")
+	ioutil.WriteFile(old, []byte("first\n"), 0644)
+	l.preExec()
+	l.postSuccess()
+	l.compressWG.Wait()
+	if _, err := os.Stat(old); err != nil {
+		t.Fatal(err)
+	}
+}
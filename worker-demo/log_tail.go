@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stream the current sync log of a mirror, like tail -f on the
+// "latest" link maintained by logLimiter
+
+const (
+	defaultTailLines = 10
+	maxTailLines     = 10000
+	tailPollInterval = 500 * time.Millisecond
+	tailChunkSize    = 4096
+)
+
+// handleLogTail serves GET /jobs/:mirror/log. The query option n is
+// the number of lines to show first, like tail -n (default 10), and
+// follow=false stops at the end of the log instead of streaming.
+// When Accept lists text/event-stream lines are sent as Server-Sent
+// Events, otherwise as a chunked plain text response.
+func (w *Worker) handleLogTail(c *gin.Context) {
+	name := c.Param("mirror")
+	// from the config, the provider's context belongs to the job
+	// goroutine
+	var logDir string
+	w.L.Lock()
+	_, ok := w.jobs[name]
+	for _, mirror := range w.cfg.Mirrors {
+		if mirror.Name == name {
+			logDir = mirrorLogDir(mirror, w.cfg)
+		}
+	}
+	w.L.Unlock()
+	if !ok || logDir == "" {
+		c.JSON(http.StatusNotFound, gin.H{"msg": fmt.Sprintf("Mirror `%s` not found", name)})
+		return
+	}
+
+	lines := defaultTailLines
+	if s := c.Query("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxTailLines {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "Invalid line count"})
+			return
+		}
+		lines = n
+	}
+	follow := true
+	if s := c.Query("follow"); s != "" {
+		f, err := strconv.ParseBool(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"msg": "Invalid follow option"})
+			return
+		}
+		follow = f
+	}
+
+	logLink := filepath.Join(logDir, "latest")
+	f, err := os.Open(logLink)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"msg": fmt.Sprintf("No log for mirror `%s`", name)})
+		return
+	}
+	defer func() { f.Close() }()
+
+	offset, err := tailOffset(f, lines)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"msg": err.Error()})
+		return
+	}
+
+	sse := acceptsEventStream(c.Request.Header.Values("Accept"))
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+	}
+	c.Status(http.StatusOK)
+	// the server's WriteTimeout would cut the stream
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	out := &tailWriter{w: c.Writer, sse: sse}
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	r := bufio.NewReaderSize(f, tailChunkSize)
+
+	for {
+		if err := out.copyLines(r); err != nil {
+			return
+		}
+		c.Writer.Flush()
+		if !follow {
+			out.flushPartial()
+			c.Writer.Flush()
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		// a new run points "latest" to a new file, the rename to
+		// ".fail" by postFail keeps the same file and isn't a rotation
+		next, err := os.Open(logLink)
+		if err != nil {
+			continue
+		}
+		if sameFile(f, next) {
+			next.Close()
+			continue
+		}
+		// drain what was written to the old log before switching
+		if err := out.copyLines(r); err != nil {
+			next.Close()
+			return
+		}
+		out.flushPartial()
+		f.Close()
+		f = next
+		r.Reset(f)
+		if err := out.rotated(filepath.Base(mustReadlink(logLink))); err != nil {
+			return
+		}
+	}
+}
+
+// acceptsEventStream tells whether the Accept headers list
+// text/event-stream other than with q=0
+func acceptsEventStream(accept []string) bool {
+	for _, header := range accept {
+		for _, v := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(v)
+			if err != nil || mediaType != "text/event-stream" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func sameFile(a, b *os.File) bool {
+	ai, err := a.Stat()
+	if err != nil {
+		return false
+	}
+	bi, err := b.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+func mustReadlink(path string) string {
+	target, _ := os.Readlink(path)
+	return target
+}
+
+// tailOffset returns where the last n lines of f start,
+// scanning backwards from the end
+func tailOffset(f *os.File, n int) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if n == 0 {
+		return size, nil
+	}
+
+	buf := make([]byte, tailChunkSize)
+	pos := size
+	found := 0
+	// a final newline ends the last line rather than starting a new one
+	skipLast := true
+	for pos > 0 {
+		readSize := int64(len(buf))
+		if pos < readSize {
+			readSize = pos
+		}
+		pos -= readSize
+		if _, err := f.ReadAt(buf[:readSize], pos); err != nil {
+			return 0, err
+		}
+		for i := readSize - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				skipLast = false
+				continue
+			}
+			if skipLast {
+				skipLast = false
+				continue
+			}
+			found++
+			if found == n {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// tailWriter writes whole lines, as plain text or Server-Sent Events
+type tailWriter struct {
+	w       io.Writer
+	sse     bool
+	partial []byte
+}
+
+// copyLines writes every complete line available from r,
+// a trailing partial line is kept until its newline arrives
+func (t *tailWriter) copyLines(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadBytes('\n')
+		t.partial = append(t.partial, line...)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if werr := t.writeLine(t.partial); werr != nil {
+			return werr
+		}
+		t.partial = t.partial[:0]
+	}
+}
+
+// flushPartial writes the pending partial line, if any
+func (t *tailWriter) flushPartial() error {
+	if len(t.partial) == 0 {
+		return nil
+	}
+	err := t.writeLine(t.partial)
+	t.partial = t.partial[:0]
+	return err
+}
+
+func (t *tailWriter) writeLine(line []byte) error {
+	if !t.sse {
+		_, err := t.w.Write(line)
+		return err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	_, err := fmt.Fprintf(t.w, "data: %s\n\n", line)
+	return err
+}
+
+func (t *tailWriter) rotated(newLog string) error {
+	if !t.sse {
+		_, err := fmt.Fprintf(t.w, "==> %s <==\n", newLog)
+		return err
+	}
+	_, err := fmt.Fprintf(t.w, "event: rotate\ndata: %s\n\n", newLog)
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTailOffset(t *testing.T) {
+	long := strings.Repeat("x", tailChunkSize+100) + "\n"
+	tests := []struct {
+		name    string
+		content string
+		n       int
+		want    string
+	}{
+		{"empty", "", 10, ""},
+		{"no lines", "a\nb\n", 0, ""},
+		{"last line", "a\nb\nc\n", 1, "c\n"},
+		{"last two", "a\nb\nc\n", 2, "b\nc\n"},
+		{"more than there are", "a\nb\n", 10, "a\nb\n"},
+		{"partial last line", "a\nb\nc", 2, "b\nc"},
+		{"empty lines", "a\n\n\n", 2, "\n\n"},
+		{"lines across chunks", "a\n" + long + long + "b\n", 3, long + long + "b\n"},
+		{"line longer than a chunk", "a\n" + long, 1, long},
+	}
+	for _, tt := range tests {
+		f, err := ioutil.TempFile(t.TempDir(), "log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(tt.content)
+		offset, err := tailOffset(f, tt.n)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tt.content[offset:]; got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	for _, sse := range []bool{false, true} {
+		var out bytes.Buffer
+		w := &tailWriter{w: &out, sse: sse}
+		r := bufio.NewReader(strings.NewReader("one\r\ntwo\nthr"))
+		if err := w.copyLines(r); err != nil {
+			t.Fatal(err)
+		}
+		// the partial line waits for the rest
+		r.Reset(strings.NewReader("ee\nfou"))
+		if err := w.copyLines(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.flushPartial(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.rotated("2026-10-19.log"); err != nil {
+			t.Fatal(err)
+		}
+		want := "one\r\ntwo\nthree\nfou==> 2026-10-19.log <==\n"
+		if sse {
+			want = "data: one\n\ndata: two\n\ndata: three\n\ndata: fou\n\nevent: rotate\ndata: 2026-10-19.log\n\n"
+		}
+		if out.String() != want {
+			t.Errorf("sse %v: got %q, want %q", sse, out.String(), want)
+		}
+	}
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"text/event-stream"}, true},
+		{[]string{"text/event-stream, */*"}, true},
+		{[]string{"text/plain;q=0.9, text/event-stream;q=0.5"}, true},
+		{[]string{"Text/Event-Stream; charset=utf-8"}, true},
+		{[]string{"text/plain", "text/event-stream"}, true},
+		{[]string{"text/event-stream;q=0"}, false},
+		{[]string{"*/*"}, false},
+		{[]string{"text/plain"}, false},
+		{[]string{"text/event-streamer"}, false},
+	}
+	for _, tt := range tests {
+		if got := acceptsEventStream(tt.accept); got != tt.want {
+			t.Errorf("%q: got %v", tt.accept, got)
+		}
+	}
+}
+
+// newTailServer serves the log endpoint of a worker with the mirror
+// "debian", whose log dir is returned
+func newTailServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	logDir := t.TempDir()
+	mirror := mirrorConfig{Name: "debian", LogDir: logDir}
+	w := &Worker{
+		cfg:  &Config{Mirrors: []mirrorConfig{mirror}},
+		jobs: map[string]*mirrorJob{"debian": newMirrorJob(nil)},
+	}
+	r := gin.New()
+	r.GET("/jobs/:mirror/log", w.handleLogTail)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, logDir
+}
+
+// writeLatest writes a log and points "latest" to it
+func writeLatest(t *testing.T, logDir, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(logDir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(logDir, "latest")
+	os.Remove(link)
+	if err := os.Symlink(name, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTail(t *testing.T, url, accept string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestHandleLogTail(t *testing.T) {
+	srv, logDir := newTailServer(t)
+	writeLatest(t, logDir, "a.log", "1\n2\n3\n4\n")
+
+	tests := []struct {
+		query  string
+		accept string
+		status int
+		ctype  string
+		body   string
+	}{
+		{"?follow=false&n=2", "", http.StatusOK, "text/plain", "3\n4\n"},
+		{"?follow=false", "", http.StatusOK, "text/plain", "1\n2\n3\n4\n"},
+		{"?follow=false&n=1", "text/event-stream, */*", http.StatusOK, "text/event-stream", "data: 4\n\n"},
+		{"?n=-1", "", http.StatusBadRequest, "", ""},
+		{"?follow=maybe", "", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		resp := getTail(t, srv.URL+"/jobs/debian/log"+tt.query, tt.accept)
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d", tt.query, resp.StatusCode)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), tt.ctype) || string(body) != tt.body {
+			t.Errorf("%s: got %s %q, want %s %q", tt.query, resp.Header.Get("Content-Type"), body, tt.ctype, tt.body)
+		}
+	}
+
+	if resp := getTail(t, srv.URL+"/jobs/ubuntu/log", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown mirror: status %d", resp.StatusCode)
+	}
+	os.Remove(filepath.Join(logDir, "latest"))
+	if resp := getTail(t, srv.URL+"/jobs/debian/log", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("no log: status %d", resp.StatusCode)
+	}
+}
+
+func TestHandleLogTailFollow(t *testing.T) {
+	srv, logDir := newTailServer(t)
+	writeLatest(t, logDir, "a.log", "old\nstarted\n")
+
+	resp := getTail(t, srv.URL+"/jobs/debian/log?n=1", "text/event-stream")
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines <- scanner.Text()
+			}
+		}
+		close(lines)
+	}()
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case got := <-lines:
+				if got != w {
+					t.Fatalf("got %q, want %q", got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %q", w)
+			}
+		}
+	}
+	expect("data: started")
+
+	f, err := os.OpenFile(filepath.Join(logDir, "a.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "synced\nlast")
+	f.Close()
+	expect("data: synced")
+
+	// a new run, the partial line of the old log is sent first
+	writeLatest(t, logDir, "b.log", "next run\n")
+	expect("data: last", "event: rotate", "data: b.log", "data: next run")
+}
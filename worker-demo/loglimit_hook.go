@@ -5,20 +5,55 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
-	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	defaultLogRetainCount = 10
+	logTimeFormat         = "2006-01-02_15_04"
+)
+
+// logRetention decides which old logs of a mirror are removed,
+// zero values disable a limit
+type logRetention struct {
+	// count includes the log of the run about to start
+	count    int
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+func newLogRetention(mirror mirrorConfig) logRetention {
+	r := logRetention{
+		count:    mirror.LogRetainCount,
+		maxAge:   time.Duration(mirror.LogMaxAge) * 24 * time.Hour,
+		maxBytes: mirror.LogMaxTotalBytes,
+	}
+	if r.count == 0 {
+		r.count = defaultLogRetainCount
+	}
+	return r
+}
+
 // limit
 type logLimiter struct {
 	emptyHook
-	provider mirrorProvider
+	provider    mirrorProvider
+	retention   logRetention
+	compression logCompression
+
+	// compression runs in the background, one batch at a time
+	compressMu sync.Mutex
+	compressWG sync.WaitGroup
 }
 
-func newLogLimiter(provider mirrorProvider) *logLimiter {
+func newLogLimiter(provider mirrorProvider, retention logRetention, compression logCompression) *logLimiter {
 	return &logLimiter{
-		provider: provider,
+		provider:    provider,
+		retention:   retention,
+		compression: compression,
 	}
 }
 
@@ -28,27 +63,26 @@ func (f fileSlice) Len() int           { return len(f) }
 func (f fileSlice) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
 func (f fileSlice) Less(i, j int) bool { return f[i].ModTime().Before(f[j].ModTime()) }
 
-func (l *logLimiter) preExec() error {
-	logger.Debugf("executing log limitter for %s", l.provider.Name())
-
-	p := l.provider
-	if p.LogFile() == "dev/null" {
-		return nil
-	}
+// logFilePattern matches "<name>_<timestamp>.log", the ".fail"
+// variant renamed by postFail and their compressed forms, but not the
+// logs of another mirror whose name merely starts with name
+func logFilePattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(
+		`^` + regexp.QuoteMeta(name) + `_\d{4}-\d{2}-\d{2}_\d{2}_\d{2}\.log(\.fail)?(\.gz|\.zst)?$`,
+	)
+}
 
-	logDir := p.LogDir()
-	files, err := ioutil.ReadDir(logDir)
+// matchedLogs lists the logs of the mirror, newest first
+func (l *logLimiter) matchedLogs() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(l.provider.LogDir())
 	if err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(logDir, 755)
-		} else {
-			return err
-		}
+		return nil, err
 	}
 	matchedFiles := []os.FileInfo{}
+	pattern := logFilePattern(l.provider.Name())
 
 	for _, f := range files {
-		if strings.HasPrefix(f.Name(), p.Name()) {
+		if f.Mode().IsRegular() && pattern.MatchString(f.Name()) {
 			matchedFiles = append(matchedFiles, f)
 		}
 	}
@@ -60,24 +94,71 @@ func (l *logLimiter) preExec() error {
 			fileSlice(matchedFiles),
 		),
 	)
-	// remove old files
-	if len(matchedFiles) > 9 {
-		for _, f := range matchedFiles[9:] {
-			os.Remove(filePath.Join(logDir, f.Name()))
+	return matchedFiles, nil
+}
+
+// expired returns the logs to remove, files must be sorted newest first
+func (r logRetention) expired(files []os.FileInfo, now time.Time) []os.FileInfo {
+	expired := []os.FileInfo{}
+	var total int64
+	// keep room for the new log
+	kept := 1
+	// once a log is over the byte budget so are the older ones,
+	// even if they are smaller
+	full := false
+	for _, f := range files {
+		switch {
+		case r.count > 0 && kept >= r.count:
+		case r.maxAge > 0 && now.Sub(f.ModTime()) > r.maxAge:
+		case full:
+		case r.maxBytes > 0 && total+f.Size() > r.maxBytes:
+			full = true
+		default:
+			kept++
+			total += f.Size()
+			continue
 		}
+		expired = append(expired, f)
+	}
+	return expired
+}
+
+func (l *logLimiter) preExec() error {
+	log := logger.WithMirror(l.provider.Name())
+	log.Debug("executing log limitter")
+
+	p := l.provider
+	if p.LogFile() == "/dev/null" {
+		return nil
+	}
+
+	logDir := p.LogDir()
+	matchedFiles, err := l.matchedLogs()
+	if err != nil {
+		if os.IsNotExist(err) {
+			os.MkdirAll(logDir, 0755)
+		} else {
+			return err
+		}
+	}
+
+	// remove old files
+	for _, f := range l.retention.expired(matchedFiles, time.Now()) {
+		log.Debugf("removing old log %s", f.Name())
+		os.Remove(filepath.Join(logDir, f.Name()))
 	}
 
 	logFileName := fmt.Sprintf(
 		"%s_%s.log",
 		p.Name(),
-		time.Now().Format("2006-01-02_15_04"),
+		time.Now().Format(logTimeFormat),
 	)
 
 	logFilePath := filepath.Join(
-		logDir, LogFileName,
+		logDir, logFileName,
 	)
 
-	logLink := filePath.Join(logDir, "latest")
+	logLink := filepath.Join(logDir, "latest")
 
 	if _, err = os.Lstat(logLink); err == nil {
 		os.Remove(logLink)
@@ -90,20 +171,65 @@ func (l *logLimiter) preExec() error {
 }
 
 func (l *logLimiter) postSuccess() error {
+	l.compressOldLogs()
 	l.provider.ExitContext()
 	return nil
 }
 
 func (l *logLimiter) postFail() error {
-	logFile := l.provider().LogFile()
+	logFile := l.provider.LogFile()
 	logFileFail := logFile + ".fail"
 	logDir := l.provider.LogDir()
 	logLink := filepath.Join(logDir, "latest")
 	os.Rename(logFile, logFileFail)
 	os.Remove(logLink)
-	logFilName := filepath.Base(logFileFail)
+	logFileName := filepath.Base(logFileFail)
 	os.Symlink(logFileName, logLink)
 
+	l.compressOldLogs()
 	l.provider.ExitContext()
 	return nil
 }
+
+// compressOldLogs compresses every plain log except the one "latest"
+// points to. the logs are listed here, before the next run can create
+// its own, and compressed in the background so a large log doesn't
+// hold up the job. failures are only logged as the sync is over
+func (l *logLimiter) compressOldLogs() {
+	if l.compression == logCompressNone {
+		return
+	}
+	log := logger.WithMirror(l.provider.Name())
+	logDir := l.provider.LogDir()
+	current, _ := os.Readlink(filepath.Join(logDir, "latest"))
+
+	files, err := l.matchedLogs()
+	if err != nil {
+		log.WithError(err).Warning("failed to list logs")
+		return
+	}
+	pending := []string{}
+	for _, f := range files {
+		if f.Name() != current && !isCompressedLog(f.Name()) {
+			pending = append(pending, f.Name())
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	l.compressWG.Add(1)
+	go func() {
+		defer l.compressWG.Done()
+		l.compressMu.Lock()
+		defer l.compressMu.Unlock()
+		for _, name := range pending {
+			err := compressLog(filepath.Join(logDir, name), l.compression)
+			// removed by the retention of a later run, or compressed
+			// by an earlier batch
+			if err != nil && !os.IsNotExist(err) {
+				log.WithError(err).Warningf("failed to compress log %s", name)
+			}
+		}
+	}()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestProvider returns a command provider with its mirror and log
+// dirs in a temp dir
+func newTestProvider(t *testing.T, mirror mirrorConfig) mirrorProvider {
+	t.Helper()
+	dir := t.TempDir()
+	if mirror.Name == "" {
+		mirror.Name = "mirror"
+	}
+	if mirror.Provider == "" {
+		mirror.Provider = provCommand
+		mirror.Command = "true"
+	}
+	cfg := &Config{Global: globalConfig{
+		MirrorDir: filepath.Join(dir, "mirrors"),
+		LogDir:    filepath.Join(dir, "logs"),
+	}}
+	p, err := newMirrorProvider(mirror, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLogRetention(t *testing.T) {
+	// newest first
+	logs := []struct {
+		name string
+		age  time.Duration
+		size int
+	}{
+		{"mirror_2020-01-05_00_00.log", 1, 100},
+		{"mirror_2020-01-04_00_00.log.fail", 2, 100},
+		{"mirror_2020-01-03_00_00.log.gz", 3, 100},
+		{"mirror_2020-01-02_00_00.log.fail.zst", 10, 100},
+		{"mirror_2020-01-01_00_00.log", 40, 100},
+	}
+	// never touched, whatever the policy
+	others := []string{
+		"mirror2_2019-01-01_00_00.log",
+		"mirror_notes.txt",
+		"mirror_2019-01-01_00_00.log.bak",
+	}
+	all := func(names ...string) []string {
+		return append(names, others...)
+	}
+
+	tests := []struct {
+		name   string
+		mirror mirrorConfig
+		want   []string
+	}{
+		{"default count", mirrorConfig{}, all(
+			logs[0].name, logs[1].name, logs[2].name, logs[3].name, logs[4].name)},
+		// one place is kept for the log of the run about to start
+		{"count", mirrorConfig{LogRetainCount: 3}, all(logs[0].name, logs[1].name)},
+		{"count of one", mirrorConfig{LogRetainCount: 1}, all()},
+		{"age", mirrorConfig{LogRetainCount: 100, LogMaxAge: 7}, all(
+			logs[0].name, logs[1].name, logs[2].name)},
+		{"total size", mirrorConfig{LogRetainCount: 100, LogMaxTotalBytes: 250}, all(
+			logs[0].name, logs[1].name)},
+		{"count and age", mirrorConfig{LogRetainCount: 5, LogMaxAge: 30}, all(
+			logs[0].name, logs[1].name, logs[2].name, logs[3].name)},
+		{"all limits", mirrorConfig{LogRetainCount: 4, LogMaxAge: 30, LogMaxTotalBytes: 150}, all(
+			logs[0].name)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, tt.mirror)
+			logDir := p.LogDir()
+			if err := os.MkdirAll(logDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			for _, l := range logs {
+				path := filepath.Join(logDir, l.name)
+				if err := ioutil.WriteFile(path, make([]byte, l.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				mtime := now.Add(-l.age * 24 * time.Hour)
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			old := now.Add(-365 * 24 * time.Hour)
+			for _, name := range others {
+				path := filepath.Join(logDir, name)
+				ioutil.WriteFile(path, []byte("x"), 0644)
+				os.Chtimes(path, old, old)
+			}
+
+			var limiter *logLimiter
+			for _, h := range p.Hooks() {
+				if l, ok := h.(*logLimiter); ok {
+					limiter = l
+				}
+			}
+			if err := limiter.preExec(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.ExitContext()
+
+			// the log of the new run and the link to it
+			newLog := filepath.Base(p.LogFile())
+			if target, err := os.Readlink(filepath.Join(logDir, "latest")); err != nil || target != newLog {
+				t.Fatalf("latest links to %q, %v", target, err)
+			}
+			files, err := ioutil.ReadDir(logDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, f := range files {
+				if f.Name() != "latest" && f.Name() != newLog {
+					got = append(got, f.Name())
+				}
+			}
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("kept %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+type testFileInfo struct {
+	os.FileInfo
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (f testFileInfo) Name() string       { return f.name }
+func (f testFileInfo) Size() int64        { return f.size }
+func (f testFileInfo) ModTime() time.Time { return f.mtime }
+
+// older logs go once a newer one is over the budget, even if they'd
+// fit themselves
+func TestLogRetentionUnequalSizes(t *testing.T) {
+	now := time.Now()
+	var files []os.FileInfo
+	for i, size := range []int64{100, 300, 50, 50} {
+		files = append(files, testFileInfo{
+			name:  fmt.Sprintf("%d.log", i),
+			size:  size,
+			mtime: now.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	tests := []struct {
+		maxBytes int64
+		kept     int
+	}{
+		{250, 1},
+		{400, 2},
+		{500, 4},
+		{99, 0},
+	}
+	for _, tt := range tests {
+		r := logRetention{count: 100, maxBytes: tt.maxBytes}
+		expired := r.expired(files, now)
+		if len(expired) != len(files)-tt.kept {
+			t.Errorf("budget %d: expired %d logs, want %d", tt.maxBytes, len(expired), len(files)-tt.kept)
+			continue
+		}
+		// the oldest ones
+		for i, f := range expired {
+			if f.Name() != files[tt.kept+i].Name() {
+				t.Errorf("budget %d: expired %s", tt.maxBytes, f.Name())
+			}
+		}
+	}
+}
+
+func TestMatchedLogsNewestFirst(t *testing.T) {
+	p := newTestProvider(t, mirrorConfig{Name: "debian"})
+	logDir := p.LogDir()
+	os.MkdirAll(logDir, 0755)
+	now := time.Now()
+	names := []string{
+		"debian_2020-01-01_00_00.log",
+		"debian_2020-01-02_00_00.log.gz",
+		"debian-security_2020-01-03_00_00.log",
+		"debian_2020-01-04_00_00.log.fail",
+	}
+	for i, name := range names {
+		path := filepath.Join(logDir, name)
+		ioutil.WriteFile(path, nil, 0644)
+		mtime := now.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(path, mtime, mtime)
+	}
+	// a directory with a log's name
+	os.Mkdir(filepath.Join(logDir, "debian_2020-01-05_00_00.log"), 0755)
+
+	files, err := newLogLimiter(p, logRetention{}, logCompressNone).matchedLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range files {
+		got = append(got, f.Name())
+	}
+	want := []string{names[3], names[1], names[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
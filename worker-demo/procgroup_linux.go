@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// groupRunning reports whether a process of the group is in any
+// state but zombie, it errs on the side of running if /proc can't
+// be read
+func groupRunning(pgid int) bool {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil || len(stats) == 0 {
+		return true
+	}
+	for _, path := range stats {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			// exited meanwhile
+			continue
+		}
+		// the command may contain spaces and parentheses,
+		// the fields after the last ')' are state, ppid and pgrp
+		i := bytes.LastIndexByte(b, ')')
+		if i < 0 {
+			continue
+		}
+		fields := bytes.Fields(b[i+1:])
+		if len(fields) < 3 {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(string(fields[2])); pgrp == pgid && string(fields[0]) != "Z" {
+			return true
+		}
+	}
+	return false
+}
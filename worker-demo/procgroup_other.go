@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// groupRunning can't tell zombies apart without /proc
+func groupRunning(pgid int) bool {
+	return true
+}
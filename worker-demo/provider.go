@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mirror provider is the wrapper of mirror jobs
+
+const (
+	provRsync         = "rsync"
+	provTwoStageRsync = "two-stage-rsync"
+	provCommand       = "command"
+	provHTTP          = "http"
+	provGit           = "git"
+
+	_WorkingDirKey = "working_dir"
+	_LogDirKey     = "log_dir"
+	_LogFileKey    = "log_file"
+
+	defaultMaxRetry = 2
+	// in minutes
+	defaultInterval = 1440
+)
+
+var errProviderRunning = errors.New("provider is currently running")
+
+// A mirrorProvider instance
+type mirrorProvider interface {
+	// name
+	Name() string
+	Upstream() string
+	Type() string
+
+	// Start then Wait
+	Run() error
+	// Start the job
+	Start() error
+	// Wait job to finish
+	Wait() error
+	// terminate mirror job
+	Terminate() error
+	// whether the job is running
+	IsRunning() bool
+	// data size reported by the last successful run, "" if unknown
+	DataSize() string
+
+	// job hooks
+	AddHook(hook jobHook)
+	Hooks() []jobHook
+
+	Interval() time.Duration
+	Retry() int
+
+	WorkingDir() string
+	LogDir() string
+	LogFile() string
+	Backend() execBackend
+
+	// enter context
+	EnterContext() *Context
+	// exit context
+	ExitContext() *Context
+	// return context
+	Context() *Context
+}
+
+// mirrorLogDir returns the log dir of mirror
+func mirrorLogDir(mirror mirrorConfig, cfg *Config) string {
+	if mirror.LogDir != "" {
+		return mirror.LogDir
+	}
+	return filepath.Join(cfg.Global.LogDir, mirror.Name)
+}
+
+// newMirrorProvider creates a mirrorProvider instance
+// using a mirrorCfg and the global cfg
+func newMirrorProvider(mirror mirrorConfig, cfg *Config) (mirrorProvider, error) {
+	mirrorDir := mirror.MirrorDir
+	if mirrorDir == "" {
+		mirrorDir = filepath.Join(cfg.Global.MirrorDir, mirror.Name)
+	}
+	logDir := mirrorLogDir(mirror, cfg)
+	if mirror.Interval == 0 {
+		mirror.Interval = cfg.Global.Interval
+	}
+	if mirror.Interval == 0 {
+		mirror.Interval = defaultInterval
+	}
+	if mirror.Retry == 0 {
+		mirror.Retry = cfg.Global.Retry
+	}
+	if mirror.Retry == 0 {
+		mirror.Retry = defaultMaxRetry
+	}
+
+	backend, err := newExecBackend(mirror, mirrorDir, logDir)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := newSandbox(mirror)
+	if err != nil {
+		return nil, fmt.Errorf("mirror %s: %s", mirror.Name, err.Error())
+	}
+	if _, native := backend.(*nativeBackend); sb != nil && !native {
+		return nil, fmt.Errorf("mirror %s: %s", mirror.Name, errSandboxInContainer.Error())
+	}
+	base := newBaseProvider(mirror, mirrorDir, logDir, backend, sb)
+
+	var provider mirrorProvider
+	switch mirror.Provider {
+	case provRsync:
+		provider, err = newRsyncProvider(base, mirror)
+	case provTwoStageRsync:
+		provider, err = newTwoStageRsyncProvider(base, mirror)
+	case provCommand:
+		provider, err = newCmdProvider(base, mirror)
+	case provHTTP:
+		provider, err = newHTTPProvider(base, mirror)
+	case provGit:
+		provider, err = newGitProvider(base, mirror)
+	default:
+		err = fmt.Errorf("unknown provider %q", mirror.Provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mirror %s: %s", mirror.Name, err.Error())
+	}
+
+	// add logging hook
+	compression, err := parseLogCompression(mirror.LogCompression)
+	if err != nil {
+		return nil, fmt.Errorf("mirror %s: %s", mirror.Name, err.Error())
+	}
+	provider.AddHook(newLogLimiter(provider, newLogRetention(mirror), compression))
+
+	// check the upstream before the log of the run is created
+	hc, err := newHealthChecker(provider, mirror)
+	if err != nil {
+		return nil, err
+	}
+	if hc != nil {
+		provider.AddHook(hc)
+	}
+
+	return provider, nil
+}
+
+// baseProvider is the base mixin of providers
+type baseProvider struct {
+	sync.Mutex
+
+	ctx      *Context
+	name     string
+	upstream string
+	interval time.Duration
+	retry    int
+	// mirror's env, passed to every command
+	env map[string]string
+
+	cmd     *cmdJob
+	backend execBackend
+	sandbox *sandbox
+
+	isRunning atomic.Bool
+	dataSize  atomic.Value
+
+	hooks []jobHook
+}
+
+func newBaseProvider(mirror mirrorConfig, mirrorDir, logDir string, backend execBackend, sb *sandbox) *baseProvider {
+	p := &baseProvider{
+		ctx:      NewContext(),
+		name:     mirror.Name,
+		upstream: mirror.Upstream,
+		interval: time.Duration(mirror.Interval) * time.Minute,
+		retry:    mirror.Retry,
+		env:      mirror.Env,
+		backend:  backend,
+		sandbox:  sb,
+	}
+	p.ctx.Set(_WorkingDirKey, mirrorDir)
+	p.ctx.Set(_LogDirKey, logDir)
+	p.ctx.Set(_LogFileKey, filepath.Join(logDir, "latest.log"))
+	p.dataSize.Store("")
+	return p
+}
+
+func (p *baseProvider) Name() string {
+	return p.name
+}
+
+func (p *baseProvider) Upstream() string {
+	return p.upstream
+}
+
+func (p *baseProvider) EnterContext() *Context {
+	p.ctx = p.ctx.Enter()
+	return p.ctx
+}
+
+func (p *baseProvider) ExitContext() *Context {
+	p.ctx = p.ctx.Exit()
+	return p.ctx
+}
+
+func (p *baseProvider) Context() *Context {
+	return p.ctx
+}
+
+func (p *baseProvider) Interval() time.Duration {
+	return p.interval
+}
+
+func (p *baseProvider) Retry() int {
+	return p.retry
+}
+
+func (p *baseProvider) WorkingDir() string {
+	if v, ok := p.ctx.Get(_WorkingDirKey); ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	panic("working dir is impossible to be non-exist")
+}
+
+func (p *baseProvider) LogDir() string {
+	if v, ok := p.ctx.Get(_LogDirKey); ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	panic("log dir is impossible to be unavailable")
+}
+
+func (p *baseProvider) LogFile() string {
+	if v, ok := p.ctx.Get(_LogFileKey); ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	panic("log file is impossible to be unavailable")
+}
+
+func (p *baseProvider) Backend() execBackend {
+	return p.backend
+}
+
+func (p *baseProvider) AddHook(hook jobHook) {
+	p.hooks = append(p.hooks, hook)
+}
+
+func (p *baseProvider) Hooks() []jobHook {
+	return p.hooks
+}
+
+func (p *baseProvider) DataSize() string {
+	return p.dataSize.Load().(string)
+}
+
+func (p *baseProvider) IsRunning() bool {
+	return p.isRunning.Load()
+}
+
+// startCmd runs cmdAndArgs in the working dir with the mirror's
+// backend and limits, env is added to the mirror's env.
+// the caller holds the lock
+func (p *baseProvider) startCmd(provider mirrorProvider, cmdAndArgs []string, env map[string]string) error {
+	if p.IsRunning() {
+		return errProviderRunning
+	}
+	merged := make(map[string]string, len(p.env)+len(env))
+	for k, v := range p.env {
+		merged[k] = v
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	cmd := newCmdJob(provider, cmdAndArgs, p.WorkingDir(), merged)
+	if err := cmd.SetSandbox(p.sandbox); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	p.isRunning.Store(true)
+	return nil
+}
+
+func (p *baseProvider) Wait() error {
+	defer func() {
+		p.Lock()
+		p.isRunning.Store(false)
+		p.Unlock()
+	}()
+	return p.cmd.Wait()
+}
+
+func (p *baseProvider) Terminate() error {
+	p.Lock()
+	defer p.Unlock()
+	logger.WithMirror(p.Name()).Debug("terminating provider")
+	if !p.IsRunning() {
+		return nil
+	}
+	return p.cmd.Terminate()
+}
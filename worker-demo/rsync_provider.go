@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultRsyncTimeout = 120
+
+// rsyncDeleteOptions maps delete_mode to rsync's options
+var rsyncDeleteOptions = map[string][]string{
+	"":       {"--delete", "--delete-after"},
+	"after":  {"--delete", "--delete-after"},
+	"delay":  {"--delete", "--delete-delay"},
+	"during": {"--delete", "--delete-during"},
+	"none":   nil,
+}
+
+type rsyncProvider struct {
+	*baseProvider
+	rsyncCmd string
+	username string
+	password string
+	options  []string
+	stats    rsyncStats
+}
+
+func newRsyncProvider(base *baseProvider, mirror mirrorConfig) (*rsyncProvider, error) {
+	if !strings.HasSuffix(mirror.Upstream, "/") {
+		return nil, errors.New("rsync upstream URL should ends with /")
+	}
+	if mirror.UseIPv4 && mirror.UseIPv6 {
+		return nil, errors.New("use_ipv4 and use_ipv6 are exclusive")
+	}
+	p := &rsyncProvider{
+		baseProvider: base,
+		rsyncCmd:     mirror.RsyncCmd,
+		username:     mirror.Username,
+		password:     mirror.Password,
+	}
+	if p.rsyncCmd == "" {
+		p.rsyncCmd = "rsync"
+	}
+	options, err := rsyncOptions(mirror)
+	if err != nil {
+		return nil, err
+	}
+	p.options = options
+	return p, nil
+}
+
+// rsyncOptions builds the options of a single stage sync
+func rsyncOptions(mirror mirrorConfig) ([]string, error) {
+	deleteOptions, ok := rsyncDeleteOptions[mirror.DeleteMode]
+	if !ok {
+		return nil, fmt.Errorf("unknown delete mode %q", mirror.DeleteMode)
+	}
+	options, err := rsyncCommonOptions(mirror)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, "--delay-updates")
+	options = append(options, deleteOptions...)
+	// user options come last so they can override the defaults
+	options = append(options, mirror.RsyncOptions...)
+	return options, nil
+}
+
+// rsyncCommonOptions builds the options shared by every rsync run
+func rsyncCommonOptions(mirror mirrorConfig) ([]string, error) {
+	if mirror.BandwidthLimit < 0 || mirror.RsyncTimeout < 0 {
+		return nil, errors.New("bwlimit and rsync_timeout must not be negative")
+	}
+
+	// --stats prints the summary parsed into rsyncStats
+	options := []string{
+		"-aHv", "--no-o", "--no-g", "--stats",
+		"--exclude", ".~tmp~/",
+		"--safe-links",
+	}
+
+	timeout := mirror.RsyncTimeout
+	if timeout == 0 {
+		timeout = defaultRsyncTimeout
+	}
+	options = append(options, "--timeout="+strconv.Itoa(timeout))
+	if mirror.BandwidthLimit > 0 {
+		options = append(options, "--bwlimit="+strconv.Itoa(mirror.BandwidthLimit))
+	}
+	if mirror.UseIPv4 {
+		options = append(options, "-4")
+	} else if mirror.UseIPv6 {
+		options = append(options, "-6")
+	}
+	for _, pattern := range mirror.Exclude {
+		options = append(options, "--exclude", pattern)
+	}
+	if mirror.ExcludeFile != "" {
+		options = append(options, "--exclude-from", mirror.ExcludeFile)
+	}
+	return options, nil
+}
+
+// rsyncEnv passes the credentials without putting them on the
+// command line
+func rsyncEnv(username, password string) map[string]string {
+	env := map[string]string{}
+	if username != "" {
+		env["USER"] = username
+	}
+	if password != "" {
+		env["RSYNC_PASSWORD"] = password
+	}
+	return env
+}
+
+func (p *rsyncProvider) Type() string {
+	return provRsync
+}
+
+// Stats returns the transfer statistics of the last successful run
+func (p *rsyncProvider) Stats() rsyncStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
+
+func (p *rsyncProvider) Run() error {
+	p.dataSize.Store("")
+	if err := p.Start(); err != nil {
+		return err
+	}
+	if err := p.Wait(); err != nil {
+		return err
+	}
+
+	stats, err := p.loadRsyncStats()
+	if err != nil {
+		logger.WithMirror(p.Name()).WithError(err).Warning("failed to parse rsync stats")
+		return nil
+	}
+	p.Lock()
+	p.stats = stats
+	p.Unlock()
+	return nil
+}
+
+func (p *rsyncProvider) Start() error {
+	p.Lock()
+	defer p.Unlock()
+
+	command := []string{p.rsyncCmd}
+	command = append(command, p.options...)
+	command = append(command, p.upstream, p.WorkingDir())
+	return p.startCmd(p, command, rsyncEnv(p.username, p.password))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parse the summary printed by rsync --stats:
+//
+//	Number of files: 4,123 (reg: 3,000, dir: 1,123)
+//	Number of regular files transferred: 12
+//	Total file size: 1,234,567 bytes
+//	Total transferred file size: 12,345 bytes
+
+// the summary is at the end of the log, followed by a few lines
+const rsyncStatsTail = 8192
+
+var errNoRsyncStats = errors.New("no rsync stats found")
+
+type rsyncStats struct {
+	// number of files, directories and links on the sender
+	Files            int64
+	FilesTransferred int64
+	FilesCreated     int64
+	FilesDeleted     int64
+	// size of all files on the sender in bytes
+	TotalSize int64
+	// size of the transferred files in bytes
+	BytesTransferred int64
+	BytesSent        int64
+	BytesReceived    int64
+}
+
+// loadRsyncStats parses the stats of the current log and reports
+// the total size as the mirror's size
+func (p *baseProvider) loadRsyncStats() (rsyncStats, error) {
+	stats, err := parseRsyncStatsFile(p.LogFile())
+	if err != nil {
+		return stats, err
+	}
+	p.dataSize.Store(formatSize(stats.TotalSize))
+	logger.WithMirror(p.Name()).WithFields(logFields{
+		"files":             stats.Files,
+		"files_transferred": stats.FilesTransferred,
+		"bytes_transferred": stats.BytesTransferred,
+		"total_size":        stats.TotalSize,
+	}).Info("rsync stats")
+	return stats, nil
+}
+
+func parseRsyncStatsFile(logPath string) (rsyncStats, error) {
+	return parseRsyncStats(bytes.NewReader(readLogTail(logPath, rsyncStatsTail)))
+}
+
+// readLogTail returns up to the last n bytes of a log,
+// nil if it can't be read
+func readLogTail(logPath string, n int64) []byte {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > n {
+		f.Seek(-n, io.SeekEnd)
+	}
+	b, _ := io.ReadAll(io.LimitReader(f, n))
+	return b
+}
+
+func parseRsyncStats(r io.Reader) (rsyncStats, error) {
+	var s rsyncStats
+	fields := map[string]*int64{
+		"Number of files": &s.Files,
+		// before rsync 3.1
+		"Number of files transferred":         &s.FilesTransferred,
+		"Number of regular files transferred": &s.FilesTransferred,
+		"Number of created files":             &s.FilesCreated,
+		"Number of deleted files":             &s.FilesDeleted,
+		"Total file size":                     &s.TotalSize,
+		"Total transferred file size":         &s.BytesTransferred,
+		"Total bytes sent":                    &s.BytesSent,
+		"Total bytes received":                &s.BytesReceived,
+	}
+
+	found := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+		// drop the unit and details, e.g. "(reg: 3,000, dir: 1,123)"
+		value, _, _ = strings.Cut(strings.TrimSpace(value), " ")
+		n, err := parseRsyncNumber(value)
+		if err != nil {
+			return s, fmt.Errorf("%s: %s", key, err.Error())
+		}
+		*field = n
+		if field == &s.TotalSize {
+			found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s, err
+	}
+	if !found {
+		return s, errNoRsyncStats
+	}
+	return s, nil
+}
+
+// parseRsyncNumber accepts plain and digit grouped numbers, and the
+// K/M/G/T/P units printed with -h. rsync 3.1 and later follow the
+// locale, which may group with dots and use a decimal comma.
+func parseRsyncNumber(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty number")
+	}
+	unit := strings.IndexByte("KMGTP", s[len(s)-1])
+	if unit < 0 {
+		s = strings.NewReplacer(",", "", ".", "").Replace(s)
+		return strconv.ParseInt(s, 10, 64)
+	}
+	s = s[:len(s)-1]
+	if !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	f, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", ""), 64)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i <= unit; i++ {
+		f *= 1000
+	}
+	return int64(math.Round(f)), nil
+}
+
+// formatSize prints a size in bytes the way the manager displays it,
+// e.g. 1.33T
+func formatSize(size int64) string {
+	const units = "KMGTP"
+	if size < 1024 {
+		return strconv.FormatInt(size, 10) + "B"
+	}
+	f := float64(size)
+	unit := -1
+	for f >= 1024 && unit < len(units)-1 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%c", f, units[unit])
+}
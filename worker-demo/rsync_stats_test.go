@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the end of the output of rsync -av --stats
+const (
+	// rsync 3.0 prints plain numbers
+	rsyncStats30 = `debian/pool/main/z/zsh/zsh_5.9-4_amd64.deb
+
+Number of files: 1234567
+Number of files transferred: 42
+Total file size: 3298534883328 bytes
+Total transferred file size: 7340032 bytes
+Literal data: 7340032 bytes
+Matched data: 0 bytes
+File list size: 28765432
+File list generation time: 12.345 seconds
+File list transfer time: 0.000 seconds
+Total bytes sent: 987654
+Total bytes received: 36123456
+
+sent 987654 bytes  received 36123456 bytes  123456.78 bytes/sec
+total size is 3298534883328  speedup is 88812.53
+`
+	// rsync 3.1 and 3.2 group digits and detail the file types
+	rsyncStats31 = `debian/dists/sid/InRelease
+deleting debian/pool/main/z/zsh/zsh_5.9-3_amd64.deb
+
+Number of files: 1,234,567 (reg: 1,100,000, dir: 134,000, link: 567)
+Number of created files: 40 (reg: 38, dir: 2)
+Number of deleted files: 3 (reg: 3)
+Number of regular files transferred: 42
+Total file size: 3,298,534,883,328 bytes
+Total transferred file size: 7,340,032 bytes
+Literal data: 7,340,032 bytes
+Matched data: 0 bytes
+File list size: 28,765,432
+File list generation time: 12.345 seconds
+File list transfer time: 0.000 seconds
+Total bytes sent: 987,654
+Total bytes received: 36,123,456
+
+sent 987,654 bytes  received 36,123,456 bytes  123,456.78 bytes/sec
+total size is 3,298,534,883,328  speedup is 88,812.53
+`
+	// with -h, powers of 1000
+	rsyncStats32Human = `
+Number of files: 1.23M (reg: 1.10M, dir: 134.00K, link: 567)
+Number of created files: 40 (reg: 38, dir: 2)
+Number of deleted files: 3 (reg: 3)
+Number of regular files transferred: 42
+Total file size: 3.30T bytes
+Total transferred file size: 7.34M bytes
+Literal data: 7.34M bytes
+Matched data: 0 bytes
+File list size: 28.77M
+File list generation time: 12.345 seconds
+File list transfer time: 0.000 seconds
+Total bytes sent: 987.65K
+Total bytes received: 36.12M
+
+sent 987.65K bytes  received 36.12M bytes  123.46K bytes/sec
+total size is 3.30T  speedup is 88,812.53
+`
+	// in a de_DE locale
+	rsyncStats32German = `
+Number of files: 1.234.567 (reg: 1.100.000, dir: 134.000, link: 567)
+Number of created files: 40 (reg: 38, dir: 2)
+Number of deleted files: 3 (reg: 3)
+Number of regular files transferred: 42
+Total file size: 3.298.534.883.328 bytes
+Total transferred file size: 7,34M bytes
+Literal data: 7.340.032 bytes
+Matched data: 0 bytes
+File list size: 28.765.432
+Total bytes sent: 987.654
+Total bytes received: 36.123.456
+`
+)
+
+func TestParseRsyncStats(t *testing.T) {
+	full := rsyncStats{
+		Files:            1234567,
+		FilesTransferred: 42,
+		FilesCreated:     40,
+		FilesDeleted:     3,
+		TotalSize:        3298534883328,
+		BytesTransferred: 7340032,
+		BytesSent:        987654,
+		BytesReceived:    36123456,
+	}
+	rsync30 := full
+	// not reported before 3.1
+	rsync30.FilesCreated, rsync30.FilesDeleted = 0, 0
+
+	tests := []struct {
+		name string
+		in   string
+		want rsyncStats
+	}{
+		{"rsync 3.0", rsyncStats30, rsync30},
+		{"rsync 3.1", rsyncStats31, full},
+		{"rsync 3.2 -h", rsyncStats32Human, rsyncStats{
+			Files:            1230000,
+			FilesTransferred: 42,
+			FilesCreated:     40,
+			FilesDeleted:     3,
+			TotalSize:        3300000000000,
+			BytesTransferred: 7340000,
+			BytesSent:        987650,
+			BytesReceived:    36120000,
+		}},
+		{"de_DE locale", rsyncStats32German, rsyncStats{
+			Files:            1234567,
+			FilesTransferred: 42,
+			FilesCreated:     40,
+			FilesDeleted:     3,
+			TotalSize:        3298534883328,
+			BytesTransferred: 7340000,
+			BytesSent:        987654,
+			BytesReceived:    36123456,
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseRsyncStats(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRsyncStatsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"no stats", "sending incremental file list\nrsync error: timeout (code 30)\n"},
+		{"interrupted", "Number of files: 1,234 (reg: 1,000, dir: 234)\nNumber of regular files transferred: 1\n"},
+		{"garbled", "Total file size: lots bytes\n"},
+	}
+	for _, tt := range tests {
+		if _, err := parseRsyncStats(strings.NewReader(tt.in)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+	if _, err := parseRsyncStats(strings.NewReader(tests[0].in)); err != errNoRsyncStats {
+		t.Errorf("got %v, want errNoRsyncStats", err)
+	}
+}
+
+func TestParseRsyncNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"1234567", 1234567, false},
+		{"1,234,567", 1234567, false},
+		{"1.234.567", 1234567, false},
+		{"999", 999, false},
+		{"1.50K", 1500, false},
+		{"1,50K", 1500, false},
+		{"3.30T", 3300000000000, false},
+		{"1.13P", 1130000000000000, false},
+		{"12M", 12000000, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"12X", 0, true},
+		{"-", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRsyncNumber(tt.in)
+		if tt.err != (err != nil) {
+			t.Errorf("parseRsyncNumber(%q) error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRsyncNumber(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseRsyncStatsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rsync.log")
+	// a long transfer list before the summary, more than is read
+	log := strings.Repeat("debian/pool/main/a/apt/apt_2.7.14_amd64.deb\n", 1000) + rsyncStats31
+	if err := ioutil.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if len(log) <= rsyncStatsTail {
+		t.Fatal("log shorter than the tail")
+	}
+	s, err := parseRsyncStatsFile(path)
+	if err != nil || s.TotalSize != 3298534883328 {
+		t.Fatalf("got %+v, %v", s, err)
+	}
+	if _, err := parseRsyncStatsFile(filepath.Join(t.TempDir(), "missing.log")); err != errNoRsyncStats {
+		t.Fatalf("missing log: %v", err)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.00K"},
+		{1536, "1.50K"},
+		{7340032, "7.00M"},
+		{3298534883328, "3.00T"},
+		{1 << 60, "1024.00P"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.in); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -6,8 +6,6 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
-	"syscall"
-	"time"
 )
 
 // runner is to run os commands giving command line, env and log file
@@ -23,16 +21,74 @@ type cmdJob struct {
 	logFile    *os.File
 	finished   chan empty
 	provider   mirrorProvider
+	backend    execBackend
+	sandbox    *sandbox
 	retErr     error
 }
 
 func newCmdJob(provider mirrorProvider, cmdAndArgs []string, workingDir string, env map[string]string) *cmdJob {
+	log := logger.WithMirror(provider.Name())
+
+	log.Debugf("Executing command %s at %s", cmdAndArgs[0], workingDir)
+	if _, err := os.Stat(workingDir); os.IsNotExist(err) {
+		log.Debugf("Making dir %s", workingDir)
+		if err = os.MkdirAll(workingDir, 0755); err != nil {
+			log.WithError(err).Errorf("Error making dir %s", workingDir)
+		}
+	}
+	backend := provider.Backend()
+
+	return &cmdJob{
+		cmd:        backend.command(cmdAndArgs, workingDir, env),
+		workingDir: workingDir,
+		env:        env,
+		provider:   provider,
+		backend:    backend,
+	}
+}
+
+// SetLogFile redirects both stdout and stderr to logFile,
+// which is closed once the command exits
+func (c *cmdJob) SetLogFile(logFile *os.File) {
+	c.logFile = logFile
+	c.cmd.Stdout = logFile
+	c.cmd.Stderr = logFile
+}
+
+// SetSandbox applies the mirror's limits, it must be called
+// before Start. newMirrorProvider only allows a sandbox with the
+// native backend. The working dir is handed to the user the command
+// runs as, so that it can write the mirror.
+func (c *cmdJob) SetSandbox(s *sandbox) error {
+	if s == nil {
+		return nil
+	}
+	if err := s.apply(c.cmd); err != nil {
+		return err
+	}
+	if cred := s.credential; cred != nil {
+		if err := os.Chown(c.workingDir, int(cred.Uid), int(cred.Gid)); err != nil {
+			return err
+		}
+	}
+	c.sandbox = s
 	return nil
 }
 
 func (c *cmdJob) Start() error {
+	if c.logFile == nil {
+		logFile, err := os.OpenFile(c.provider.LogFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		c.SetLogFile(logFile)
+	}
 	c.finished = make(chan empty, 1)
-	return c.cmd.Start()
+	if err := c.cmd.Start(); err != nil {
+		c.logFile.Close()
+		return err
+	}
+	return nil
 }
 
 func (c *cmdJob) Wait() error {
@@ -44,8 +100,13 @@ func (c *cmdJob) Wait() error {
 		return c.retErr
 	default:
 		err := c.cmd.Wait()
-		if c.cmd.Stdout != nil {
-			c.cmd.Stdout.(*os.File).Close()
+		var logPath string
+		if c.logFile != nil {
+			logPath = c.logFile.Name()
+			c.logFile.Close()
+		}
+		if c.sandbox != nil && err != nil {
+			err = c.sandbox.classify(c.cmd.ProcessState, err, readLogTail(logPath, sandboxLogTail))
 		}
 		c.retErr = err
 		close(c.finished)
@@ -58,25 +119,7 @@ func (c *cmdJob) Terminate() error {
 		return errProcessNotStarted
 	}
 
-	if d := c.provider.Docker(); d != nil {
-		sh.Command(
-			"docker", "stop", "-t", "2", d.Name(),
-		).Run()
-		return nil
-	}
-
-	err := unix.Kill(c.cmd.Process.Pid, syscall.SIGTERM)
-	if err != nil {
-		return err
-	}
-
-	select {
-	case <-time.After(2 * time.Second):
-		unix.Kill(c.cmd.Process.Pid, syscall.SIGKILL)
-		return errors.New("SIGTERM failed to kill the job")
-	case <-c.finished:
-		return nil
-	}
+	return c.backend.terminate(c)
 }
 
 func newEnviron(env map[string]string, inherit bool) []string {
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startScript runs script with sh in a temp dir, the script touches
+// "ready" once its children are started and may write their pids to
+// "pids". Wait is called in background, its error is sent on the
+// returned channel.
+func startScript(t *testing.T, script string) (*cmdJob, string, chan error) {
+	t.Helper()
+	dir := t.TempDir()
+	p := newTestProvider(t, mirrorConfig{})
+	c := newCmdJob(p, []string{"sh", "-c", script}, dir, nil)
+	logFile, err := os.Create(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetLogFile(logFile)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	t.Cleanup(func() {
+		syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+		<-c.finished
+	})
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "ready")); err == nil {
+			break
+		}
+		if i == 500 {
+			t.Fatal("script didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c, dir, done
+}
+
+// alive reports whether pid exists and isn't a zombie
+func alive(pid int) bool {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	i := strings.LastIndexByte(string(b), ')')
+	return i < 0 || !strings.HasPrefix(string(b[i+1:]), " Z")
+}
+
+func readPids(t *testing.T, dir string) []int {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pids := []int{}
+	for _, f := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func TestTerminateKillsChildren(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		// whether terminate has to fall back to SIGKILL
+		killed bool
+	}{
+		{"children", `sleep 100 & echo $! >> pids
+sleep 100 & echo $! >> pids
+touch ready
+wait`, false},
+		// the subshell keeps running after the leader is gone
+		{"child ignoring SIGTERM", `(trap '' TERM; while :; do sleep 0.1; done) & echo $! >> pids
+touch ready
+wait`, true},
+		{"leader ignoring SIGTERM", `trap '' TERM
+sleep 100 & echo $! >> pids
+touch ready
+while :; do sleep 0.1; done`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir, done := startScript(t, tt.script)
+			pids := readPids(t, dir)
+
+			start := time.Now()
+			err := c.Terminate()
+			if tt.killed != (err != nil) {
+				t.Fatalf("Terminate: %v", err)
+			}
+			if tt.killed && time.Since(start) < terminateTimeout {
+				t.Fatalf("killed after %s, before the grace period", time.Since(start))
+			}
+			if !tt.killed && time.Since(start) >= terminateTimeout {
+				t.Fatalf("took %s", time.Since(start))
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Wait didn't return")
+			}
+
+			// SIGKILL is delivered asynchronously
+			deadline := time.Now().Add(time.Second)
+			for _, pid := range pids {
+				for alive(pid) {
+					if time.Now().After(deadline) {
+						t.Fatalf("child %d survived", pid)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if groupAlive(-c.cmd.Process.Pid) {
+				t.Fatal("process group still alive")
+			}
+		})
+	}
+}
+
+func TestTerminateNotStarted(t *testing.T) {
+	c := newCmdJob(newTestProvider(t, mirrorConfig{}), []string{"true"}, t.TempDir(), nil)
+	if err := c.Terminate(); err != errProcessNotStarted {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestGroupAlive(t *testing.T) {
+	if !groupAlive(-syscall.Getpgrp()) {
+		t.Fatal("own group reported gone")
+	}
+
+	// the leader is reaped by Wait, the child exits on its own and
+	// may be left a zombie if nobody reaps orphans
+	c, dir, _ := startScript(t, `sleep 0.1 & echo $! >> pids; touch ready; exit 0`)
+	pids := readPids(t, dir)
+	<-c.finished
+	time.Sleep(300 * time.Millisecond)
+	if alive(pids[0]) {
+		t.Fatalf("child %d still running", pids[0])
+	}
+	if groupAlive(-c.cmd.Process.Pid) {
+		t.Fatal("a group of zombies or nothing reported alive")
+	}
+}
+
+// a group id reused by processes of another user can't be waited for
+func TestGroupAliveOtherUser(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root may signal every group")
+	}
+	pgid, err := syscall.Getpgid(1)
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := syscall.Kill(-pgid, 0); err != syscall.EPERM {
+		t.Skipf("kill: %v", err)
+	}
+	if groupAlive(-pgid) {
+		t.Fatal("group of another user reported alive")
+	}
+}
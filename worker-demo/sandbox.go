@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// limit the resources and privileges of a sync command.
+// rlimits and priorities are applied by prlimit(1), nice(1) and
+// ionice(1) from util-linux, exec'ed in front of the command so
+// that they are in place before it can fork
+
+var (
+	errCPULimitExceeded       = errors.New("cpu time limit exceeded")
+	errAddrSpaceLimitExceeded = errors.New("address space limit exceeded")
+	errOpenFilesLimitExceeded = errors.New("open files limit exceeded")
+	errSandboxUnsupported     = errors.New("sandboxing not supported on this platform")
+)
+
+// signals a command dies of when an allocation fails under the
+// address space limit: a failed stack growth, a fault in a mapping
+// that couldn't be made, or abort() by the allocator or runtime
+var addrSpaceSignals = map[syscall.Signal]bool{
+	syscall.SIGSEGV: true,
+	syscall.SIGBUS:  true,
+	syscall.SIGABRT: true,
+}
+
+// what commands log when a call fails under the address space
+// limit: ENOMEM, rsync's exit 22 and the usual out of memory errors
+var addrSpaceMessages = []string{
+	"Cannot allocate memory",
+	"error allocating core memory buffers",
+	"out of memory",
+}
+
+// EMFILE
+var openFilesMessages = []string{
+	"Too many open files",
+}
+
+// bytes of the log searched for the messages
+const sandboxLogTail = 16 << 10
+
+var ioniceClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+type sandbox struct {
+	cpuTime   time.Duration
+	addrSpace int64
+	openFiles int
+
+	nice        int
+	ioniceClass string
+	ioniceLevel int
+
+	// nil if not switching user
+	credential *syscall.Credential
+
+	privateMount   bool
+	privateNetwork bool
+}
+
+// newSandbox returns nil if the mirror has no limits configured
+func newSandbox(mirror mirrorConfig) (*sandbox, error) {
+	s := &sandbox{
+		cpuTime:        time.Duration(mirror.RLimitCPU) * time.Second,
+		addrSpace:      mirror.RLimitAS,
+		openFiles:      mirror.RLimitNOFILE,
+		nice:           mirror.Nice,
+		ioniceLevel:    mirror.IONiceLevel,
+		privateMount:   mirror.PrivateMount,
+		privateNetwork: mirror.PrivateNetwork,
+	}
+	if s.cpuTime < 0 || s.addrSpace < 0 || s.openFiles < 0 {
+		return nil, errors.New("rlimits must not be negative")
+	}
+	if s.nice < -20 || s.nice > 19 {
+		return nil, fmt.Errorf("invalid nice value %d", s.nice)
+	}
+	if mirror.IONiceClass != "" {
+		class, ok := ioniceClasses[mirror.IONiceClass]
+		if !ok {
+			return nil, fmt.Errorf("invalid ionice class %q", mirror.IONiceClass)
+		}
+		s.ioniceClass = class
+	}
+	if s.ioniceLevel < 0 || s.ioniceLevel > 7 {
+		return nil, fmt.Errorf("invalid ionice level %d", s.ioniceLevel)
+	}
+
+	if mirror.RunAsUser != "" || mirror.RunAsGroup != "" {
+		cred, err := lookupCredential(mirror.RunAsUser, mirror.RunAsGroup)
+		if err != nil {
+			return nil, err
+		}
+		// the wrappers run after the switch, so raising
+		// priorities is no longer permitted
+		if s.nice < 0 || mirror.IONiceClass == "realtime" {
+			return nil, errors.New("negative nice and realtime ionice need the worker's privileges, not allowed with run_as_user")
+		}
+		s.credential = cred
+	}
+
+	if *s == (sandbox{}) {
+		return nil, nil
+	}
+	for _, bin := range s.wrappers() {
+		if _, err := exec.LookPath(bin); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// lookupCredential resolves names or numeric ids, the group
+// defaults to the user's primary group
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+		// Groups is left empty to drop the worker's
+		// supplementary groups
+	}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %s", userName)
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %s", groupName)
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		cred.Gid = uint32(gid)
+	}
+	return cred, nil
+}
+
+// wrappers lists the commands exec'ed before the sync command
+func (s *sandbox) wrappers() []string {
+	var bins []string
+	if s.cpuTime > 0 || s.addrSpace > 0 || s.openFiles > 0 {
+		bins = append(bins, "prlimit")
+	}
+	if s.nice != 0 {
+		bins = append(bins, "nice")
+	}
+	if s.ioniceClass != "" {
+		bins = append(bins, "ionice")
+	}
+	return bins
+}
+
+// wrap prefixes cmdAndArgs with the wrappers
+func (s *sandbox) wrap(cmdAndArgs []string) []string {
+	var args []string
+	if s.cpuTime > 0 || s.addrSpace > 0 || s.openFiles > 0 {
+		args = append(args, "prlimit")
+		if s.cpuTime > 0 {
+			// soft limit raises SIGXCPU, the hard one SIGKILL
+			// a few seconds later
+			soft := int64(s.cpuTime / time.Second)
+			args = append(args, fmt.Sprintf("--cpu=%d:%d", soft, soft+5))
+		}
+		if s.addrSpace > 0 {
+			args = append(args, fmt.Sprintf("--as=%d", s.addrSpace))
+		}
+		if s.openFiles > 0 {
+			args = append(args, fmt.Sprintf("--nofile=%d", s.openFiles))
+		}
+		args = append(args, "--")
+	}
+	if s.nice != 0 {
+		args = append(args, "nice", "-n", strconv.Itoa(s.nice), "--")
+	}
+	if s.ioniceClass != "" {
+		args = append(args, "ionice", "-c", s.ioniceClass)
+		if s.ioniceClass != "3" {
+			args = append(args, "-n", strconv.Itoa(s.ioniceLevel))
+		}
+		args = append(args, "--")
+	}
+	return append(args, cmdAndArgs...)
+}
+
+// apply rewrites cmd to run inside the sandbox
+func (s *sandbox) apply(cmd *exec.Cmd) error {
+	args := s.wrap(cmd.Args)
+	if len(args) > len(cmd.Args) {
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			return err
+		}
+		cmd.Path, cmd.Args = path, args
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = s.credential
+	return s.applyNamespaces(cmd.SysProcAttr)
+}
+
+// classify maps a failed run to a limit violation from how the
+// command ended and the end of its log, err is returned unchanged if
+// neither points to a configured limit. Most commands exit on their
+// own when a call fails with ENOMEM or EMFILE, only the log tells.
+func (s *sandbox) classify(state *os.ProcessState, err error, log []byte) error {
+	if err == nil || state == nil {
+		return err
+	}
+	var sig syscall.Signal
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		sig = ws.Signal()
+	}
+
+	if s.cpuTime > 0 {
+		if sig == syscall.SIGXCPU || (sig == syscall.SIGKILL && state.UserTime()+state.SystemTime() >= s.cpuTime) {
+			return fmt.Errorf("%w (%s): %v", errCPULimitExceeded, s.cpuTime, err)
+		}
+	}
+	if s.addrSpace > 0 && (addrSpaceSignals[sig] || containsAny(log, addrSpaceMessages)) {
+		return fmt.Errorf("%w (%d bytes): %v", errAddrSpaceLimitExceeded, s.addrSpace, err)
+	}
+	if s.openFiles > 0 && containsAny(log, openFilesMessages) {
+		return fmt.Errorf("%w (%d): %v", errOpenFilesLimitExceeded, s.openFiles, err)
+	}
+	return err
+}
+
+func containsAny(log []byte, messages []string) bool {
+	for _, m := range messages {
+		if bytes.Contains(log, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
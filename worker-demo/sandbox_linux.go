@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// applyNamespaces unshares the mount and network namespaces,
+// the runtime makes the new mount tree private so mounts
+// don't leak back to the host
+func (s *sandbox) applyNamespaces(attr *syscall.SysProcAttr) error {
+	if s.privateMount {
+		attr.Unshareflags |= syscall.CLONE_NEWNS
+	}
+	if s.privateNetwork {
+		// only an unconfigured loopback is left
+		attr.Unshareflags |= syscall.CLONE_NEWNET
+	}
+	return nil
+}
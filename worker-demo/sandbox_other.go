@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+func (s *sandbox) applyNamespaces(attr *syscall.SysProcAttr) error {
+	if s.privateMount || s.privateNetwork {
+		return errSandboxUnsupported
+	}
+	return nil
+}
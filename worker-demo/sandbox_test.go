@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSandboxWrap(t *testing.T) {
+	s := &sandbox{
+		cpuTime:     time.Minute,
+		addrSpace:   1 << 30,
+		openFiles:   1024,
+		nice:        10,
+		ioniceClass: "2",
+		ioniceLevel: 7,
+	}
+	got := s.wrap([]string{"rsync", "-a"})
+	want := []string{
+		"prlimit", "--cpu=60:65", "--as=1073741824", "--nofile=1024", "--",
+		"nice", "-n", "10", "--",
+		"ionice", "-c", "2", "-n", "7", "--",
+		"rsync", "-a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+	idle := &sandbox{ioniceClass: "3"}
+	if got := idle.wrap([]string{"true"}); !reflect.DeepEqual(got, []string{"ionice", "-c", "3", "--", "true"}) {
+		t.Fatalf("idle class: %q", got)
+	}
+}
+
+// the scripts end the way a command hitting the limit would
+func TestSandboxClassify(t *testing.T) {
+	tests := []struct {
+		name    string
+		sandbox sandbox
+		script  string
+		log     string
+		want    error
+		// in the message when the error isn't classified
+		msg string
+	}{
+		{"cpu soft limit", sandbox{cpuTime: time.Second}, "kill -XCPU $$", "", errCPULimitExceeded, ""},
+		{"failed stack growth", sandbox{addrSpace: 1 << 20}, "kill -SEGV $$", "", errAddrSpaceLimitExceeded, ""},
+		{"allocator abort", sandbox{addrSpace: 1 << 20}, "kill -ABRT $$", "", errAddrSpaceLimitExceeded, ""},
+		{"rsync allocation failure", sandbox{addrSpace: 1 << 20}, "exit 22",
+			"rsync error: error allocating core memory buffers (code 22) at util2.c(80) [sender=3.2.7]\n", errAddrSpaceLimitExceeded, ""},
+		{"ENOMEM", sandbox{addrSpace: 1 << 20}, "exit 1", "git: fork: Cannot allocate memory\n", errAddrSpaceLimitExceeded, ""},
+		{"EMFILE", sandbox{openFiles: 64}, "exit 23",
+			"rsync: [receiver] opendir \"pool\" failed: Too many open files (24)\n", errOpenFilesLimitExceeded, ""},
+		{"segfault without address space limit", sandbox{cpuTime: time.Second}, "kill -SEGV $$", "", nil, "signal: segmentation fault"},
+		{"terminated", sandbox{addrSpace: 1 << 20, cpuTime: time.Second}, "kill -TERM $$", "", nil, "signal: terminated"},
+		{"rsync partial transfer under limits", sandbox{addrSpace: 1 << 20, openFiles: 64}, "exit 23",
+			"rsync error: some files/attrs were not transferred (see previous errors) (code 23)\n", nil, "exit status 23"},
+		{"rsync timeout under limits", sandbox{addrSpace: 1 << 20, openFiles: 64}, "exit 30",
+			"rsync error: timeout in data send/receive (code 30)\n", nil, "exit status 30"},
+		{"EMFILE without open files limit", sandbox{addrSpace: 1 << 20}, "exit 3", "Too many open files\n", nil, "exit status 3"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("sh", "-c", tt.script)
+		err := cmd.Run()
+		err = tt.sandbox.classify(cmd.ProcessState, err, []byte(tt.log))
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if tt.want != nil {
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err.Error() != tt.msg {
+			t.Errorf("%s: got %q, want %q", tt.name, err, tt.msg)
+		}
+	}
+
+	cmd := exec.Command("true")
+	err := cmd.Run()
+	s := &sandbox{cpuTime: time.Second, addrSpace: 1 << 20, openFiles: 64}
+	if err := s.classify(cmd.ProcessState, err, []byte("Too many open files\n")); err != nil {
+		t.Fatalf("success classified as %v", err)
+	}
+}
+
+// the log the job wrote is what classify searches
+func TestSandboxClassifyFromLog(t *testing.T) {
+	p := newTestProvider(t, mirrorConfig{RLimitNOFILE: 64})
+	dir := t.TempDir()
+	c := newCmdJob(p, []string{"sh", "-c", "echo 'rsync: opendir failed: Too many open files (24)'; exit 23"}, dir, nil)
+	logFile, err := os.Create(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetLogFile(logFile)
+	if err := c.SetSandbox(p.(*cmdProvider).sandbox); err != nil {
+		t.Skip(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Wait(); !errors.Is(err, errOpenFilesLimitExceeded) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// the switched user gets the working dir the worker creates
+func TestSandboxRunAsUserWorkingDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	p := newTestProvider(t, mirrorConfig{RunAsUser: "nobody"})
+	s := p.(*cmdProvider).sandbox
+	if s == nil || s.credential == nil {
+		t.Fatal("no credential")
+	}
+	dir := filepath.Join(t.TempDir(), "debian")
+	c := newCmdJob(p, []string{"true"}, dir, nil)
+	if err := c.SetSandbox(s); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != s.credential.Uid || st.Gid != s.credential.Gid {
+		t.Fatalf("owned by %d:%d, want %d:%d", st.Uid, st.Gid, s.credential.Uid, s.credential.Gid)
+	}
+}
+
+func TestSandboxCPULimit(t *testing.T) {
+	s, err := newSandbox(mirrorConfig{RLimitCPU: 1})
+	if err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command("sh", "-c", "while :; do :; done")
+	if err := s.apply(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(cmd.Path, "prlimit") {
+		t.Fatalf("runs %s", cmd.Path)
+	}
+	start := time.Now()
+	err = cmd.Run()
+	err = s.classify(cmd.ProcessState, err, nil)
+	if !errors.Is(err, errCPULimitExceeded) {
+		t.Fatalf("got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("stopped after %s", time.Since(start))
+	}
+}
+
+func TestNewSandbox(t *testing.T) {
+	if s, err := newSandbox(mirrorConfig{}); s != nil || err != nil {
+		t.Fatalf("no limits: %v, %v", s, err)
+	}
+	for _, m := range []mirrorConfig{
+		{RLimitAS: -1},
+		{Nice: 20},
+		{IONiceClass: "fast"},
+		{IONiceLevel: 8},
+		{RunAsUser: "no-such-user-here"},
+	} {
+		if _, err := newSandbox(m); err == nil {
+			t.Errorf("%+v accepted", m)
+		}
+	}
+}
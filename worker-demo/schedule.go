@@ -33,12 +33,12 @@ func (q *scheduleQueue) AddJob(schedTime time.Time, job *mirrorJob) {
 	defer q.Unlock()
 	// remove exist job
 	if _, ok := q.jobs[job.Name()]; ok {
-		logger.Warnningf("Job %s already scheduled, removing the existing one", job.Name())
+		logger.WithMirror(job.Name()).Warning("Job already scheduled, removing the existing one")
 		q.unsafeRemove(job.Name())
 	}
 	q.jobs[job.Name()] = true
 	q.list.Set(schedTime, job)
-	logger.Debugf("Added job %s @ %v", job.Name(), schedTime)
+	logger.WithMirror(job.Name()).Debugf("Added job @ %v", schedTime)
 }
 
 // pop out the first job if it's time to run it
@@ -57,7 +57,7 @@ func (q *scheduleQueue) Pop() *mirrorJob {
 		job := first.Value().(*mirrorJob)
 		q.list.Delete(first.Key())
 		delete(q.jobs, job.Name())
-		logger.Debug("Poped out job %s @%v", job.Name(), t)
+		logger.WithMirror(job.Name()).Debugf("Poped out job @%v", t)
 		return job
 	}
 	return nil
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structured logging for job runs, each entry carries fields such as
+// mirror, worker, retry, status, duration and error, and is written
+// as text or one JSON object per line for the log pipeline
+
+type logLevel uint8
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelNotice
+	levelWarning
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelNotice:
+		return "notice"
+	case levelWarning:
+		return "warning"
+	case levelError:
+		return "error"
+	default:
+		return ""
+	}
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "", "notice":
+		return levelNotice, nil
+	case "warning", "warn":
+		return levelWarning, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelNotice, fmt.Errorf("invalid log level %q", s)
+	}
+}
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFields are attached to every entry of a logger
+type logFields map[string]interface{}
+
+// logCore is shared by a logger and all loggers derived from it
+type logCore struct {
+	sync.Mutex
+	out          io.Writer
+	json         bool
+	level        logLevel
+	mirrorLevels map[string]logLevel
+	base         logFields
+}
+
+type structLogger struct {
+	core   *logCore
+	fields logFields
+}
+
+var logger = newStructLogger(os.Stderr)
+
+func newStructLogger(out io.Writer) *structLogger {
+	return &structLogger{
+		core: &logCore{
+			out:          out,
+			level:        levelNotice,
+			mirrorLevels: make(map[string]logLevel),
+			base:         make(logFields),
+		},
+	}
+}
+
+// SetFormat selects "text" or "json" output
+func (l *structLogger) SetFormat(format string) error {
+	c := l.core
+	c.Lock()
+	defer c.Unlock()
+	switch format {
+	case "", logFormatText:
+		c.json = false
+	case logFormatJSON:
+		c.json = true
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	return nil
+}
+
+// SetLevel sets the level of entries without a mirror override
+func (l *structLogger) SetLevel(level logLevel) {
+	l.core.Lock()
+	l.core.level = level
+	l.core.Unlock()
+}
+
+// SetMirrorLevels replaces the per-mirror level overrides
+func (l *structLogger) SetMirrorLevels(levels map[string]logLevel) {
+	l.core.Lock()
+	l.core.mirrorLevels = levels
+	l.core.Unlock()
+}
+
+// SetBaseField adds a field to every entry of every logger,
+// such as the worker name
+func (l *structLogger) SetBaseField(key string, value interface{}) {
+	l.core.Lock()
+	l.core.base[key] = value
+	l.core.Unlock()
+}
+
+// WithFields returns a logger adding fields to its entries
+func (l *structLogger) WithFields(fields logFields) *structLogger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &structLogger{core: l.core, fields: merged}
+}
+
+// WithMirror is a shortcut for WithFields(logFields{"mirror": name})
+func (l *structLogger) WithMirror(name string) *structLogger {
+	return l.WithFields(logFields{"mirror": name})
+}
+
+// WithError adds the error message as the "error" field
+func (l *structLogger) WithError(err error) *structLogger {
+	if err == nil {
+		return l
+	}
+	return l.WithFields(logFields{"error": err.Error()})
+}
+
+func (l *structLogger) enabled(level logLevel) bool {
+	c := l.core
+	min := c.level
+	if mirror, ok := l.fields["mirror"].(string); ok {
+		if ml, ok := c.mirrorLevels[mirror]; ok {
+			min = ml
+		}
+	}
+	return level >= min
+}
+
+func (l *structLogger) log(level logLevel, msg string) {
+	c := l.core
+	c.Lock()
+	defer c.Unlock()
+	if !l.enabled(level) {
+		return
+	}
+
+	now := time.Now()
+	fields := make(logFields, len(c.base)+len(l.fields))
+	for k, v := range c.base {
+		fields[fieldKey(k)] = v
+	}
+	for k, v := range l.fields {
+		fields[fieldKey(k)] = v
+	}
+
+	if c.json {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			entry[k] = jsonFieldValue(v)
+		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = level.String()
+		entry["msg"] = msg
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"level": "error", "msg": "unencodable log entry: " + err.Error()})
+		}
+		c.out.Write(append(b, '\n'))
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s [%s] %s", now.Format("2006-01-02 15:04:05"), strings.ToUpper(level.String()), msg)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&sb, " %s=%s", k, v)
+	}
+	sb.WriteByte('\n')
+	io.WriteString(c.out, sb.String())
+}
+
+// fieldKey prefixes fields named like the keys of every entry,
+// so they don't overwrite them
+func fieldKey(k string) string {
+	switch k {
+	case "time", "level", "msg":
+		return "fields." + k
+	}
+	return k
+}
+
+// jsonFieldValue keeps fields readable for the log pipeline:
+// durations in seconds, errors and enums by their text
+func jsonFieldValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case time.Duration:
+		return val.Seconds()
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	default:
+		return v
+	}
+}
+
+func (l *structLogger) Debug(args ...interface{})   { l.log(levelDebug, fmt.Sprint(args...)) }
+func (l *structLogger) Info(args ...interface{})    { l.log(levelInfo, fmt.Sprint(args...)) }
+func (l *structLogger) Notice(args ...interface{})  { l.log(levelNotice, fmt.Sprint(args...)) }
+func (l *structLogger) Warning(args ...interface{}) { l.log(levelWarning, fmt.Sprint(args...)) }
+func (l *structLogger) Error(args ...interface{})   { l.log(levelError, fmt.Sprint(args...)) }
+
+func (l *structLogger) Debugf(format string, args ...interface{}) {
+	l.log(levelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) Infof(format string, args ...interface{}) {
+	l.log(levelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) Noticef(format string, args ...interface{}) {
+	l.log(levelNotice, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) Warningf(format string, args ...interface{}) {
+	l.log(levelWarning, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) Errorf(format string, args ...interface{}) {
+	l.log(levelError, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStructLoggerText(t *testing.T) {
+	var out bytes.Buffer
+	l := newStructLogger(&out)
+	l.SetBaseField("worker", "w1")
+	l.WithMirror("debian").WithFields(logFields{
+		"retry":    1,
+		"status":   Success,
+		"duration": 1500 * time.Millisecond,
+		"cmd":      `rsync -a "src"`,
+	}).WithError(errors.New("exit status 23")).Notice("succeeded syncing")
+
+	pattern := regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} \[NOTICE\] succeeded syncing ` +
+		`cmd="rsync -a \\"src\\"" duration=1.5s error="exit status 23" mirror=debian retry=1 status=success worker=w1\n$`)
+	if !pattern.MatchString(out.String()) {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestStructLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	l := newStructLogger(&out)
+	if err := l.SetFormat(logFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	l.SetBaseField("worker", "w1")
+	l.WithMirror("debian").WithFields(logFields{
+		"retry":    2,
+		"status":   Failed,
+		"duration": 1500 * time.Millisecond,
+	}).WithError(errors.New("exit status 23")).Warningf("failed syncing %s", "debian")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("%q: %v", out.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":    "warning",
+		"msg":      "failed syncing debian",
+		"worker":   "w1",
+		"mirror":   "debian",
+		"retry":    2.0,
+		"status":   "failed",
+		"duration": 1.5,
+		"error":    "exit status 23",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s: got %v, want %v", k, entry[k], v)
+		}
+	}
+	ts, ok := entry["time"].(string)
+	if _, err := time.Parse(time.RFC3339Nano, ts); !ok || err != nil {
+		t.Errorf("time %v: %v", entry["time"], err)
+	}
+	if len(entry) != len(want)+1 {
+		t.Errorf("unexpected fields in %v", entry)
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("}\n")) || bytes.Count(out.Bytes(), []byte("\n")) != 1 {
+		t.Errorf("not one object per line: %q", out.String())
+	}
+
+	// an unencodable value still gives a line
+	out.Reset()
+	l.WithFields(logFields{"ch": make(chan int)}).Notice("oops")
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil || entry["level"] != "error" {
+		t.Errorf("got %q", out.String())
+	}
+
+	if err := l.SetFormat("xml"); err == nil {
+		t.Error("xml accepted")
+	}
+}
+
+func TestStructLoggerReservedFields(t *testing.T) {
+	var out bytes.Buffer
+	l := newStructLogger(&out)
+	l.SetFormat(logFormatJSON)
+	l.SetBaseField("level", "base")
+	l.WithFields(logFields{"time": "user", "msg": "user"}).Notice("real")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "notice" || entry["msg"] != "real" || entry["time"] == "user" {
+		t.Errorf("built-in keys overwritten: %v", entry)
+	}
+	for _, k := range []string{"fields.time", "fields.level", "fields.msg"} {
+		if _, ok := entry[k]; !ok {
+			t.Errorf("%s missing from %v", k, entry)
+		}
+	}
+
+	out.Reset()
+	l.SetFormat(logFormatText)
+	l.WithFields(logFields{"msg": "user"}).Notice("real")
+	if !strings.Contains(out.String(), "] real fields.level=base fields.msg=user\n") {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestStructLoggerLevels(t *testing.T) {
+	var out bytes.Buffer
+	l := newStructLogger(&out)
+	l.SetMirrorLevels(map[string]logLevel{"debian": levelDebug, "ubuntu": levelError})
+
+	lines := func() int {
+		n := strings.Count(out.String(), "\n")
+		out.Reset()
+		return n
+	}
+
+	// notice by default
+	l.Info("hidden")
+	l.Notice("shown")
+	l.Warning("shown")
+	if n := lines(); n != 2 {
+		t.Errorf("default level: %d lines", n)
+	}
+
+	l.WithMirror("debian").Debug("shown")
+	l.WithMirror("ubuntu").Warning("hidden")
+	l.WithMirror("ubuntu").Error("shown")
+	l.WithMirror("arch").Info("hidden")
+	if n := lines(); n != 2 {
+		t.Errorf("mirror levels: %d lines", n)
+	}
+
+	// derived loggers follow later changes
+	debian := l.WithMirror("debian")
+	l.SetMirrorLevels(nil)
+	l.SetLevel(levelWarning)
+	debian.Notice("hidden")
+	l.Error("shown")
+	if n := lines(); n != 1 {
+		t.Errorf("after SetLevel: %d lines", n)
+	}
+
+	// WithFields doesn't change its parent
+	parent := l.WithFields(logFields{"a": 1})
+	parent.WithFields(logFields{"b": 2})
+	parent.WithError(nil).Error("x")
+	if got := out.String(); !strings.HasSuffix(got, "] x a=1\n") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		s    string
+		want logLevel
+	}{
+		{"", levelNotice},
+		{"debug", levelDebug},
+		{"INFO", levelInfo},
+		{"notice", levelNotice},
+		{"warn", levelWarning},
+		{"Warning", levelWarning},
+		{"error", levelError},
+	}
+	for _, tt := range tests {
+		if got, err := parseLogLevel(tt.s); err != nil || got != tt.want {
+			t.Errorf("%q: %v, %v", tt.s, got, err)
+		}
+		if got, _ := parseLogLevel(tt.want.String()); got != tt.want {
+			t.Errorf("%v doesn't round trip", tt.want)
+		}
+	}
+	if _, err := parseLogLevel("fatal"); err == nil {
+		t.Error("fatal accepted")
+	}
+}
+
+func TestSyncStatusString(t *testing.T) {
+	if got := PreSyncing.String(); got != "pre-syncing" {
+		t.Errorf("got %q", got)
+	}
+	if got := SyncStatus(200).String(); got != "SyncStatus(200)" {
+		t.Errorf("got %q", got)
+	}
+}
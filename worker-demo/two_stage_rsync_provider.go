@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// package repositories are synced in two stages, the packages first
+// and the indices referring to them after, so clients never see
+// indices of packages that aren't there yet. both stages append to
+// the log of the run and a failure of either fails the attempt
+
+const stage1ProfileCustom = "custom"
+
+// rsyncStage1Profiles lists what the first stage leaves out
+var rsyncStage1Profiles = map[string][]string{
+	"debian": {
+		"dists/",
+		"ls-lR*",
+	},
+	"ubuntu": {
+		"dists/",
+		"indices/",
+		"ls-lR*",
+		"project/trace/",
+	},
+}
+
+var errTerminatedBetweenStages = errors.New("terminated between stages")
+
+type twoStageRsyncProvider struct {
+	*baseProvider
+	rsyncCmd      string
+	username      string
+	password      string
+	stage1Options []string
+	stage2Options []string
+
+	stage      int
+	terminated bool
+	stats      rsyncStats
+}
+
+func newTwoStageRsyncProvider(base *baseProvider, mirror mirrorConfig) (*twoStageRsyncProvider, error) {
+	if !strings.HasSuffix(mirror.Upstream, "/") {
+		return nil, errors.New("rsync upstream URL should ends with /")
+	}
+	if mirror.UseIPv4 && mirror.UseIPv6 {
+		return nil, errors.New("use_ipv4 and use_ipv6 are exclusive")
+	}
+
+	var stage1Exclude []string
+	switch mirror.Stage1Profile {
+	case stage1ProfileCustom:
+		if len(mirror.Stage1Exclude) == 0 {
+			return nil, errors.New("stage1_exclude is required by the custom profile")
+		}
+		stage1Exclude = mirror.Stage1Exclude
+	case "":
+		return nil, errors.New("stage1_profile is required")
+	default:
+		profile, ok := rsyncStage1Profiles[mirror.Stage1Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage1 profile %q", mirror.Stage1Profile)
+		}
+		stage1Exclude = profile
+	}
+
+	common, err := rsyncCommonOptions(mirror)
+	if err != nil {
+		return nil, err
+	}
+	// the first stage only adds files, nothing is deleted
+	// before the new indices are in place
+	stage1Options := append([]string(nil), common...)
+	for _, pattern := range stage1Exclude {
+		stage1Options = append(stage1Options, "--exclude", pattern)
+	}
+	stage1Options = append(stage1Options, mirror.RsyncOptions...)
+
+	stage2Options, err := rsyncOptions(mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &twoStageRsyncProvider{
+		baseProvider:  base,
+		rsyncCmd:      mirror.RsyncCmd,
+		username:      mirror.Username,
+		password:      mirror.Password,
+		stage1Options: stage1Options,
+		stage2Options: stage2Options,
+		stage:         1,
+	}
+	if p.rsyncCmd == "" {
+		p.rsyncCmd = "rsync"
+	}
+	return p, nil
+}
+
+func (p *twoStageRsyncProvider) Type() string {
+	return provTwoStageRsync
+}
+
+// Stats returns the statistics of the second stage of the last
+// successful run, it covers the whole tree
+func (p *twoStageRsyncProvider) Stats() rsyncStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
+
+func (p *twoStageRsyncProvider) Run() error {
+	p.dataSize.Store("")
+	p.Lock()
+	p.terminated = false
+	p.Unlock()
+
+	log := logger.WithMirror(p.Name())
+	for stage := 1; stage <= 2; stage++ {
+		p.Lock()
+		p.stage = stage
+		p.Unlock()
+
+		log.WithFields(logFields{"stage": stage}).Debug("rsync stage started")
+		if err := p.Start(); err != nil {
+			return fmt.Errorf("stage %d: %w", stage, err)
+		}
+		if err := p.Wait(); err != nil {
+			return fmt.Errorf("stage %d: %w", stage, err)
+		}
+	}
+
+	// both stages append to the log, the summary of stage 2 ends it
+	// and so is within the tail parsed. when stage 1's summary is in
+	// the tail too, the fields of the later one win
+	stats, err := p.loadRsyncStats()
+	if err != nil {
+		log.WithError(err).Warning("failed to parse rsync stats")
+		return nil
+	}
+	p.Lock()
+	p.stats = stats
+	p.Unlock()
+	return nil
+}
+
+// Start starts the current stage
+func (p *twoStageRsyncProvider) Start() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.terminated {
+		return errTerminatedBetweenStages
+	}
+	options := p.stage1Options
+	if p.stage == 2 {
+		options = p.stage2Options
+	}
+	command := []string{p.rsyncCmd}
+	command = append(command, options...)
+	command = append(command, p.upstream, p.WorkingDir())
+	return p.startCmd(p, command, rsyncEnv(p.username, p.password))
+}
+
+// Terminate stops the running stage and keeps the next one from
+// starting
+func (p *twoStageRsyncProvider) Terminate() error {
+	p.Lock()
+	p.terminated = true
+	p.Unlock()
+	return p.baseProvider.Terminate()
+}
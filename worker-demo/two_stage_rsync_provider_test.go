@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRsync writes an rsync look-alike into dir. Every call is appended
+// to dir/calls, the stage is told by --delay-updates which only stage 2
+// has. It prints dir/out<stage>, fails if dir/fail<stage> exists, and if
+// dir/block<stage> exists it waits to be terminated and exits 0 then,
+// as if it was done right before.
+func fakeRsync(t *testing.T, dir string) string {
+	t.Helper()
+	script := `#!/bin/sh
+dir=` + dir + `
+echo "$*" >> $dir/calls
+stage=1
+case " $* " in
+*" --delay-updates "*) stage=2 ;;
+esac
+[ -e $dir/out$stage ] && cat $dir/out$stage
+if [ -e $dir/fail$stage ]; then
+	echo "rsync error: some files/attrs were not transferred (code 23)"
+	exit 23
+fi
+if [ -e $dir/block$stage ]; then
+	trap 'exit 0' TERM
+	touch $dir/started
+	sleep 30 &
+	wait
+fi
+exit 0
+`
+	path := filepath.Join(dir, "rsync")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestTwoStageProvider(t *testing.T, dir string, mirror mirrorConfig) *twoStageRsyncProvider {
+	t.Helper()
+	mirror.Provider = provTwoStageRsync
+	mirror.Upstream = "rsync://mirrors.example.com/debian/"
+	mirror.RsyncCmd = fakeRsync(t, dir)
+	if mirror.Stage1Profile == "" {
+		mirror.Stage1Profile = "debian"
+	}
+	p := newTestProvider(t, mirror).(*twoStageRsyncProvider)
+	if err := os.MkdirAll(p.LogDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestNewTwoStageRsyncProvider(t *testing.T) {
+	base := newBaseProvider(mirrorConfig{Name: "debian"}, t.TempDir(), t.TempDir(), &nativeBackend{}, nil)
+	up := "rsync://mirrors.example.com/debian/"
+	tests := []struct {
+		name    string
+		mirror  mirrorConfig
+		exclude []string
+	}{
+		{"debian", mirrorConfig{Upstream: up, Stage1Profile: "debian"}, rsyncStage1Profiles["debian"]},
+		{"ubuntu", mirrorConfig{Upstream: up, Stage1Profile: "ubuntu"}, rsyncStage1Profiles["ubuntu"]},
+		{"custom", mirrorConfig{Upstream: up, Stage1Profile: stage1ProfileCustom,
+			Stage1Exclude: []string{"repodata/"}}, []string{"repodata/"}},
+		{"no profile", mirrorConfig{Upstream: up}, nil},
+		{"unknown profile", mirrorConfig{Upstream: up, Stage1Profile: "fedora"}, nil},
+		{"custom without excludes", mirrorConfig{Upstream: up, Stage1Profile: stage1ProfileCustom}, nil},
+		{"no trailing slash", mirrorConfig{Upstream: "rsync://mirrors.example.com/debian", Stage1Profile: "debian"}, nil},
+		{"ipv4 and ipv6", mirrorConfig{Upstream: up, Stage1Profile: "debian", UseIPv4: true, UseIPv6: true}, nil},
+		{"unknown delete mode", mirrorConfig{Upstream: up, Stage1Profile: "debian", DeleteMode: "never"}, nil},
+	}
+	for _, tt := range tests {
+		p, err := newTwoStageRsyncProvider(base, tt.mirror)
+		if tt.exclude == nil {
+			if err == nil {
+				t.Errorf("%s: accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		stage1 := strings.Join(p.stage1Options, " ")
+		for _, pattern := range tt.exclude {
+			if !strings.Contains(stage1, "--exclude "+pattern) {
+				t.Errorf("%s: stage 1 doesn't exclude %s: %s", tt.name, pattern, stage1)
+			}
+			if strings.Contains(strings.Join(p.stage2Options, " "), "--exclude "+pattern) {
+				t.Errorf("%s: stage 2 excludes %s", tt.name, pattern)
+			}
+		}
+	}
+}
+
+func TestTwoStageRsyncProviderRun(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestTwoStageProvider(t, dir, mirrorConfig{
+		Username:     "mirror",
+		Password:     "secret",
+		RsyncOptions: []string{"--info=progress2"},
+	})
+	// a summary for each stage, stage 2's is the one reported
+	ioutil.WriteFile(filepath.Join(dir, "out1"), []byte(
+		"debian/pool/main/a/apt/apt_2.7.14_amd64.deb\n\n"+
+			"Number of files: 10\nNumber of regular files transferred: 1\nTotal file size: 1,024 bytes\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "out2"), []byte(rsyncStats31), 0644)
+
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	calls := readCalls(t, dir)
+	if len(calls) != 2 {
+		t.Fatalf("calls %q", calls)
+	}
+	for i, call := range calls {
+		args := " " + call + " "
+		del := strings.Contains(args, " --delete ")
+		delay := strings.Contains(args, " --delay-updates ")
+		dists := strings.Contains(args, " --exclude dists/ ")
+		if i == 0 && (del || delay || !dists) {
+			t.Errorf("stage 1: %s", call)
+		}
+		if i == 1 && (!del || !delay || dists) {
+			t.Errorf("stage 2: %s", call)
+		}
+		if !strings.HasSuffix(call, " --info=progress2 "+p.Upstream()+" "+p.WorkingDir()) {
+			t.Errorf("stage %d: %s", i+1, call)
+		}
+	}
+
+	log, _ := ioutil.ReadFile(p.LogFile())
+	if !strings.HasPrefix(string(log), "debian/pool/main/a/apt") || !strings.HasSuffix(string(log), rsyncStats31) {
+		t.Errorf("log %q", log)
+	}
+	if p.Stats().TotalSize != 3298534883328 || p.Stats().Files != 1234567 || p.DataSize() != "3.00T" {
+		t.Errorf("stats %+v, size %s", p.Stats(), p.DataSize())
+	}
+
+	// a long transfer list in stage 2 pushes stage 1's summary out of
+	// the tail, the result is the same
+	ioutil.WriteFile(filepath.Join(dir, "out2"), []byte(
+		strings.Repeat("debian/pool/main/a/apt/apt_2.7.14_amd64.deb\n", 1000)+rsyncStats31), 0644)
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if p.DataSize() != "3.00T" {
+		t.Errorf("long stage 2: size %s", p.DataSize())
+	}
+}
+
+func TestTwoStageRsyncProviderStage1Fails(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestTwoStageProvider(t, dir, mirrorConfig{})
+	ioutil.WriteFile(filepath.Join(dir, "fail1"), nil, 0644)
+
+	err := p.Run()
+	if err == nil || !strings.HasPrefix(err.Error(), "stage 1: ") {
+		t.Fatalf("got %v", err)
+	}
+	if calls := readCalls(t, dir); len(calls) != 1 {
+		t.Fatalf("stage 2 started: %q", calls)
+	}
+	if p.DataSize() != "" || p.IsRunning() {
+		t.Fatalf("size %q, running %v", p.DataSize(), p.IsRunning())
+	}
+
+	// stage 2 failing fails the attempt too
+	os.Remove(filepath.Join(dir, "fail1"))
+	ioutil.WriteFile(filepath.Join(dir, "fail2"), nil, 0644)
+	if err := p.Run(); err == nil || !strings.HasPrefix(err.Error(), "stage 2: ") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestTwoStageRsyncProviderTerminate(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestTwoStageProvider(t, dir, mirrorConfig{})
+	ioutil.WriteFile(filepath.Join(dir, "block1"), nil, 0644)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run()
+	}()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "started")); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("stage 1 not started")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// stage 1 exits cleanly when terminated, stage 2 must not start
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, errTerminatedBetweenStages) {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return")
+	}
+	if calls := readCalls(t, dir); len(calls) != 1 {
+		t.Fatalf("stage 2 started: %q", calls)
+	}
+
+	// the next run starts over
+	os.Remove(filepath.Join(dir, "block1"))
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, dir); len(calls) != 3 {
+		t.Fatalf("calls %q", calls)
+	}
+}
@@ -23,9 +23,10 @@ type Worker struct {
 	semaphore   chan empty
 	exit        chan empty
 
-	schedule   *scheduleQueue
-	httpEngine *gin.Engine
-	httpClient *http.Client
+	schedule    *scheduleQueue
+	httpEngine  *gin.Engine
+	httpClient  *http.Client
+	tlsProvider *ReloadingTLSProvider
 }
 
 // GetTUNASyncWorker returns a singalton worker
@@ -45,13 +46,29 @@ func GetTUNASyncWorker(cfg *Config) *Worker {
 		schedule: newScheduleQueue(),
 	}
 
-	if cfg.Manager.CACert != "" {
-		httpClient, err := CreateHTTPClient(cfg.Manager.CACert)
+	if err := configureLogger(cfg); err != nil {
+		logger.WithError(err).Error("Error configuring logger")
+		return nil
+	}
+
+	if cfg.Manager.CACert != "" || cfg.Manager.ClientCert != "" {
+		// rotated certificates are picked up without a restart
+		tlsProvider, err := NewReloadingTLSProvider(
+			cfg.Manager.CACert, cfg.Manager.ClientCert, cfg.Manager.ClientKey,
+			time.Duration(cfg.Manager.TLSReloadInterval)*time.Second,
+		)
+		if err != nil {
+			logger.WithError(err).Error("Error loading manager certificates")
+			return nil
+		}
+		httpClient, err := NewHTTPClient(WithTLSProvider(tlsProvider))
 		if err != nil {
-			logger.Errorf("Error initializing HTTP client: %s", err.Error())
+			logger.WithError(err).Error("Error initializing HTTP client")
 			return nil
 		}
+		tlsProvider.Start()
 		w.httpClient = httpClient
+		w.tlsProvider = tlsProvider
 	}
 
 	w.initJobs()
@@ -78,6 +95,9 @@ func (w *Worker) Halt() {
 	}
 	jobsDone.Wait()
 	logger.Notice("All the jobs are stopped")
+	if w.tlsProvider != nil {
+		w.tlsProvider.Stop()
+	}
 	w.L.Unlock()
 	close(w.exit)
 }
@@ -92,29 +112,40 @@ func (w *Worker) ReloadMirrorConfig(newMirrors []mirrorConfig) {
 	oldMirrors := w.cfg.Mirrors
 	difference := diffMirrorConfig(oldMirrors, newMirrors)
 
+	if levels, err := mirrorLogLevels(newMirrors); err != nil {
+		logger.WithError(err).Warning("Keeping previous mirror log levels")
+	} else {
+		logger.SetMirrorLevels(levels)
+	}
+
 	// first deal with deletion and modifications
 	for _, op := range difference {
 		if op.diffOp == diffAdd {
 			contine
 		}
 		name := op.mirCfg.Name
+		log := logger.WithMirror(name)
 		job, ok := w.jobs[name]
 		if !ok {
-			logger.Warningf("Job %s not found", name)
+			log.Warning("Job not found")
 			continue
 		}
 		switch op.diffOp {
 		case diffDelete:
 			w.disableJob(job)
 			delte(w.jobs, name)
-			logger.Noticef("Deleted job %s", name)
+			log.Notice("Deleted job")
 		case diffModify:
 			jobState := job.State()
 			w.disableJob(job)
 			// set new provider
-			provider := newMirrorProvider(op.mirCfg, w.cfg)
+			provider, err := newMirrorProvider(op.mirCfg, w.cfg)
+			if err != nil {
+				log.WithError(err).Error("Error creating job provider, job stays disabled")
+				continue
+			}
 			if err := job.SetProvider(provider); err != nil {
-				logger.Errorf("Error setting job provider of %s: %s", name, err.Error())
+				log.WithError(err).Error("Error setting job provider")
 				continue
 			}
 
@@ -129,7 +160,7 @@ func (w *Worker) ReloadMirrorConfig(newMirrors []mirrorConfig) {
 				go job.Run(w.managerChan, w.semaphore)
 				w.schedule.AddJob(time.Now(), job)
 			}
-			logger.Noticef("Reloaded job %s", name)
+			log.Notice("Reloaded job")
 		}
 	}
 	// for added new jobs, just start new jobs
@@ -137,7 +168,11 @@ func (w *Worker) ReloadMirrorConfig(newMirrors []mirrorConfig) {
 		if op.diffOp != diffAdd {
 			continue
 		}
-		provider := newMirrorProvider(op.mirCfg, w.cfg)
+		provider, err := newMirrorProvider(op.mirCfg, w.cfg)
+		if err != nil {
+			logger.WithMirror(op.mirCfg.Name).WithError(err).Error("Error creating job provider")
+			continue
+		}
 		job := newMirrorJob(provider)
 		w.jobs[provider.Name()] = job
 
@@ -145,7 +180,7 @@ func (w *Worker) ReloadMirrorConfig(newMirrors []mirrorConfig) {
 
 		go job.Run(w.managerChan, w.semaphore)
 		w.schedule.AddJob(time.Now(), job)
-		logger.Noticef("New job %s", job.Name())
+		logger.WithMirror(job.Name()).Notice("New job")
 	}
 
 	w.cfg.Mirrors = newMirrors
@@ -154,7 +189,11 @@ func (w *Worker) ReloadMirrorConfig(newMirrors []mirrorConfig) {
 func (w *Worker) initJobs() {
 	for _, mirror := range w.cfg.Mirrors {
 		// Create Provider
-		provider := newMirrorProvider(mirror, w.cfg)
+		provider, err := newMirrorProvider(mirror, w.cfg)
+		if err != nil {
+			logger.WithMirror(mirror.Name).WithError(err).Error("Error creating job provider")
+			continue
+		}
 		w.jobs[provider.Name()] = newMirrorJob(provider)
 	}
 }
@@ -243,6 +282,8 @@ func (w *Worker) makeHTTPServer() {
 
 		c.JSON(http.StatusOK, gin.H{"msg": "OK"})
 	})
+	// served by the same engine as commands, behind the same TLS setup
+	s.GET("/jobs/:mirror/log", w.handleLogTail)
 	w.httpEngine = s
 }
 
@@ -294,7 +335,7 @@ func (w *Worker) runSchedule() {
 				go job.Run(w.managerChan, w.semaphore)
 				stime := m.LastUpdate.Add(job.provider.Interval())
 
-				logger.Debugf("Scheduling job %s @%s", job.Name(), stime.Format("2006-01-02 15:04:05"))
+				logger.WithMirror(job.Name()).Debugf("Scheduling job @%s", stime.Format("2006-01-02 15:04:05"))
 				w.schedule.AddJob(stime, job)
 			}
 		}
@@ -320,12 +361,12 @@ func (w *Worker) runSchedule() {
 			job, ok := w.jobs[jobMsg.name]
 			w.L.Unlock()
 			if !ok {
-				logger.Warningf("Job %s not found", jobMsg.name)
+				logger.WithMirror(jobMsg.name).Warning("Job not found")
 				continue
 			}
 
 			if (job.State() != stateReady) && (job.State() != stateHalting) {
-				logger.Infof("Job %s state is not ready, skip adding new schedule", jobMsg.name)
+				logger.WithMirror(jobMsg.name).Info("Job state is not ready, skip adding new schedule")
 				continue
 			}
 
@@ -338,9 +379,8 @@ func (w *Worker) runSchedule() {
 			// can trigger scheduling
 			if jobMsg.schedule {
 				schedTime := time.Now().Add(job.provider.Interval())
-				logger.Noticef(
-					"Next scheduled time for %s: %s",
-					job.Name(),
+				logger.WithMirror(job.Name()).Noticef(
+					"Next scheduled time: %s",
 					schedTime.Format("2006-01-02 15:04:05"),
 				)
 				w.schedule.AddJob(schedTime, job)
@@ -357,7 +397,7 @@ func (w *Worker) runSchedule() {
 			for {
 				select {
 				case jobMsg := <-w.managerChan:
-					logger.Debugf("status update from %s", jobMsg.name)
+					logger.WithMirror(jobMsg.name).Debug("status update")
 					job, ok := w.jobs[jobMsg.name]
 					if !ok {
 						continue
@@ -374,6 +414,30 @@ func (w *Worker) runSchedule() {
 	}
 }
 
+func (w *Worker) updateStatus(job *mirrorJob, jobMsg jobMessage) {
+	smsg := MirrorStatus{
+		Name:     jobMsg.name,
+		Worker:   w.cfg.Global.Name,
+		Status:   jobMsg.status,
+		Upstream: job.provider.Upstream(),
+		Size:     "unknown",
+		ErrorMsg: jobMsg.msg,
+	}
+
+	// providers like rsync know the size of the mirror
+	if size := job.Size(); size != "" {
+		smsg.Size = size
+	}
+
+	for _, root := range w.cfg.Manager.APIBaseList() {
+		url := fmt.Sprintf("%s/workers/%s/jobs/%s", root, w.Name(), jobMsg.name)
+		logger.WithMirror(jobMsg.name).Debugf("reporting on manager url: %s", url)
+		if _, err := PostJSON(url, smsg, w.httpClient); err != nil {
+			logger.WithMirror(jobMsg.name).WithError(err).Error("Failed to update mirror status")
+		}
+	}
+}
+
 // Name returns worker name
 func (w *Worker) Name() string {
 	return w.cfg.Global.Name
@@ -399,7 +463,41 @@ func (w *Worker) registorWorker() {
 		url := fmt.Sprintf("%s/workers", root)
 		logger.Debugf("register on manager url: %s", url)
 		if _, err := PostJSON(url, msg, w.httpClient); err != nil {
-			logger.Errorf("Failed to register worker")
+			logger.WithError(err).Errorf("Failed to register worker on %s", url)
+		}
+	}
+}
+
+// configureLogger applies the log format and levels of cfg
+func configureLogger(cfg *Config) error {
+	if err := logger.SetFormat(cfg.Global.LogFormat); err != nil {
+		return err
+	}
+	level, err := parseLogLevel(cfg.Global.LogLevel)
+	if err != nil {
+		return err
+	}
+	levels, err := mirrorLogLevels(cfg.Mirrors)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(level)
+	logger.SetMirrorLevels(levels)
+	logger.SetBaseField("worker", cfg.Global.Name)
+	return nil
+}
+
+func mirrorLogLevels(mirrors []mirrorConfig) (map[string]logLevel, error) {
+	levels := make(map[string]logLevel)
+	for _, m := range mirrors {
+		if m.LogLevel == "" {
+			continue
+		}
+		level, err := parseLogLevel(m.LogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s: %s", m.Name, err.Error())
 		}
+		levels[m.Name] = level
 	}
+	return levels, nil
 }